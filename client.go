@@ -2,177 +2,276 @@ package higgs
 
 
 import (
-	"crypto/tls"
-	"fmt"
+	"context"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
 	Client struct {
-		HTTP         *http.Client
-		Store        *DB
-		Log          *log.Logger
-		UserAgent    string
-		ESIRateLimit *safeCounter
-		RetryLimit   int
-		MaxRoutines  int
-	}
-
-	safeCounter struct {
-		cnt int
-		mux sync.Mutex
+		HTTP      *http.Client
+		Store     Store
+		Log       *slog.Logger
+		UserAgent string
+		// Retry is how requests are retried, the zero value uses the defaults
+		Retry       RetryPolicy
+		MaxRoutines int
+		Languages   []string
+		// ESIBaseURL is where ESI is, without a trailing slash
+		ESIBaseURL string
+		// StartDelay is how long to wait after warning that a universe populate is about to start
+		StartDelay time.Duration
+
+		recorder *Recorder
+		// pacer keeps ESI requests under the rate and concurrency limits, nil for no limits
+		pacer *pacer
+		// staged fills a staging database and only moves the collections into place once a run succeeds, so
+		// nothing reading them sees them empty or half done. The daemon sets it
+		staged bool
 	}
 )
 
+const defaultESIBaseURL = "https://esi.evetech.net"
+
 func newClient(config Configuration) (*Client, error) {
-	logger := log.New(os.Stdout, "CLIENT:", log.Lshortfile|log.Ldate|log.Ltime)
+	return newClientWithStore(config, nil)
+}
 
-	// now check we have access to mongo
+// newClientWithStore is newClient writing to store instead, nil connects to the database in config
+func newClientWithStore(config Configuration, store Store) (*Client, error) {
+	logger, err := NewLogger(config.App)
+	if err != nil {
+		return nil, err
+	}
 
-	store, err := GetDatabaseHandle(config)
+	languages, err := validateLanguages(config.App.Languages)
+	if err != nil {
+		return nil, err
+	}
 
+	esiBaseURL := strings.TrimRight(config.Web.ESIBaseURL, "/")
+	if esiBaseURL == "" {
+		esiBaseURL = defaultESIBaseURL
+	}
+
+	httpTransport, err := newTransport(config.Web, config.App.MaxRoutines)
 	if err != nil {
 		return nil, err
 	}
+	if config.Web.Transport.InsecureSkipVerify {
+		logger.Warn("Not verifying TLS certificates, web.Transport.InsecureSkipVerify is set")
+	}
+	var transport http.RoundTripper = httpTransport
+
+	var recorder *Recorder
+	switch {
+	case config.Web.Record != "" && config.Web.Replay != "":
+		return nil, errors.New("web.Record and web.Replay cant both be set")
+	case config.Web.Replay != "":
+		replayer, err := LoadReplay(config.Web.Replay)
+		if err != nil {
+			return nil, err
+		}
+		replayer.Base = transport
+		replayer.Match = matchHost(esiBaseURL)
+		transport = replayer
+		logger.Info("Replaying ESI", "from", config.Web.Replay)
+	case config.Web.Record != "":
+		recorder, err = NewRecorder(config.Web.Record, transport)
+		if err != nil {
+			return nil, err
+		}
+		recorder.Match = matchHost(esiBaseURL)
+		transport = recorder
+		logger.Info("Recording ESI", "to", config.Web.Record)
+	}
 
-	rateLimESI := &safeCounter{}
+	// now check we have access to mongo
+
+	if store == nil {
+		db, err := GetDatabaseHandle(config)
 
-	go func() {
-		for {
-			time.Sleep(time.Second)
-			if rateLimESI.Value() > 0 {
-				rateLimESI.Dec()
+		if err != nil {
+			if recorder != nil {
+				recorder.Close()
 			}
+			return nil, err
 		}
-	}()
+		store = db
+	}
 
 	return &Client{
 		HTTP: &http.Client{
-			Timeout: time.Second * time.Duration(config.Web.TimeoutSec),
-			Transport: &http.Transport{
-				MaxConnsPerHost:     10,
-				MaxIdleConnsPerHost: 2,
-				TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
-			},
+			Timeout:   time.Second * time.Duration(config.Web.TimeoutSec),
+			Transport: transport,
 		},
-		Store:        store,
-		Log:          logger,
-		UserAgent:    config.Web.UserAgent,
-		ESIRateLimit: rateLimESI,
-		RetryLimit:   25,
-		MaxRoutines:  config.App.MaxRoutines,
+		Store:       store,
+		Log:         logger,
+		UserAgent:   config.Web.UserAgent,
+		Retry:       config.Web.Retry,
+		MaxRoutines: config.App.MaxRoutines,
+		Languages:   languages,
+		ESIBaseURL:  esiBaseURL,
+		StartDelay:  config.App.StartDelay,
+		recorder:    recorder,
+		pacer:       newPacer(config.Web, config.App.MaxRoutines),
 	}, nil
 
 }
 
-func (c *Client) makeRawHTTPGet(url string) ([]byte, int, error) {
+// Close finishes off anything the client is recording
+func (c *Client) Close() error {
+	var err error
+	if c.recorder != nil {
+		err = c.recorder.Close()
+	}
+	if db, ok := c.db(); ok {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// esiURL puts path, which starts with a slash, onto the end of wherever ESI is
+func (c *Client) esiURL(path string) string {
+	return c.ESIBaseURL + path
+}
+
+// makeRawHTTPGet does a single GET. attempt is only used to label the span, 0 being the first try.
+func (c *Client) makeRawHTTPGet(ctx context.Context, url string, attempt int) (body []byte, status int, header http.Header, err error) {
+
+	ctx, span := tracer.Start(ctx, "esi GET", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.method", http.MethodGet),
+		attribute.String("http.url", url),
+		attribute.String("esi.endpoint", esiEndpoint(url)),
+		attribute.Int("esi.attempt", attempt),
+	))
+	defer func() {
+		if status > 0 {
+			span.SetAttributes(attribute.Int("http.status_code", status))
+		}
+		endSpan(span, err)
+	}()
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 
 	if err != nil {
-		return nil, 0, errors.Wrap(err, "Failed to buid http request")
+		return nil, 0, nil, errors.Wrap(err, "Failed to buid http request")
 	}
 
 	req.Header.Set("User-Agent", c.UserAgent)
 
+	start := time.Now()
 	res, err := c.HTTP.Do(req)
 
 	if err != nil {
-		return nil, 0, errors.Wrap(err, "Failed to make request")
+		observeESIRequest(url, 0, nil, time.Since(start))
+		return nil, 0, nil, errors.Wrap(err, "Failed to make request")
 	}
 	defer res.Body.Close()
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err = ioutil.ReadAll(res.Body)
+	observeESIRequest(url, res.StatusCode, res.Header, time.Since(start))
 
 	if err != nil {
-		return nil, 0, errors.Wrap(err, "Failed to read response from request")
+		return nil, 0, nil, errors.Wrap(err, "Failed to read response from request")
 	}
 
-	return body, res.StatusCode, nil
+	return body, res.StatusCode, res.Header, nil
 }
 
 func (c *Client) MakeESIGet(url string) (out []byte, err error) {
+	return c.MakeESIGetContext(context.Background(), url)
+}
 
-	retriesRemain := c.RetryLimit
-	for retriesRemain > 1 {
-		retriesRemain--
-
-		for c.ESIRateLimit.Value() > 10 {
-			time.Sleep(500 * time.Millisecond)
-		}
+// MakeESIGetContext is MakeESIGet with the request, and its span, tied to ctx. It is retried according to
+// c.Retry. A request that fails for good returns a *NotFound, *ServerError or one of the other errors built on
+// *RequestError, so callers can tell a deleted entity from an outage with errors.As.
+func (c *Client) MakeESIGetContext(ctx context.Context, url string) (out []byte, err error) {
+	body, _, err := c.getWithRetry(ctx, url, true)
+	return body, err
+}
 
-		body, status, err := c.makeRawHTTPGet(url)
-		if err != nil {
-			if strings.Contains(err.Error(), "too many open files") {
-				// This is not going to hurt to keep retrying
-				retriesRemain++
-			} else {
-				// fmt.Printf("ESI GET ERROR - %v\n", err)
-			}
-			continue
-		}
-		if !(status == 200) {
-			// Increment the counter :(
-			c.ESIRateLimit.Inc()
-			// fmt.Printf("ESI GET RESPONSE ERROR - %v - %v - %v\n", status, url, string(body))
-			time.Sleep(250 * time.Millisecond)
-			continue
-		}
+// makeESIAttempt is makeRawHTTPGet once the pacer lets it through, telling the pacer how it went
+func (c *Client) makeESIAttempt(ctx context.Context, url string, attempt int) ([]byte, int, http.Header, error) {
+	if c.pacer == nil {
+		return c.makeRawHTTPGet(ctx, url, attempt)
+	}
 
-		return body, err
+	waitStart := time.Now()
+	_, wait := tracer.Start(ctx, "esi pacing wait")
+	err := c.pacer.acquire(ctx)
+	wait.End()
+	observePacingWait(time.Since(waitStart))
+	if err != nil {
+		return nil, 0, nil, err
 	}
 
-	return nil, fmt.Errorf("Max retries exceeded for url: ; err: %v", url, err)
+	start := time.Now()
+	body, status, header, err := c.makeRawHTTPGet(ctx, url, attempt)
+	c.pacer.release(ctx, time.Since(start), status, err)
+	return body, status, header, err
 }
 
-
+// MakeGetRequestWithRetry is for things that arent ESI, so it isnt paced and doesnt count towards the ESI error limit
 func (c *Client) MakeGetRequestWithRetry(url string) ([]byte, error) {
-	retriesRemain := c.RetryLimit
-	for retriesRemain > 1 {
-		retriesRemain--
+	body, _, err := c.getWithRetry(context.Background(), url, false)
+	return body, err
+}
 
-		body, status, err := c.makeRawHTTPGet(url)
-		if err != nil {
-			continue
-		}
-		if !(status >= 200 && status < 300) {
-			time.Sleep(250 * time.Millisecond)
-			continue
+// getWithRetry GETs url until it gets a 2xx, something not worth retrying, or runs out of attempts. The header is
+// the successful response's.
+func (c *Client) getWithRetry(ctx context.Context, url string, esi bool) ([]byte, http.Header, error) {
+	policy := c.Retry.withDefaults()
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			observeESIRetry(url)
 		}
 
-		return body, err
-	}
+		var (
+			body   []byte
+			status int
+			header http.Header
+			err    error
+		)
+		if esi {
+			body, status, header, err = c.makeESIAttempt(ctx, url, attempt-1)
+		} else {
+			body, status, header, err = c.makeRawHTTPGet(ctx, url, attempt-1)
+		}
+		if err == nil && status >= 200 && status < 300 {
+			return body, header, nil
+		}
 
-	return nil, fmt.Errorf("Max retries exceeded for url: ", url)
-}
+		if ctx.Err() != nil {
+			return nil, nil, &RequestError{URL: url, Status: status, Attempts: attempt, Body: body, Err: ctx.Err()}
+		}
+		if err != nil {
+			c.Log.Debug("GET failed", "url", url, "attempt", attempt, "error", err)
+		} else {
+			c.Log.Debug("GET bad response", "url", url, "status", status, "attempt", attempt, "body", string(body))
+		}
 
-// Inc increments the counter.
-func (c *safeCounter) Inc() {
-	c.mux.Lock()
-	c.cnt++
-	c.mux.Unlock()
-}
+		if !retryable(status, err) || attempt >= policy.Attempts {
+			return nil, nil, newRequestError(url, attempt, status, body, header, err)
+		}
 
-// Dec decrements the counter.
-func (c *safeCounter) Dec() {
-	c.mux.Lock()
-	if c.cnt > 0 {
-		c.cnt--
+		wait := policy.delay(attempt, status, header)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, &RequestError{URL: url, Status: status, Attempts: attempt, Body: body, Err: ctx.Err()}
+		}
 	}
-	c.mux.Unlock()
-}
-
-// Value returns the current value of the counter.
-func (c *safeCounter) Value() int {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	return c.cnt
 }
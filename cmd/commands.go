@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/podded/higgs"
+)
+
+func runPopulate(args []string) int {
+	var opts options
+	fs := newFlagSet("populate", &opts)
+	addLockFlags(fs, &opts)
+	only := fs.String("only", "", "comma separated stages to run along with whatever they depend on, any of "+strings.Join(higgs.StageNames(), ","))
+	record := fs.String("record", "", "write every ESI request and response to this archive")
+	replay := fs.String("replay", "", "answer ESI requests from an archive written by --record instead of calling ESI")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	populate := higgs.PopulateOptions{Only: splitList(*only)}
+
+	plan, err := higgs.PlanPopulate(populate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if opts.dryRun {
+		fmt.Printf("would run stages: %v\n", strings.Join(plan, ", "))
+		return exitOK
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	if *record != "" {
+		config.Web.Record = *record
+	}
+	if *replay != "" {
+		config.Web.Replay = *replay
+	}
+
+	stopProgress := startProgress(config)
+	err = higgs.Populate(config, populate)
+	stopProgress()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error populating static data. err: %s\n", err)
+		return exitCodeFor(err)
+	}
+
+	return exitOK
+}
+
+func runDelete(args []string) int {
+	var opts options
+	fs := newFlagSet("delete", &opts)
+	addLockFlags(fs, &opts)
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	if opts.dryRun {
+		fmt.Printf("would empty collections: %v\n", strings.Join(higgs.StaticCollections, ", "))
+		return exitOK
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	if err := higgs.DeleteStaticData(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error deleting static data. err: %s\n", err)
+		return exitCodeFor(err)
+	}
+
+	return exitOK
+}
+
+func runImportSDE(args []string) int {
+	var opts options
+	fs := newFlagSet("import-sde", &opts)
+	addLockFlags(fs, &opts)
+	file := fs.String("file", "sde.zip", "path to the SDE zip")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	if _, err := os.Stat(*file); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if opts.dryRun {
+		fmt.Printf("would replace all static data with the contents of %v\n", *file)
+		return exitOK
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	stopProgress := startProgress(config)
+	err := higgs.ImportSDE(config, *file)
+	stopProgress()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing SDE. err: %s\n", err)
+		return exitCodeFor(err)
+	}
+
+	return exitOK
+}
+
+func runImportIndustry(args []string) int {
+	var opts options
+	fs := newFlagSet("import-industry", &opts)
+	addLockFlags(fs, &opts)
+	file := fs.String("file", "sde.zip", "path to the SDE zip")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	if _, err := os.Stat(*file); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if opts.dryRun {
+		fmt.Printf("would replace blueprints and type_materials with the contents of %v\n", *file)
+		return exitOK
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	stopProgress := startProgress(config)
+	err := higgs.ImportIndustry(config, *file)
+	stopProgress()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing industry data. err: %s\n", err)
+		return exitCodeFor(err)
+	}
+
+	return exitOK
+}
+
+func runVerify(args []string) int {
+	var opts options
+	fs := newFlagSet("verify", &opts)
+	asJSON := fs.Bool("json", false, "print the report as json")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	report, err := higgs.VerifyStaticData(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying static data. err: %s\n", err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		printJSON(report)
+	} else {
+		printCounts(report.Counts)
+		for _, collection := range higgs.StaticCollections {
+			if missing := report.Missing[collection]; len(missing) > 0 {
+				fmt.Printf("%v: %v referenced but missing\n", collection, len(missing))
+			}
+		}
+		for _, collection := range report.Empty() {
+			fmt.Printf("%v: empty\n", collection)
+		}
+	}
+
+	if !report.OK() {
+		return exitUnverified
+	}
+
+	return exitOK
+}
+
+func runExport(args []string) int {
+	var opts options
+	fs := newFlagSet("export", &opts)
+	out := fs.String("out", "export", "directory to write <collection>.jsonl files into")
+	only := fs.String("only", "", "comma separated collections to export, default all of them")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	collections := splitList(*only)
+	if len(collections) == 0 {
+		collections = higgs.StaticCollections
+	}
+
+	if opts.dryRun {
+		for _, c := range collections {
+			fmt.Printf("would write %v\n", filepath.Join(*out, c+".jsonl"))
+		}
+		return exitOK
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	if err := higgs.ExportStaticData(config, *out, collections); err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting static data. err: %s\n", err)
+		return exitFailure
+	}
+
+	return exitOK
+}
+
+func runStatus(args []string) int {
+	var opts options
+	fs := newFlagSet("status", &opts)
+	asJSON := fs.Bool("json", false, "print the status as json")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	status, err := higgs.Status(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting status. err: %s\n", err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		printJSON(status)
+		return exitOK
+	}
+
+	fmt.Printf("database: %v\n\n", status.Database)
+	printCounts(status.Counts)
+
+	return exitOK
+}
+
+func runServe(args []string) int {
+	var opts options
+	fs := newFlagSet("serve", &opts)
+	listen := fs.String("listen", ":8080", "address to serve http on")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	if opts.dryRun {
+		fmt.Printf("would serve on %v\n", *listen)
+		return exitOK
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	server, err := higgs.NewServer(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting server. err: %s\n", err)
+		return exitFailure
+	}
+
+	fmt.Printf("serving on %v\n", *listen)
+	if err := http.ListenAndServe(*listen, server); err != nil {
+		fmt.Fprintf(os.Stderr, "Error serving. err: %s\n", err)
+		return exitFailure
+	}
+
+	return exitOK
+}
+
+func runDaemon(args []string) int {
+	var opts options
+	fs := newFlagSet("daemon", &opts)
+	source := fs.String("source", "", "esi to refresh on a new server_version, sde to import on a new SDE checksum")
+	checkEvery := fs.Duration("check-every", 0, "how often to check for a new version (default 5m)")
+	schedule := fs.String("schedule", "", "also refresh on this cron schedule, eg \"0 12 * * 2\" or @daily, in UTC")
+	jitter := fs.Int("jitter", -1, "wait up to this many seconds at random before refreshing")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	if *source != "" {
+		config.Daemon.Source = *source
+	}
+	if *checkEvery > 0 {
+		config.Daemon.CheckEvery = *checkEvery
+	}
+	if *schedule != "" {
+		config.Daemon.Schedule = *schedule
+	}
+	if *jitter >= 0 {
+		config.Daemon.JitterSec = *jitter
+	}
+
+	daemon, err := higgs.NewDaemon(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting daemon. err: %s\n", err)
+		return exitConfig
+	}
+
+	if opts.dryRun {
+		fmt.Printf("would watch %v for changes\n", config.Daemon.Source)
+		return exitOK
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	stopProgress := startProgress(config)
+	err = daemon.Run(ctx)
+	stopProgress()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running daemon. err: %s\n", err)
+		return exitFailure
+	}
+
+	return exitOK
+}
+
+func runHistory(args []string) int {
+	var opts options
+	fs := newFlagSet("history", &opts)
+	limit := fs.Int("limit", 20, "how many runs to list, 0 for all of them")
+	id := fs.String("id", "", "show everything about this run")
+	asJSON := fs.Bool("json", false, "print the runs as json")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	config, stop, ok := opts.mustLoad()
+	if !ok {
+		return exitConfig
+	}
+	defer stop()
+
+	if *id != "" {
+		run, err := higgs.GetRun(config, *id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting run. err: %s\n", err)
+			return exitFailure
+		}
+		if *asJSON {
+			printJSON(run)
+		} else {
+			printRun(*run)
+		}
+		return exitOK
+	}
+
+	runs, err := higgs.History(config, *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting history. err: %s\n", err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		printJSON(runs)
+		return exitOK
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tSTARTED\tTOOK\tSTATUS\tSNAPSHOT")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", run.ID.Hex(), run.Kind, run.Started.Local().Format(time.RFC3339),
+			run.Took().Round(time.Second), run.Status, run.SnapshotID)
+	}
+	w.Flush()
+
+	return exitOK
+}
+
+func runDiff(args []string) int {
+	var opts options
+	fs := newFlagSet("diff", &opts)
+	run := fs.String("run", "", "show what this run changed, default the most recent run that changed anything")
+	from := fs.String("from", "", "an export directory to compare from, against --to or the database")
+	to := fs.String("to", "", "an export directory to compare --from with, instead of the database")
+	only := fs.String("only", "", "comma separated collections to compare, default all of them")
+	asJSON := fs.Bool("json", false, "print the changelog as json")
+	if code, ok := parse(fs, args); !ok {
+		return code
+	}
+
+	if *run != "" && *from != "" {
+		fmt.Fprintln(os.Stderr, "--run cant be used with --from")
+		return exitUsage
+	}
+	if *to != "" && *from == "" {
+		fmt.Fprintln(os.Stderr, "--to needs --from")
+		return exitUsage
+	}
+
+	var changelog *higgs.Changelog
+	var err error
+
+	if *from != "" && *to != "" {
+		// Two exports dont need the database, or a config
+		changelog, err = higgs.DiffExports(*from, *to, splitList(*only))
+	} else {
+		config, stop, ok := opts.mustLoad()
+		if !ok {
+			return exitConfig
+		}
+		defer stop()
+
+		if *from != "" {
+			changelog, err = higgs.DiffExportWithDatabase(config, *from, splitList(*only))
+		} else {
+			changelog, err = higgs.RunChangelog(config, *run)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error working out changes. err: %s\n", err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		printJSON(changelog)
+	} else {
+		changelog.WriteText(os.Stdout)
+	}
+
+	return exitOK
+}
+
+func printRun(run higgs.ImportRun) {
+	fmt.Printf("id:       %v\n", run.ID.Hex())
+	fmt.Printf("kind:     %v\n", run.Kind)
+	fmt.Printf("status:   %v\n", run.Status)
+	fmt.Printf("version:  %v\n", run.Version)
+	fmt.Printf("started:  %v\n", run.Started.Local().Format(time.RFC3339))
+	if !run.Finished.IsZero() {
+		fmt.Printf("finished: %v\n", run.Finished.Local().Format(time.RFC3339))
+	}
+	fmt.Printf("took:     %v\n", run.Took().Round(time.Second))
+	fmt.Printf("database: %v %v\n", run.Config.Database.URI, run.Config.Database.Database)
+	fmt.Printf("snapshot: %v\n", run.SnapshotID)
+	if run.Changes != nil {
+		fmt.Printf("changes:  %v collections changed, see higgs diff --run %v\n", len(run.Changes), run.ID.Hex())
+	}
+
+	if len(run.Progress) > 0 {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "STAGE\tSTATE\tDONE\tFAILED\tTOTAL")
+		for _, sp := range run.Progress {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", sp.Stage, sp.State, sp.Done, sp.Failed, sp.Total)
+		}
+		w.Flush()
+	}
+
+	if len(run.Counts) > 0 {
+		fmt.Println()
+		printCounts(run.Counts)
+	}
+
+	if len(run.Errors) > 0 {
+		fmt.Println()
+		stages := make([]string, 0, len(run.Errors))
+		for stage := range run.Errors {
+			stages = append(stages, stage)
+		}
+		sort.Strings(stages)
+		for _, stage := range stages {
+			fmt.Printf("%v: %v\n", stage, run.Errors[stage])
+		}
+	}
+}
+
+func printCounts(counts map[string]int64) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, collection := range higgs.StaticCollections {
+		fmt.Fprintf(w, "%v\t%v\n", collection, counts[collection])
+	}
+	w.Flush()
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/podded/higgs"
+
+	"github.com/spf13/viper"
+)
+
+// options are the flags every command takes
+type options struct {
+	configPath  string
+	logLevel    string
+	logFormat   string
+	concurrency int
+	dryRun      bool
+	waitLock    time.Duration
+	profile     higgs.ProfileConfig
+}
+
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&opts.configPath, "config", "", "path to the config file (default ./config.*)")
+	fs.StringVar(&opts.logLevel, "log-level", "", "log level, one of debug, info, warn or error")
+	fs.StringVar(&opts.logFormat, "log-format", "", "log format, text or json")
+	fs.IntVar(&opts.concurrency, "concurrency", 0, "override app.MaxRoutines from the config")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "show what would be done without doing it")
+	fs.StringVar(&opts.profile.Mode, "profile", "", "write a profile, one of cpu, heap, mutex, block or trace")
+	fs.StringVar(&opts.profile.Path, "profile-path", "", "directory to write the profile into")
+	fs.StringVar(&opts.profile.PprofListen, "pprof-listen", "", "serve net/http/pprof on this address while running")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: higgs %v [flags]\n\nflags:\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// addLockFlags is for the commands that change the static data and so need the lock
+func addLockFlags(fs *flag.FlagSet, opts *options) {
+	fs.DurationVar(&opts.waitLock, "wait-lock", 0, "wait this long for another run holding the lock to finish, instead of failing")
+}
+
+// exitCodeFor is the exit code for a command that failed with err
+func exitCodeFor(err error) int {
+	if errors.Is(err, higgs.ErrLockHeld) {
+		return exitLocked
+	}
+	return exitFailure
+}
+
+// parse handles the flags for a command, returning the exit code to use if we cant carry on
+func parse(fs *flag.FlagSet, args []string) (int, bool) {
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return exitOK, false
+	}
+	if err != nil {
+		return exitUsage, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %v\n", fs.Args())
+		fs.Usage()
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+func (o *options) load() (higgs.Configuration, error) {
+
+	//Set some reasonable defaults
+
+	config := higgs.Configuration{
+		Database: higgs.DatabaseConfig{
+			URI:      "mongodb://localhost:27017",
+			Database: "podded",
+		},
+		Web: higgs.HttpConfig{
+			UserAgent:  "Crypta-Eve/Podded install (BUT I AM BAD AND HAVENT CHANGED DEFAULT UA)",
+			TimeoutSec: 30,
+		},
+		App: higgs.AppConfig{
+			MaxRoutines: 20,
+			LogLevel:    "info",
+			StartDelay:  30 * time.Second,
+		},
+	}
+
+	v := viper.New()
+	if o.configPath != "" {
+		v.SetConfigFile(o.configPath)
+	} else {
+		v.SetConfigName("config")
+		v.AddConfigPath(".")
+	}
+
+	if err := v.ReadInConfig(); err != nil {
+		return config, fmt.Errorf("Error reading config, does it exist? err: %s", err)
+	}
+
+	if err := v.Unmarshal(&config); err != nil {
+		return config, fmt.Errorf("Error interpreting the config, is it valid? err: %s", err)
+	}
+
+	// Flags win over the config file
+	if o.logLevel != "" {
+		config.App.LogLevel = o.logLevel
+	}
+	if o.logFormat != "" {
+		config.App.LogFormat = o.logFormat
+	}
+	if o.waitLock > 0 {
+		config.Lock.Wait = o.waitLock
+	}
+	if o.concurrency > 0 {
+		config.App.MaxRoutines = o.concurrency
+	}
+	if o.profile.Mode != "" {
+		config.Profile.Mode = o.profile.Mode
+	}
+	if o.profile.Path != "" {
+		config.Profile.Path = o.profile.Path
+	}
+	if o.profile.PprofListen != "" {
+		config.Profile.PprofListen = o.profile.PprofListen
+	}
+
+	if config.App.MaxRoutines < 1 {
+		return config, fmt.Errorf("app.MaxRoutines must be at least 1, got %v", config.App.MaxRoutines)
+	}
+
+	return config, nil
+}
+
+// mustLoad loads the config and starts any profiling, metrics or tracing it asks for, printing why not if it cant.
+// The returned func stops them, pushing metrics if need be, and has to be called before exiting.
+func (o *options) mustLoad() (higgs.Configuration, func(), bool) {
+	config, err := o.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return config, func() {}, false
+	}
+
+	stopProfiling, err := startProfiling(config.Profile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		stopProfiling()
+		return config, func() {}, false
+	}
+
+	stopMetrics := startMetrics(config.Metrics)
+
+	stopTracing, err := higgs.SetupTracing(config.Tracing)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		stopMetrics()
+		stopProfiling()
+		return config, func() {}, false
+	}
+
+	return config, func() {
+		if err := stopTracing(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error flushing traces. err: %s\n", err)
+		}
+		stopMetrics()
+		stopProfiling()
+	}, true
+}
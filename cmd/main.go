@@ -1,53 +1,95 @@
 package main
 
 import (
-	"log"
-
-	"github.com/podded/higgs"
-
-	"github.com/spf13/viper"
-
-	"github.com/pkg/profile"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
 )
 
-func main() {
+// Exit codes, so scripts can tell a bad config apart from a failed run
+const (
+	exitOK         = 0
+	exitFailure    = 1
+	exitUsage      = 2
+	exitConfig     = 3
+	exitUnverified = 4
+	exitLocked     = 5
+)
 
-	// Start out by reading in our config file
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
 
-	defer profile.Start().Stop()
+var commands []command
+
+func init() {
+	commands = []command{
+		{"populate", "replace the static data from ESI", runPopulate},
+		{"delete", "delete all of the static data", runDelete},
+		{"import-sde", "replace the static data from a local SDE zip", runImportSDE},
+		{"import-industry", "replace just the blueprint and reprocessing data from a local SDE zip", runImportIndustry},
+		{"verify", "check the static data is complete and consistent", runVerify},
+		{"export", "dump the static data to json files", runExport},
+		{"status", "show what is in the database", runStatus},
+		{"history", "list past runs, or show one of them", runHistory},
+		{"diff", "show what a run changed, or compare exports", runDiff},
+		{"serve", "run the http api", runServe},
+		{"daemon", "keep the static data up to date as the game changes", runDaemon},
+	}
+}
 
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	var config higgs.Configuration
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-	//Set some reasonable defaults
+func run(args []string) int {
 
-	config = higgs.Configuration{
-		Database: higgs.DatabaseConfig{
-			URI:        "mongodb://localhost:27017",
-			Database:   "podded",
-		},
-		Web: higgs.HttpConfig{
-			UserAgent:  "Crypta-Eve/Podded install (BUT I AM BAD AND HAVENT CHANGED DEFAULT UA)",
-			TimeoutSec: 30,
-		},
-		App: higgs.AppConfig{
-			MaxRoutines: 20,
-		},
+	if len(args) == 0 {
+		usage()
+		return exitUsage
 	}
 
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config, does it exist? err: %s", err)
+	name := args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return exitOK
 	}
 
-	if err := viper.Unmarshal(&config); err != nil {
-		log.Fatalf("Error interpreting the config, is it valid? err: %s", err)
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(args[1:])
+		}
 	}
 
-	if err := higgs.PopulateStaticData(config); err != nil {
-		log.Fatalf("Error deleting static data. err: %s", err)
-	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	return exitUsage
+}
 
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: higgs <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
 
+	sorted := append([]command(nil), commands...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	for _, c := range sorted {
+		fmt.Fprintf(os.Stderr, "  %-16s %v\n", c.name, c.summary)
+	}
+
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "run higgs <command> -h for the flags each command takes")
+}
 
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/podded/higgs"
+)
+
+// startMetrics serves /metrics, and /progress for whatever is running, if asked to. The returned func
+// shuts that down and pushes the final numbers to the pushgateway if there is one.
+func startMetrics(config higgs.MetricsConfig) func() {
+	var server *http.Server
+
+	if config.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", higgs.MetricsHandler())
+		mux.Handle("/progress", higgs.ProgressHandler())
+
+		server = &http.Server{Addr: config.Listen, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "metrics listener failed. err: %s\n", err)
+			}
+		}()
+	}
+
+	return func() {
+		if server != nil {
+			_ = server.Close()
+		}
+
+		if config.PushGateway != "" {
+			job := config.Job
+			if job == "" {
+				job = "higgs"
+			}
+			if err := higgs.PushMetrics(config.PushGateway, job); err != nil {
+				fmt.Fprintf(os.Stderr, "Error pushing metrics. err: %s\n", err)
+			}
+		}
+	}
+}
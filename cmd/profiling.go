@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+
+	"github.com/podded/higgs"
+
+	"github.com/pkg/profile"
+)
+
+var profileModes = map[string]func(*profile.Profile){
+	"cpu":   profile.CPUProfile,
+	"heap":  profile.MemProfile,
+	"mutex": profile.MutexProfile,
+	"block": profile.BlockProfile,
+	"trace": profile.TraceProfile,
+}
+
+// startProfiling turns on whatever profiling the config asks for. Nothing is profiled by default.
+// The returned func has to be called to write the profile out.
+func startProfiling(config higgs.ProfileConfig) (func(), error) {
+	stops := []func(){}
+	stop := func() {
+		for _, s := range stops {
+			s()
+		}
+	}
+
+	if config.Mode != "" {
+		mode, ok := profileModes[config.Mode]
+		if !ok {
+			return stop, fmt.Errorf("unknown profile mode %q, must be one of cpu, heap, mutex, block or trace", config.Mode)
+		}
+
+		opts := []func(*profile.Profile){mode, profile.NoShutdownHook}
+		if config.Path != "" {
+			opts = append(opts, profile.ProfilePath(config.Path))
+		}
+		stops = append(stops, profile.Start(opts...).Stop)
+	}
+
+	if config.PprofListen != "" {
+		// Without these the live mutex and block profiles are always empty
+		runtime.SetMutexProfileFraction(5)
+		runtime.SetBlockProfileRate(1000)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		server := &http.Server{Addr: config.PprofListen, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "pprof listener failed. err: %s\n", err)
+			}
+		}()
+		stops = append(stops, func() { _ = server.Close() })
+	}
+
+	return stop, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/podded/higgs"
+)
+
+const (
+	// redraw the terminal display this often
+	progressRedraw = 500 * time.Millisecond
+	// and log a line this often when there is no terminal to draw on
+	progressLogEvery = 30 * time.Second
+)
+
+// startProgress reports on a long running command until the returned func is called. When stderr is a
+// terminal it draws a display there, otherwise it logs every so often.
+func startProgress(config higgs.Configuration) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	if interactive() {
+		go func() {
+			defer wg.Done()
+			higgs.WatchProgress(ctx, os.Stderr, progressRedraw)
+		}()
+	} else {
+		logger, err := higgs.NewLogger(config.App)
+		if err != nil {
+			// load has already checked the log config, so this is just in case
+			fmt.Fprintln(os.Stderr, err)
+			wg.Done()
+			return cancel
+		}
+		go func() {
+			defer wg.Done()
+			higgs.LogProgress(ctx, logger, progressLogEvery)
+		}()
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func interactive() bool {
+	fi, err := os.Stderr.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
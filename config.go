@@ -1,10 +1,18 @@
 package higgs
 
+import "time"
+
 type (
 	Configuration struct {
 		Database DatabaseConfig
 		Web      HttpConfig
 		App      AppConfig
+		Profile  ProfileConfig
+		Metrics  MetricsConfig
+		Tracing  TracingConfig
+		Events   EventsConfig
+		Daemon   DaemonConfig
+		Lock     LockConfig
 	}
 
 	DatabaseConfig struct {
@@ -15,9 +23,109 @@ type (
 	HttpConfig struct {
 		UserAgent  string
 		TimeoutSec int
+		// ESIBaseURL defaults to https://esi.evetech.net, point it at a fake ESI to test against
+		ESIBaseURL string
+		// Record writes every ESI request and response to this file, a gzipped archive that Replay can serve back
+		Record string
+		// Replay answers ESI requests from a Record archive instead of calling ESI
+		Replay string
+		// Retry is how failed requests are retried
+		Retry RetryPolicy
+		// Transport is TLS, proxy and connection settings
+		Transport TransportConfig
+		// RequestsPerSecond is the most requests made to ESI a second across every stage, defaults to 100.
+		// Negative for no limit
+		RequestsPerSecond float64
+		// Burst is how many requests can go at once after being idle, defaults to RequestsPerSecond
+		Burst int
+		// MaxConcurrency caps how many requests can be in flight, defaults to twice app.MaxRoutines. It starts at
+		// MaxRoutines and backs off when ESI gets slow or errors, growing again while it is healthy
+		MaxConcurrency int
+		// LatencyTarget is how slow a response can be before it counts as ESI struggling, defaults to 2s
+		LatencyTarget time.Duration
 	}
 
 	AppConfig struct {
 		MaxRoutines int
+		// Languages to fetch names and descriptions in, english is always fetched
+		Languages []string
+		// LogLevel is one of debug, info, warn or error
+		LogLevel string
+		// LogFormat is text or json, defaults to text
+		LogFormat string
+		// StartDelay is how long populate waits after warning it is about to take a long time, 0 for not at all
+		StartDelay time.Duration
+	}
+
+	ProfileConfig struct {
+		// Mode is one of cpu, heap, mutex, block or trace. Empty means dont profile
+		Mode string
+		// Path is the directory to write the profile into, defaults to a temp dir
+		Path string
+		// PprofListen is an address to serve net/http/pprof on while running, eg localhost:6060
+		PprofListen string
+	}
+
+	MetricsConfig struct {
+		// Listen is an address to serve /metrics on while running, serve mode also has it alongside the api
+		Listen string
+		// PushGateway is the url of a prometheus pushgateway to send metrics to when a command finishes
+		PushGateway string
+		// Job is the job name used when pushing, defaults to higgs
+		Job string
+	}
+
+	TracingConfig struct {
+		// Exporter is otlp to send spans to a collector over http, file to write them to File as json,
+		// or empty to not trace at all
+		Exporter string
+		// Endpoint is the collector's host:port, defaults to the OTEL_EXPORTER_OTLP_ENDPOINT environment variable
+		Endpoint string
+		// Insecure sends to the collector over plain http
+		Insecure bool
+		File     string
+		// ServiceName defaults to higgs
+		ServiceName string
+		// SampleRatio is the fraction of runs to trace, anything outside of (0, 1) traces everything
+		SampleRatio float64
+	}
+
+	EventsConfig struct {
+		// Webhooks are each POSTed a json list of change events after a run that changed something
+		Webhooks []string
+		// WebhookSecret signs each body with hmac sha256 in the X-Higgs-Signature header if set
+		WebhookSecret string
+		// ChangeLog writes the events to the change_log collection as well
+		ChangeLog bool
+		// Bus gets each event on <BusPrefix>.<kind>.<operation>. It cant come from a config file, programs
+		// using higgs set it to their NATS or Redis connection
+		Bus MessageBus `json:"-" bson:"-" mapstructure:"-"`
+		// BusPrefix goes on the front of every subject published to Bus
+		BusPrefix string
+	}
+
+	LockConfig struct {
+		// TTL is how long the lock lasts without a heartbeat, so a crashed run doesnt hold it forever. Defaults to 2m
+		TTL time.Duration
+		// Wait is how long to wait for someone else to finish, 0 means fail straight away
+		Wait time.Duration
+	}
+
+	DaemonConfig struct {
+		// Source is esi to refresh from ESI when /status has a new server_version, or sde to import the
+		// SDE when its checksum changes. Defaults to esi
+		Source string
+		// CheckEvery is how often to check for a new version, defaults to 5m
+		CheckEvery time.Duration
+		// Schedule refreshes regardless of the version, as cron (minute hour day month weekday, UTC),
+		// @daily and friends or @every <duration>. Empty means only refresh on a new version
+		Schedule string
+		// JitterSec is the most to wait, at random, before starting a refresh
+		JitterSec int
+		// Only is the populate stages to refresh from ESI, default all of them
+		Only []string
+		// SDEURL and SDEChecksumURL default to CCP's
+		SDEURL         string
+		SDEChecksumURL string
 	}
 )
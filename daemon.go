@@ -0,0 +1,311 @@
+package higgs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Where the daemon looks for a new version
+const (
+	SourceESI = "esi"
+	SourceSDE = "sde"
+)
+
+const (
+	defaultCheckEvery     = 5 * time.Minute
+	defaultSDEURL         = "https://eve-static-data-export.s3-eu-west-1.amazonaws.com/tranquility/sde.zip"
+	defaultSDEChecksumURL = "https://eve-static-data-export.s3-eu-west-1.amazonaws.com/tranquility/checksum"
+	esiStatusURL          = "/latest/status/?datasource=tranquility"
+)
+
+type (
+	// Daemon keeps the static data up to date, refreshing it whenever the game or the SDE changes
+	Daemon struct {
+		config   Configuration
+		client   *Client
+		db       *DB
+		schedule schedule
+
+		// refreshing is held while a refresh runs, so there is only ever one
+		refreshing sync.Mutex
+		wg         sync.WaitGroup
+	}
+
+	esiStatus struct {
+		Players       int    `json:"players"`
+		ServerVersion string `json:"server_version"`
+	}
+)
+
+// NewDaemon checks the daemon config and connects to everything it needs
+func NewDaemon(config Configuration) (*Daemon, error) {
+	dc := &config.Daemon
+	if dc.Source == "" {
+		dc.Source = SourceESI
+	}
+	if dc.Source != SourceESI && dc.Source != SourceSDE {
+		return nil, fmt.Errorf("unknown daemon source %q, want esi or sde", dc.Source)
+	}
+	if dc.CheckEvery <= 0 {
+		dc.CheckEvery = defaultCheckEvery
+	}
+	if dc.SDEURL == "" {
+		dc.SDEURL = defaultSDEURL
+	}
+	if dc.SDEChecksumURL == "" {
+		dc.SDEChecksumURL = defaultSDEChecksumURL
+	}
+	if _, err := selectStages(dc.Only); err != nil {
+		return nil, err
+	}
+	if config.Web.Record != "" {
+		// Every refresh would start the recording over, record a populate instead
+		return nil, errors.New("web.Record cant be used with the daemon")
+	}
+
+	d := &Daemon{config: config}
+
+	if dc.Schedule != "" {
+		s, err := parseSchedule(dc.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		d.schedule = s
+	}
+
+	client, err := newClient(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create client")
+	}
+	// Whatever reads the static data keeps the old copy until a refresh has all of the new one
+	client.staged = true
+	d.client = client
+	// newClient always connects to mongo, which is where the version refreshed to is kept
+	d.db, _ = client.db()
+
+	return d, nil
+}
+
+// Run checks for a new version every CheckEvery, and refreshes on the schedule, until ctx is done.
+// A refresh that is going when ctx is done is stopped and waited for.
+func (d *Daemon) Run(ctx context.Context) error {
+	dc := d.config.Daemon
+	log := d.client.Log.With("source", dc.Source)
+
+	last, err := d.db.GetDaemonVersion(dc.Source)
+	if err != nil {
+		return err
+	}
+	log.Info("Daemon started", "version", last, "check_every", dc.CheckEvery.String(), "schedule", dc.Schedule)
+
+	check := func() {
+		version, err := d.currentVersion(ctx)
+		if err != nil {
+			log.Warn("Failed to check version", "error", err)
+			return
+		}
+		log.Debug("Checked version", "version", version)
+
+		// A refresh records what it refreshed to once it succeeds, so a failed one is tried again next time
+		last, err := d.db.GetDaemonVersion(dc.Source)
+		if err != nil {
+			log.Warn("Failed to get the last version", "error", err)
+			return
+		}
+
+		if version == last {
+			return
+		}
+
+		if last == "" {
+			// We have never refreshed, so only do it if there is nothing there
+			n, err := d.client.Store.Count("types")
+			if err == nil && n > 0 {
+				log.Info("Recording the current version without refreshing, there is already data", "version", version)
+				if err := d.db.SetDaemonVersion(ctx, dc.Source, version); err != nil {
+					log.Warn("Failed to record version", "error", err)
+				}
+				return
+			}
+		}
+
+		log.Info("Version changed", "from", last, "to", version)
+		d.trigger(ctx, "version changed")
+	}
+
+	ticker := time.NewTicker(dc.CheckEvery)
+	defer ticker.Stop()
+
+	var scheduled <-chan time.Time
+	var timer *time.Timer
+	nextScheduled := func() {
+		if d.schedule == nil {
+			return
+		}
+		at := d.schedule.next(time.Now())
+		log.Info("Next scheduled refresh", "at", at.Format(time.RFC3339))
+		timer = time.NewTimer(time.Until(at))
+		scheduled = timer.C
+	}
+	nextScheduled()
+
+	check()
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			log.Info("Daemon stopping, waiting for any refresh to finish")
+			d.wg.Wait()
+			return d.client.Close()
+		case <-ticker.C:
+			check()
+		case <-scheduled:
+			d.trigger(ctx, "schedule")
+			nextScheduled()
+		}
+	}
+}
+
+// trigger starts a refresh unless one is already going
+func (d *Daemon) trigger(ctx context.Context, reason string) {
+	if !d.refreshing.TryLock() {
+		d.client.Log.Info("Refresh already running, not starting another", "reason", reason)
+		return
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer d.refreshing.Unlock()
+
+		if d.config.Daemon.JitterSec > 0 {
+			wait := time.Duration(rand.Int63n(int64(d.config.Daemon.JitterSec) * int64(time.Second)))
+			d.client.Log.Info("Waiting before refreshing", "reason", reason, "wait", wait.Round(time.Second).String())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		d.client.Log.Info("Refreshing", "source", d.config.Daemon.Source, "reason", reason)
+		err := d.refresh(ctx)
+		if errors.Is(err, ErrLockHeld) {
+			// Another replica, or someone by hand, is already on it
+			d.client.Log.Info("Not refreshing, someone else is", "source", d.config.Daemon.Source, "error", err)
+			return
+		}
+		if err != nil {
+			d.client.Log.Error("Refresh failed", "source", d.config.Daemon.Source, "error", err)
+			return
+		}
+
+		// Record whatever is current now, it might have moved on again while we were refreshing but
+		// then the next check will pick that up
+		version, err := d.currentVersion(ctx)
+		if err == nil {
+			err = d.db.SetDaemonVersion(ctx, d.config.Daemon.Source, version)
+		}
+		if err != nil {
+			d.client.Log.Warn("Failed to record the version refreshed to", "error", err)
+			return
+		}
+		d.client.Log.Info("Refreshed", "source", d.config.Daemon.Source, "version", version)
+	}()
+}
+
+// refresh uses the daemon's own client, so each one doesnt connect all over again
+func (d *Daemon) refresh(ctx context.Context) error {
+	if d.config.Daemon.Source == SourceESI {
+		return d.client.populateWithRun(ctx, d.config, PopulateOptions{Only: d.config.Daemon.Only})
+	}
+
+	path, err := d.downloadSDE(ctx)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	return d.client.importSDEWithRun(ctx, d.config, path)
+}
+
+// currentVersion is the server_version from ESI or the SDE's checksum
+func (d *Daemon) currentVersion(ctx context.Context) (string, error) {
+	if d.config.Daemon.Source == SourceESI {
+		url := d.client.esiURL(esiStatusURL)
+		body, err := d.client.MakeESIGetContext(ctx, url)
+		if err != nil {
+			return "", err
+		}
+		var status esiStatus
+		if err := decodeESI(url, body, &status); err != nil {
+			return "", err
+		}
+		if status.ServerVersion == "" {
+			return "", errors.New("ESI status has no server_version")
+		}
+		return status.ServerVersion, nil
+	}
+
+	body, _, err := d.client.getWithRetry(ctx, d.config.Daemon.SDEChecksumURL, false)
+	if err != nil {
+		return "", err
+	}
+	// The checksum file is a few lines of "<hash>  <file>", the whole thing changing is what matters
+	checksum := strings.TrimSpace(string(body))
+	if checksum == "" {
+		return "", errors.New("SDE checksum is empty")
+	}
+	return checksum, nil
+}
+
+// downloadSDE fetches the SDE zip to a temp file, returning its path
+func (d *Daemon) downloadSDE(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.config.Daemon.SDEURL, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to buid http request")
+	}
+	req.Header.Set("User-Agent", d.client.UserAgent)
+
+	// The zip is a few hundred meg, so no timeout beyond ctx
+	httpClient := *d.client.HTTP
+	httpClient.Timeout = 0
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to download the SDE")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("downloading the SDE returned %v", res.StatusCode)
+	}
+
+	f, err := ioutil.TempFile("", "higgs-sde-*.zip")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create a file for the SDE")
+	}
+
+	_, err = io.Copy(f, res.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "Failed to download the SDE")
+	}
+
+	return f.Name(), nil
+}
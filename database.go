@@ -2,8 +2,13 @@ package higgs
 
 import (
 	"context"
+	"io"
+	"time"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type (
@@ -19,6 +24,9 @@ type (
 		Description    string `json:"description" bson:"description"`
 		Name           string `json:"name" bson:"name"`
 		RegionID       int    `json:"region_id" bson:"_id"`
+
+		Names        map[string]string `json:"names,omitempty" bson:"names,omitempty"`
+		Descriptions map[string]string `json:"descriptions,omitempty" bson:"descriptions,omitempty"`
 	}
 
 	ESIConstellation struct {
@@ -27,6 +35,8 @@ type (
 		Systems         []int       `json:"systems" bson:"systems"`
 		Postion         ESIPosition `json:"position" bson:"position"`
 		RegionID        int         `json:"region_id" bson:"region_id"`
+
+		Names map[string]string `json:"names,omitempty" bson:"names,omitempty"`
 	}
 
 	ESISystem struct {
@@ -40,6 +50,14 @@ type (
 		Stargates       []int              `json:"stargates" bson:"stargates"`
 		Stations        []int              `json:"stations" bson:"stations"`
 		SystemID        int                `json:"system_id" bson:"_id"`
+
+		// Derived by enrichUniverse, ESI doesnt give us these
+		RegionID      int    `json:"region_id,omitempty" bson:"region_id,omitempty"`
+		RegionName    string `json:"region_name,omitempty" bson:"region_name,omitempty"`
+		SpaceType     string `json:"space_type,omitempty" bson:"space_type,omitempty"`
+		WormholeClass int    `json:"wormhole_class,omitempty" bson:"wormhole_class,omitempty"`
+
+		Names map[string]string `json:"names,omitempty" bson:"names,omitempty"`
 	}
 
 	ESISystemPlanets struct {
@@ -66,6 +84,9 @@ type (
 		Position ESIPosition `json:"position" bson:"position"`
 		SystemID int32       `json:"system_id" bson:"system_id"`
 		TypeID   int32       `json:"type_id" bson:"type_id"`
+
+		RegionID   int32  `json:"region_id,omitempty" bson:"region_id,omitempty"`
+		RegionName string `json:"region_name,omitempty" bson:"region_name,omitempty"`
 	}
 
 	ESIMoon struct {
@@ -73,6 +94,9 @@ type (
 		Name     string      `json:"name" bson:"name"`
 		Position ESIPosition `json:"position" bson:"position"`
 		SystemID int32       `json:"system_id" bson:"system_id"`
+
+		RegionID   int32  `json:"region_id,omitempty" bson:"region_id,omitempty"`
+		RegionName string `json:"region_name,omitempty" bson:"region_name,omitempty"`
 	}
 
 	ESIAsteroidBelt struct {
@@ -80,6 +104,9 @@ type (
 		Name     string      `json:"name" bson:"name"`
 		Position ESIPosition `json:"position" bson:"position"`
 		SystemID int32       `json:"system_id" bson:"system_id"`
+
+		RegionID   int32  `json:"region_id,omitempty" bson:"region_id,omitempty"`
+		RegionName string `json:"region_name,omitempty" bson:"region_name,omitempty"`
 	}
 
 	ESIStargate struct {
@@ -89,6 +116,9 @@ type (
 		StargateID  int32                  `json:"stargate_id" bson:"_id"`
 		SystemID    int32                  `json:"system_id" bson:"system_id"`
 		TypeID      int32                  `json:"type_id" bson:"type_id"`
+
+		RegionID   int32  `json:"region_id,omitempty" bson:"region_id,omitempty"`
+		RegionName string `json:"region_name,omitempty" bson:"region_name,omitempty"`
 	}
 
 	ESIStargateDestination struct {
@@ -108,6 +138,9 @@ type (
 		StationID              int32       `json:"station_id" bson:"_id"`
 		SystemID               int32       `json:"system_id" bson:"system_id"`
 		TypeID                 int32       `json:"type_id" bson:"type_id"`
+
+		RegionID   int32  `json:"region_id,omitempty" bson:"region_id,omitempty"`
+		RegionName string `json:"region_name,omitempty" bson:"region_name,omitempty"`
 	}
 
 	ESIType struct {
@@ -127,6 +160,9 @@ type (
 		Radius          float64              `json:"radius,omitempty" bson:"radius,omitempty"`
 		TypeID          int32                `json:"type_id" bson:"_id"`
 		Volume          float64              `json:"volume,omitempty" bson:"volume,omitempty"`
+
+		Names        map[string]string `json:"names,omitempty" bson:"names,omitempty"`
+		Descriptions map[string]string `json:"descriptions,omitempty" bson:"descriptions,omitempty"`
 	}
 
 	TypeDogmaAttribute struct {
@@ -145,6 +181,8 @@ type (
 		Name       string  `json:"name" bson:"name"`
 		Published  bool    `json:"published" bson:"published"`
 		Types      []int32 `json:"types" bson:"types"`
+
+		Names map[string]string `json:"names,omitempty" bson:"names,omitempty"`
 	}
 
 	ESICategory struct {
@@ -152,10 +190,35 @@ type (
 		Groups     []int32 `json:"groups" bson:"groups"`
 		Name       string  `json:"name" bson:"name"`
 		Published  bool    `json:"published" bson:"published"`
+
+		Names map[string]string `json:"names,omitempty" bson:"names,omitempty"`
+	}
+
+	EntityName struct {
+		ID   int32  `json:"id" bson:"_id"`
+		Name string `json:"name" bson:"name"`
 	}
 )
 
 
+// StaticCollections are all of the collections higgs fills in
+var StaticCollections = []string{
+	"regions",
+	"constellations",
+	"solarsystems",
+	"stars",
+	"planets",
+	"moons",
+	"asteroid_belts",
+	"stargates",
+	"stations",
+	"categories",
+	"groups",
+	"types",
+	"blueprints",
+	"type_materials",
+}
+
 func (db *DB) DeleteStaticData() error {
 
 	// I know this is bad but I really dont care about errors here for now
@@ -208,15 +271,37 @@ func (db *DB) DeleteStaticData() error {
 	collection = db.Database.Database(db.DBName).Collection("factions")
 	_, _ = collection.DeleteMany(context.Background(), bson.M{})
 
+	collection = db.Database.Database(db.DBName).Collection("blueprints")
+	_, _ = collection.DeleteMany(context.Background(), bson.M{})
+
+	collection = db.Database.Database(db.DBName).Collection("type_materials")
+	_, _ = collection.DeleteMany(context.Background(), bson.M{})
+
 	return nil
 
 }
 
-func (db *DB) InsertRegion(region ESIRegion) error {
+// DeleteCollections empties just the named collections, for when we only want to refresh part of the data
+func (db *DB) DeleteCollections(names ...string) error {
+
+	for _, name := range names {
+		collection := db.Database.Database(db.DBName).Collection(name)
+		_, err := collection.DeleteMany(context.Background(), bson.M{})
+		if err != nil {
+			return errors.Wrapf(err, "failed to empty %v", name)
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) InsertRegion(ctx context.Context, region ESIRegion) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("regions")
+	ctx, done := dbWrite(ctx, "insert", "regions")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), region)
+	_, err = collection.InsertOne(ctx, region)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve region")
 	}
@@ -225,11 +310,13 @@ func (db *DB) InsertRegion(region ESIRegion) error {
 
 }
 
-func (db *DB) InsertConstellation(cons ESIConstellation) error {
+func (db *DB) InsertConstellation(ctx context.Context, cons ESIConstellation) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("constellations")
+	ctx, done := dbWrite(ctx, "insert", "constellations")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), cons)
+	_, err = collection.InsertOne(ctx, cons)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve constellation")
 	}
@@ -238,11 +325,13 @@ func (db *DB) InsertConstellation(cons ESIConstellation) error {
 
 }
 
-func (db *DB) InsertSystem(system ESISystem) error {
+func (db *DB) InsertSystem(ctx context.Context, system ESISystem) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("solarsystems")
+	ctx, done := dbWrite(ctx, "insert", "solarsystems")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), system)
+	_, err = collection.InsertOne(ctx, system)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve system")
 	}
@@ -251,11 +340,13 @@ func (db *DB) InsertSystem(system ESISystem) error {
 
 }
 
-func (db *DB) InsertStar(star ESIStar) error {
+func (db *DB) InsertStar(ctx context.Context, star ESIStar) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("stars")
+	ctx, done := dbWrite(ctx, "insert", "stars")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), star)
+	_, err = collection.InsertOne(ctx, star)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve star")
 	}
@@ -264,11 +355,13 @@ func (db *DB) InsertStar(star ESIStar) error {
 
 }
 
-func (db *DB) InsertPlanet(planet ESIPlanet) error {
+func (db *DB) InsertPlanet(ctx context.Context, planet ESIPlanet) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("planets")
+	ctx, done := dbWrite(ctx, "insert", "planets")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), planet)
+	_, err = collection.InsertOne(ctx, planet)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve planet")
 	}
@@ -277,11 +370,13 @@ func (db *DB) InsertPlanet(planet ESIPlanet) error {
 
 }
 
-func (db *DB) InsertMoon(moon ESIMoon) error {
+func (db *DB) InsertMoon(ctx context.Context, moon ESIMoon) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("moons")
+	ctx, done := dbWrite(ctx, "insert", "moons")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), moon)
+	_, err = collection.InsertOne(ctx, moon)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve moon")
 	}
@@ -290,11 +385,13 @@ func (db *DB) InsertMoon(moon ESIMoon) error {
 
 }
 
-func (db *DB) InsertAsteroidBelt(belt ESIAsteroidBelt) error {
+func (db *DB) InsertAsteroidBelt(ctx context.Context, belt ESIAsteroidBelt) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("asteroid_belts")
+	ctx, done := dbWrite(ctx, "insert", "asteroid_belts")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), belt)
+	_, err = collection.InsertOne(ctx, belt)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve asteroid belt")
 	}
@@ -303,11 +400,13 @@ func (db *DB) InsertAsteroidBelt(belt ESIAsteroidBelt) error {
 
 }
 
-func (db *DB) InsertStargate(gate ESIStargate) error {
+func (db *DB) InsertStargate(ctx context.Context, gate ESIStargate) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("stargates")
+	ctx, done := dbWrite(ctx, "insert", "stargates")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), gate)
+	_, err = collection.InsertOne(ctx, gate)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve stargate")
 	}
@@ -316,11 +415,13 @@ func (db *DB) InsertStargate(gate ESIStargate) error {
 
 }
 
-func (db *DB) InsertStation(station ESIStation) error {
+func (db *DB) InsertStation(ctx context.Context, station ESIStation) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("stations")
+	ctx, done := dbWrite(ctx, "insert", "stations")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), station)
+	_, err = collection.InsertOne(ctx, station)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve station")
 	}
@@ -328,11 +429,13 @@ func (db *DB) InsertStation(station ESIStation) error {
 	return nil
 }
 
-func (db *DB) InsertType(typeESI ESIType) error {
+func (db *DB) InsertType(ctx context.Context, typeESI ESIType) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("types")
+	ctx, done := dbWrite(ctx, "insert", "types")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), typeESI)
+	_, err = collection.InsertOne(ctx, typeESI)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve type")
 	}
@@ -340,11 +443,13 @@ func (db *DB) InsertType(typeESI ESIType) error {
 	return nil
 }
 
-func (db *DB) InsertGroup(group ESIGroup) error {
+func (db *DB) InsertGroup(ctx context.Context, group ESIGroup) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("groups")
+	ctx, done := dbWrite(ctx, "insert", "groups")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), group)
+	_, err = collection.InsertOne(ctx, group)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve group")
 	}
@@ -352,11 +457,13 @@ func (db *DB) InsertGroup(group ESIGroup) error {
 	return nil
 }
 
-func (db *DB) InsertCategory(category ESICategory) error {
+func (db *DB) InsertCategory(ctx context.Context, category ESICategory) (err error) {
 
 	collection := db.Database.Database(db.DBName).Collection("categories")
+	ctx, done := dbWrite(ctx, "insert", "categories")
+	defer done(&err)
 
-	_, err := collection.InsertOne(context.TODO(), category)
+	_, err = collection.InsertOne(ctx, category)
 	if err != nil {
 		return errors.Wrap(err, "failed to insert eve category")
 	}
@@ -364,6 +471,34 @@ func (db *DB) InsertCategory(category ESICategory) error {
 	return nil
 }
 
+func (db *DB) InsertBlueprint(ctx context.Context, blueprint Blueprint) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("blueprints")
+	ctx, done := dbWrite(ctx, "insert", "blueprints")
+	defer done(&err)
+
+	_, err = collection.InsertOne(ctx, blueprint)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert eve blueprint")
+	}
+
+	return nil
+}
+
+func (db *DB) InsertTypeMaterials(ctx context.Context, materials TypeMaterials) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("type_materials")
+	ctx, done := dbWrite(ctx, "insert", "type_materials")
+	defer done(&err)
+
+	_, err = collection.InsertOne(ctx, materials)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert eve type materials")
+	}
+
+	return nil
+}
+
 func (db *DB) GetSystems() (systems []ESISystem, err error) {
 	collection := db.Database.Database(db.DBName).Collection("solarsystems")
 
@@ -393,3 +528,483 @@ func (db *DB) GetSystems() (systems []ESISystem, err error) {
 
 
 
+// UpdateSystemMetadata writes the derived region and space classification back onto a system
+func (db *DB) UpdateSystemMetadata(ctx context.Context, system ESISystem) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("solarsystems")
+	ctx, done := dbWrite(ctx, "update", "solarsystems")
+	defer done(&err)
+
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": system.SystemID}, bson.M{"$set": bson.M{
+		"region_id":      system.RegionID,
+		"region_name":    system.RegionName,
+		"space_type":     system.SpaceType,
+		"wormhole_class": system.WormholeClass,
+	}})
+	if err != nil {
+		return errors.Wrap(err, "failed to update eve system metadata")
+	}
+
+	return nil
+}
+
+// SetRegion denormalises a region onto everything in collection that sits in one of the given systems
+func (db *DB) SetRegion(ctx context.Context, collection string, systemIDs []int32, regionID int32, regionName string) (err error) {
+
+	c := db.Database.Database(db.DBName).Collection(collection)
+	ctx, done := dbWrite(ctx, "update", collection)
+	defer done(&err)
+
+	_, err = c.UpdateMany(ctx, bson.M{"system_id": bson.M{"$in": systemIDs}}, bson.M{"$set": bson.M{
+		"region_id":   regionID,
+		"region_name": regionName,
+	}})
+	if err != nil {
+		return errors.Wrapf(err, "failed to set region on %v", collection)
+	}
+
+	return nil
+}
+
+func (db *DB) GetRegions() (regions []ESIRegion, err error) {
+	err = db.findAll("regions", func(c *mongo.Cursor) error {
+		var region ESIRegion
+		if err := c.Decode(&region); err != nil {
+			return err
+		}
+		regions = append(regions, region)
+		return nil
+	})
+	return regions, errors.Wrap(err, "error retrieving existing regions")
+}
+
+func (db *DB) GetConstellations() (constellations []ESIConstellation, err error) {
+	err = db.findAll("constellations", func(c *mongo.Cursor) error {
+		var constellation ESIConstellation
+		if err := c.Decode(&constellation); err != nil {
+			return err
+		}
+		constellations = append(constellations, constellation)
+		return nil
+	})
+	return constellations, errors.Wrap(err, "error retrieving existing constellations")
+}
+
+func (db *DB) GetStations() (stations []ESIStation, err error) {
+	err = db.findAll("stations", func(c *mongo.Cursor) error {
+		var station ESIStation
+		if err := c.Decode(&station); err != nil {
+			return err
+		}
+		stations = append(stations, station)
+		return nil
+	})
+	return stations, errors.Wrap(err, "error retrieving existing stations")
+}
+
+func (db *DB) GetTypes() (types []ESIType, err error) {
+	err = db.findAll("types", func(c *mongo.Cursor) error {
+		var typeESI ESIType
+		if err := c.Decode(&typeESI); err != nil {
+			return err
+		}
+		types = append(types, typeESI)
+		return nil
+	})
+	return types, errors.Wrap(err, "error retrieving existing types")
+}
+
+func (db *DB) GetGroups() (groups []ESIGroup, err error) {
+	err = db.findAll("groups", func(c *mongo.Cursor) error {
+		var group ESIGroup
+		if err := c.Decode(&group); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+		return nil
+	})
+	return groups, errors.Wrap(err, "error retrieving existing groups")
+}
+
+func (db *DB) GetCategories() (categories []ESICategory, err error) {
+	err = db.findAll("categories", func(c *mongo.Cursor) error {
+		var category ESICategory
+		if err := c.Decode(&category); err != nil {
+			return err
+		}
+		categories = append(categories, category)
+		return nil
+	})
+	return categories, errors.Wrap(err, "error retrieving existing categories")
+}
+
+// GetBlueprint is what a blueprint needs and makes for each of its activities
+func (db *DB) GetBlueprint(blueprintTypeID int32) (blueprint Blueprint, err error) {
+	collection := db.Database.Database(db.DBName).Collection("blueprints")
+
+	err = collection.FindOne(context.Background(), bson.M{"_id": blueprintTypeID}).Decode(&blueprint)
+	if err != nil {
+		return blueprint, errors.Wrapf(err, "error retrieving blueprint %v", blueprintTypeID)
+	}
+
+	return blueprint, nil
+}
+
+// GetBlueprintsProducing finds every blueprint that manufactures or reacts into typeID
+func (db *DB) GetBlueprintsProducing(typeID int32) (blueprints []Blueprint, err error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"activities.manufacturing.products.type_id": typeID},
+		bson.M{"activities.reaction.products.type_id": typeID},
+	}}
+
+	err = db.find("blueprints", filter, func(c *mongo.Cursor) error {
+		var blueprint Blueprint
+		if err := c.Decode(&blueprint); err != nil {
+			return err
+		}
+		blueprints = append(blueprints, blueprint)
+		return nil
+	})
+	return blueprints, errors.Wrapf(err, "error retrieving blueprints producing %v", typeID)
+}
+
+// GetTypeMaterials is what typeID reprocesses into
+func (db *DB) GetTypeMaterials(typeID int32) (materials TypeMaterials, err error) {
+	collection := db.Database.Database(db.DBName).Collection("type_materials")
+
+	err = collection.FindOne(context.Background(), bson.M{"_id": typeID}).Decode(&materials)
+	if err != nil {
+		return materials, errors.Wrapf(err, "error retrieving materials for type %v", typeID)
+	}
+
+	return materials, nil
+}
+
+// GetNames returns just the id and name of every document in a static data
+// collection. Much cheaper than pulling back whole types when all we want is a name.
+func (db *DB) GetNames(collection string) (names []EntityName, err error) {
+	opts := options.Find().SetProjection(bson.M{"name": 1})
+	err = db.findAll(collection, func(c *mongo.Cursor) error {
+		var name EntityName
+		if err := c.Decode(&name); err != nil {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	}, opts)
+	return names, errors.Wrapf(err, "error retrieving names from %v", collection)
+}
+
+// GetLocalizedNames is GetNames but in the requested language, falling back to english where
+// we dont have a translation
+func (db *DB) GetLocalizedNames(collection, lang string) (names []EntityName, err error) {
+	lang = normaliseLanguage(lang)
+	if lang == DefaultLanguage {
+		return db.GetNames(collection)
+	}
+
+	opts := options.Find().SetProjection(bson.M{"name": 1, "names." + lang: 1})
+	err = db.findAll(collection, func(c *mongo.Cursor) error {
+		var doc struct {
+			ID    int32             `bson:"_id"`
+			Name  string            `bson:"name"`
+			Names map[string]string `bson:"names"`
+		}
+		if err := c.Decode(&doc); err != nil {
+			return err
+		}
+		names = append(names, EntityName{ID: doc.ID, Name: localized(doc.Names, doc.Name, lang)})
+		return nil
+	}, opts)
+	return names, errors.Wrapf(err, "error retrieving %v names from %v", lang, collection)
+}
+
+func (db *DB) Count(collection string) (int64, error) {
+	n, err := db.Database.Database(db.DBName).Collection(collection).CountDocuments(context.Background(), bson.M{})
+	return n, errors.Wrapf(err, "failed to count %v", collection)
+}
+
+// GetIDs returns the _id of everything in a collection
+func (db *DB) GetIDs(collection string) (ids []int32, err error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	err = db.findAll(collection, func(c *mongo.Cursor) error {
+		var doc struct {
+			ID int32 `bson:"_id"`
+		}
+		if err := c.Decode(&doc); err != nil {
+			return err
+		}
+		ids = append(ids, doc.ID)
+		return nil
+	}, opts)
+	return ids, errors.Wrapf(err, "error retrieving ids from %v", collection)
+}
+
+// ExportCollection writes every document in a collection to w as one line of extended json each, in _id order
+func (db *DB) ExportCollection(collection string, w io.Writer) error {
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	err := db.findAll(collection, func(c *mongo.Cursor) error {
+		line, err := bson.MarshalExtJSON(c.Current, false, false)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(line, '\n'))
+		return err
+	}, opts)
+	return errors.Wrapf(err, "failed to export %v", collection)
+}
+
+func (db *DB) findAll(collection string, decode func(c *mongo.Cursor) error, opts ...*options.FindOptions) error {
+	return db.find(collection, bson.M{}, decode, opts...)
+}
+
+func (db *DB) find(collection string, filter interface{}, decode func(c *mongo.Cursor) error, opts ...*options.FindOptions) error {
+	ctx := context.Background()
+
+	c, err := db.Database.Database(db.DBName).Collection(collection).Find(ctx, filter, opts...)
+	if err != nil {
+		return err
+	}
+
+	defer c.Close(ctx)
+
+	for c.Next(ctx) {
+		if err := decode(c); err != nil {
+			return errors.Wrap(err, "Failed to morph document into struct")
+		}
+	}
+
+	return c.Err()
+}
+
+func (db *DB) InsertImportRun(ctx context.Context, run ImportRun) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("import_runs")
+	ctx, done := dbWrite(ctx, "insert", "import_runs")
+	defer done(&err)
+
+	_, err = collection.InsertOne(ctx, run)
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to insert run into database")
+	}
+
+	return nil
+}
+
+// UpdateImportRun replaces the whole document for a run, used once it has finished
+func (db *DB) UpdateImportRun(ctx context.Context, run ImportRun) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("import_runs")
+	ctx, done := dbWrite(ctx, "update", "import_runs")
+	defer done(&err)
+
+	_, err = collection.ReplaceOne(ctx, bson.M{"_id": run.ID}, run, options.Replace().SetUpsert(true))
+
+	return errors.Wrap(err, "Failed to update run in database")
+}
+
+// UpdateImportRunProgress just sets the progress of a run that is still going
+func (db *DB) UpdateImportRunProgress(ctx context.Context, id primitive.ObjectID, progress []StageProgress) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("import_runs")
+	ctx, done := dbWrite(ctx, "update", "import_runs")
+	defer done(&err)
+
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"progress": progress}})
+
+	return errors.Wrap(err, "Failed to update run progress in database")
+}
+
+// GetImportRuns returns the most recent runs first, limit of 0 means all of them
+func (db *DB) GetImportRuns(limit int) (runs []ImportRun, err error) {
+	opts := options.Find().SetSort(bson.M{"started": -1})
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	err = db.findAll("import_runs", func(c *mongo.Cursor) error {
+		var run ImportRun
+		if err := c.Decode(&run); err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		return nil
+	}, opts)
+	return runs, errors.Wrap(err, "error retrieving runs")
+}
+
+func (db *DB) GetImportRun(id primitive.ObjectID) (*ImportRun, error) {
+	var run ImportRun
+	err := db.Database.Database(db.DBName).Collection("import_runs").FindOne(context.Background(), bson.M{"_id": id}).Decode(&run)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find run %v", id.Hex())
+	}
+	return &run, nil
+}
+
+// CopyCollection replaces the collection to with a copy of from
+func (db *DB) CopyCollection(ctx context.Context, from, to string) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection(from)
+	ctx, done := dbWrite(ctx, "copy", to)
+	defer done(&err)
+
+	c, err := collection.Aggregate(ctx, mongo.Pipeline{{{Key: "$out", Value: to}}})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to copy %v to %v", from, to)
+	}
+
+	return c.Close(ctx)
+}
+
+// DropCollections drops the named collections altogether
+func (db *DB) DropCollections(ctx context.Context, names ...string) error {
+
+	for _, name := range names {
+		err := db.Database.Database(db.DBName).Collection(name).Drop(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to drop %v", name)
+		}
+	}
+
+	return nil
+}
+
+// DropDatabase drops the whole database
+func (db *DB) DropDatabase(ctx context.Context) error {
+	return errors.Wrapf(db.Database.Database(db.DBName).Drop(ctx), "Failed to drop %v", db.DBName)
+}
+
+// namespaceNotFound is the code mongo gives for a collection that doesnt exist
+const namespaceNotFound = 26
+
+// MoveCollections replaces each named collection with the one of the same name in from, another database on
+// the same server. One that from doesnt have is left empty.
+func (db *DB) MoveCollections(ctx context.Context, from *DB, names ...string) error {
+
+	admin := db.Database.Database("admin")
+	for _, name := range names {
+		err := admin.RunCommand(ctx, bson.D{
+			{Key: "renameCollection", Value: from.DBName + "." + name},
+			{Key: "to", Value: db.DBName + "." + name},
+			{Key: "dropTarget", Value: true},
+		}).Err()
+
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == namespaceNotFound {
+			// Nothing was ever inserted so there was nothing to create it
+			err = db.Database.Database(db.DBName).Collection(name).Drop(ctx)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to move %v into place", name)
+		}
+	}
+
+	return nil
+}
+
+// InsertChangelog stores each change in the changelog against the run that made it
+func (db *DB) InsertChangelog(ctx context.Context, runID primitive.ObjectID, changelog *Changelog) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("changelogs")
+	ctx, done := dbWrite(ctx, "insert", "changelogs")
+	defer done(&err)
+
+	var docs []interface{}
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		_, err := collection.InsertMany(ctx, docs)
+		docs = docs[:0]
+		return err
+	}
+
+	for _, cc := range changelog.Collections {
+		for kind, changes := range map[string][]EntityChange{ChangeAdded: cc.Added, ChangeRemoved: cc.Removed, ChangeChanged: cc.Changed} {
+			for _, change := range changes {
+				docs = append(docs, ChangeRecord{RunID: runID, Collection: cc.Collection, Kind: kind, EntityChange: change})
+				if len(docs) == 1000 {
+					if err := flush(); err != nil {
+						return errors.Wrap(err, "Failed to insert changelog into database")
+					}
+				}
+			}
+		}
+	}
+
+	return errors.Wrap(flush(), "Failed to insert changelog into database")
+}
+
+// GetChangeRecords returns everything a run changed, in collection then id order
+func (db *DB) GetChangeRecords(runID primitive.ObjectID) (records []ChangeRecord, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "collection", Value: 1}, {Key: "id", Value: 1}})
+	err = db.find("changelogs", bson.M{"run_id": runID}, func(c *mongo.Cursor) error {
+		var record ChangeRecord
+		if err := c.Decode(&record); err != nil {
+			return err
+		}
+		for i, f := range record.Fields {
+			record.Fields[i].Old = plainValue(f.Old)
+			record.Fields[i].New = plainValue(f.New)
+		}
+		records = append(records, record)
+		return nil
+	}, opts)
+	return records, errors.Wrap(err, "error retrieving changelog")
+}
+
+func (db *DB) InsertChangeEvents(ctx context.Context, events []ChangeEvent) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("change_log")
+	ctx, done := dbWrite(ctx, "insert", "change_log")
+	defer done(&err)
+
+	for len(events) > 0 {
+		n := len(events)
+		if n > 1000 {
+			n = 1000
+		}
+
+		docs := make([]interface{}, n)
+		for i := range docs {
+			docs[i] = events[i]
+		}
+
+		_, err := collection.InsertMany(ctx, docs)
+		if err != nil {
+			return errors.Wrap(err, "Failed to insert change events into database")
+		}
+
+		events = events[n:]
+	}
+
+	return nil
+}
+
+// GetDaemonVersion returns the version the daemon last refreshed from source to, empty if it never has
+func (db *DB) GetDaemonVersion(source string) (string, error) {
+	var state struct {
+		Version string `bson:"version"`
+	}
+	err := db.Database.Database(db.DBName).Collection("daemon_state").FindOne(context.Background(), bson.M{"_id": source}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get daemon state")
+	}
+	return state.Version, nil
+}
+
+func (db *DB) SetDaemonVersion(ctx context.Context, source, version string) (err error) {
+
+	collection := db.Database.Database(db.DBName).Collection("daemon_state")
+	ctx, done := dbWrite(ctx, "update", "daemon_state")
+	defer done(&err)
+
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": source},
+		bson.M{"$set": bson.M{"version": version, "updated": time.Now().UTC()}}, options.Update().SetUpsert(true))
+
+	return errors.Wrap(err, "Failed to update daemon state")
+}
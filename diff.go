@@ -0,0 +1,606 @@
+package higgs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The kinds of change an entity can have
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// previousSuffix is added to a collection's name for the copy taken before a run replaces it
+const previousSuffix = "_previous"
+
+type (
+	// Changelog is everything that differs between two versions of the static data
+	Changelog struct {
+		RunID       primitive.ObjectID  `json:"run_id,omitempty"`
+		From        string              `json:"from"`
+		To          string              `json:"to"`
+		Created     time.Time           `json:"created"`
+		Collections []CollectionChanges `json:"collections"`
+	}
+
+	// CollectionChanges are the changes to a single collection, in _id order
+	CollectionChanges struct {
+		Collection string         `json:"collection"`
+		Added      []EntityChange `json:"added,omitempty"`
+		Removed    []EntityChange `json:"removed,omitempty"`
+		Changed    []EntityChange `json:"changed,omitempty"`
+	}
+
+	// EntityChange is one thing that was added, removed or changed. Fields is only set for changes.
+	EntityChange struct {
+		ID     int64         `json:"id" bson:"id"`
+		Name   string        `json:"name,omitempty" bson:"name,omitempty"`
+		Fields []FieldChange `json:"fields,omitempty" bson:"fields,omitempty"`
+	}
+
+	// FieldChange is a single value that changed. Field is a path into the document, arrays of things
+	// with ids are matched up by id so look like dogma_attributes[attribute_id=9].value
+	FieldChange struct {
+		Field string      `json:"field" bson:"field"`
+		Old   interface{} `json:"old" bson:"old"`
+		New   interface{} `json:"new" bson:"new"`
+	}
+
+	// ChangeCounts is a summary of the changes to a collection
+	ChangeCounts struct {
+		Added   int `json:"added" bson:"added"`
+		Removed int `json:"removed" bson:"removed"`
+		Changed int `json:"changed" bson:"changed"`
+	}
+
+	// ChangeRecord is how each entity change is kept in the changelogs collection
+	ChangeRecord struct {
+		RunID        primitive.ObjectID `bson:"run_id"`
+		Collection   string             `bson:"collection"`
+		Kind         string             `bson:"kind"`
+		EntityChange `bson:",inline"`
+	}
+
+	// diffDoc is one document from either side of a diff, as plain json values
+	diffDoc struct {
+		id     int64
+		fields map[string]interface{}
+	}
+
+	// docIterator walks a collection in _id order
+	docIterator interface {
+		next() (*diffDoc, error)
+		close()
+	}
+
+	cursorIterator struct {
+		cursor *mongo.Cursor
+	}
+
+	fileIterator struct {
+		file   *os.File
+		reader *bufio.Reader
+	}
+
+	emptyIterator struct{}
+)
+
+// Empty is true if nothing changed
+func (c *Changelog) Empty() bool {
+	for _, cc := range c.Collections {
+		if cc.Counts() != (ChangeCounts{}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Counts summarises the changes to every collection that had any
+func (c *Changelog) Counts() map[string]ChangeCounts {
+	out := make(map[string]ChangeCounts)
+	for _, cc := range c.Collections {
+		if counts := cc.Counts(); counts != (ChangeCounts{}) {
+			out[cc.Collection] = counts
+		}
+	}
+	return out
+}
+
+func (cc CollectionChanges) Counts() ChangeCounts {
+	return ChangeCounts{Added: len(cc.Added), Removed: len(cc.Removed), Changed: len(cc.Changed)}
+}
+
+// WriteText writes the changelog out for people to read
+func (c *Changelog) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "changes from %v to %v\n", c.From, c.To)
+	if c.Empty() {
+		fmt.Fprintln(w, "\nnothing changed")
+		return
+	}
+
+	for _, cc := range c.Collections {
+		counts := cc.Counts()
+		if counts == (ChangeCounts{}) {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%v: %v added, %v removed, %v changed\n", cc.Collection, counts.Added, counts.Removed, counts.Changed)
+		for _, e := range cc.Added {
+			fmt.Fprintf(w, "  + %v %v\n", e.ID, e.Name)
+		}
+		for _, e := range cc.Removed {
+			fmt.Fprintf(w, "  - %v %v\n", e.ID, e.Name)
+		}
+		for _, e := range cc.Changed {
+			fmt.Fprintf(w, "  ~ %v %v\n", e.ID, e.Name)
+			for _, f := range e.Fields {
+				fmt.Fprintf(w, "      %v: %v -> %v\n", f.Field, formatValue(f.Old), formatValue(f.New))
+			}
+		}
+	}
+}
+
+// DiffExports compares two directories written by ExportStaticData. Nothing needs to be running for this.
+func DiffExports(fromDir, toDir string, collections []string) (*Changelog, error) {
+	return diffSources(fromDir, toDir, collections,
+		func(collection string) (docIterator, error) { return openExport(fromDir, collection) },
+		func(collection string) (docIterator, error) { return openExport(toDir, collection) },
+	)
+}
+
+// DiffExportWithDatabase compares a directory written by ExportStaticData with what is in the database now
+func DiffExportWithDatabase(config Configuration, fromDir string, collections []string) (*Changelog, error) {
+	store, err := GetDatabaseHandle(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to database")
+	}
+	defer store.Close()
+
+	return diffSources(fromDir, "database "+store.DBName, collections,
+		func(collection string) (docIterator, error) { return openExport(fromDir, collection) },
+		func(collection string) (docIterator, error) { return store.iterate(collection) },
+	)
+}
+
+// RunChangelog loads the changelog stored for a run. An empty id means the most recent run that has one.
+func RunChangelog(config Configuration, id string) (*Changelog, error) {
+	store, err := GetDatabaseHandle(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to database")
+	}
+	defer store.Close()
+
+	var run *ImportRun
+	if id == "" {
+		runs, err := store.GetImportRuns(0)
+		if err != nil {
+			return nil, err
+		}
+		for i := range runs {
+			if runs[i].Changes != nil {
+				run = &runs[i]
+				break
+			}
+		}
+		if run == nil {
+			return nil, errors.New("no run has a changelog yet")
+		}
+	} else {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%q is not a run id", id)
+		}
+		run, err = store.GetImportRun(oid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	records, err := store.GetChangeRecords(run.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	changelog := &Changelog{
+		RunID:   run.ID,
+		From:    "before run " + run.ID.Hex(),
+		To:      "after run " + run.ID.Hex(),
+		Created: run.Finished,
+	}
+
+	byCollection := make(map[string]*CollectionChanges)
+	for _, r := range records {
+		cc, ok := byCollection[r.Collection]
+		if !ok {
+			cc = &CollectionChanges{Collection: r.Collection}
+			byCollection[r.Collection] = cc
+		}
+		switch r.Kind {
+		case ChangeAdded:
+			cc.Added = append(cc.Added, r.EntityChange)
+		case ChangeRemoved:
+			cc.Removed = append(cc.Removed, r.EntityChange)
+		case ChangeChanged:
+			cc.Changed = append(cc.Changed, r.EntityChange)
+		}
+	}
+	for _, collection := range StaticCollections {
+		if cc, ok := byCollection[collection]; ok {
+			changelog.Collections = append(changelog.Collections, *cc)
+		}
+	}
+
+	return changelog, nil
+}
+
+// snapshotPrevious copies each collection aside before a run replaces it, so it can be diffed afterwards
+func (c *Client) snapshotPrevious(ctx context.Context, collections []string) error {
+	db, ok := c.db()
+	if !ok {
+		return errNotMongo
+	}
+	for _, collection := range collections {
+		err := db.CopyCollection(ctx, collection, collection+previousSuffix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropPrevious drops the copies taken by snapshotPrevious once theyve been diffed
+func (c *Client) dropPrevious(ctx context.Context, collections []string) error {
+	db, ok := c.db()
+	if !ok {
+		return errNotMongo
+	}
+	names := make([]string, 0, len(collections))
+	for _, collection := range collections {
+		names = append(names, collection+previousSuffix)
+	}
+	return db.DropCollections(ctx, names...)
+}
+
+// diffPrevious compares each collection with the copy taken by snapshotPrevious
+func (c *Client) diffPrevious(collections []string) (*Changelog, error) {
+	db, ok := c.db()
+	if !ok {
+		return nil, errNotMongo
+	}
+	return diffSources("previous", "current", collections,
+		func(collection string) (docIterator, error) { return db.iterate(collection + previousSuffix) },
+		func(collection string) (docIterator, error) { return db.iterate(collection) },
+	)
+}
+
+func diffSources(from, to string, collections []string, openFrom, openTo func(collection string) (docIterator, error)) (*Changelog, error) {
+	if len(collections) == 0 {
+		collections = StaticCollections
+	}
+
+	changelog := &Changelog{From: from, To: to, Created: time.Now().UTC()}
+	for _, collection := range collections {
+		old, err := openFrom(collection)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := openTo(collection)
+		if err != nil {
+			old.close()
+			return nil, err
+		}
+
+		cc, err := diffCollection(collection, old, cur)
+		old.close()
+		cur.close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to diff %v", collection)
+		}
+		changelog.Collections = append(changelog.Collections, cc)
+	}
+
+	return changelog, nil
+}
+
+// diffCollection merge joins the two sides on _id, both have to be in _id order
+func diffCollection(collection string, old, cur docIterator) (CollectionChanges, error) {
+	cc := CollectionChanges{Collection: collection}
+
+	a, err := old.next()
+	if err != nil {
+		return cc, err
+	}
+	b, err := cur.next()
+	if err != nil {
+		return cc, err
+	}
+
+	for a != nil || b != nil {
+		switch {
+		case b == nil || (a != nil && a.id < b.id):
+			cc.Removed = append(cc.Removed, EntityChange{ID: a.id, Name: docName(a)})
+			if a, err = old.next(); err != nil {
+				return cc, err
+			}
+		case a == nil || b.id < a.id:
+			cc.Added = append(cc.Added, EntityChange{ID: b.id, Name: docName(b)})
+			if b, err = cur.next(); err != nil {
+				return cc, err
+			}
+		default:
+			var fields []FieldChange
+			diffValues("", a.fields, b.fields, &fields)
+			if len(fields) > 0 {
+				cc.Changed = append(cc.Changed, EntityChange{ID: b.id, Name: docName(b), Fields: fields})
+			}
+			if a, err = old.next(); err != nil {
+				return cc, err
+			}
+			if b, err = cur.next(); err != nil {
+				return cc, err
+			}
+		}
+	}
+
+	return cc, nil
+}
+
+// diffValues appends every difference between old and new to out
+func diffValues(path string, old, new interface{}, out *[]FieldChange) {
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := make(map[string]bool)
+		for k := range oldMap {
+			keys[k] = true
+		}
+		for k := range newMap {
+			keys[k] = true
+		}
+		for _, k := range sortedStrings(keys) {
+			diffValues(joinPath(path, k), oldMap[k], newMap[k], out)
+		}
+		return
+	}
+
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := new.([]interface{})
+	if oldIsList && newIsList {
+		if key := listKey(oldList, newList); key != "" {
+			diffKeyedLists(path, key, oldList, newList, out)
+			return
+		}
+		if len(oldList) == len(newList) {
+			for i := range oldList {
+				diffValues(fmt.Sprintf("%v[%v]", path, i), oldList[i], newList[i], out)
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*out = append(*out, FieldChange{Field: path, Old: old, New: new})
+	}
+}
+
+// listKey finds an _id field that every element of both lists has, and that is unique in each of them
+func listKey(lists ...[]interface{}) string {
+	var candidates []string
+	for _, list := range lists {
+		for _, v := range list {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			if candidates == nil {
+				for k := range m {
+					if strings.HasSuffix(k, "_id") {
+						candidates = append(candidates, k)
+					}
+				}
+				sort.Strings(candidates)
+			}
+		}
+	}
+
+	for _, key := range candidates {
+		ok := true
+		for _, list := range lists {
+			seen := make(map[interface{}]bool)
+			for _, v := range list {
+				id, has := v.(map[string]interface{})[key]
+				if !has || seen[id] {
+					ok = false
+					break
+				}
+				seen[id] = true
+			}
+		}
+		if ok {
+			return key
+		}
+	}
+	return ""
+}
+
+func diffKeyedLists(path, key string, old, new []interface{}, out *[]FieldChange) {
+	oldByKey := make(map[string]interface{})
+	keys := make(map[string]bool)
+	for _, v := range old {
+		k := fmt.Sprint(v.(map[string]interface{})[key])
+		oldByKey[k] = v
+		keys[k] = true
+	}
+	newByKey := make(map[string]interface{})
+	for _, v := range new {
+		k := fmt.Sprint(v.(map[string]interface{})[key])
+		newByKey[k] = v
+		keys[k] = true
+	}
+
+	for _, k := range sortedStrings(keys) {
+		elemPath := fmt.Sprintf("%v[%v=%v]", path, key, k)
+		o, inOld := oldByKey[k]
+		n, inNew := newByKey[k]
+		if inOld && inNew {
+			diffValues(elemPath, o, n, out)
+			continue
+		}
+		*out = append(*out, FieldChange{Field: elemPath, Old: o, New: n})
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedStrings(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		// Numeric keys in number order, everything else alphabetically
+		a, errA := strconv.ParseFloat(out[i], 64)
+		b, errB := strconv.ParseFloat(out[j], 64)
+		if errA == nil && errB == nil && a != b {
+			return a < b
+		}
+		return out[i] < out[j]
+	})
+	return out
+}
+
+func docName(d *diffDoc) string {
+	name, _ := d.fields["name"].(string)
+	return name
+}
+
+// plainValue turns what mongo decodes into an interface{} back into the plain json values the diff was made of
+func plainValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(t))
+		for _, e := range t {
+			m[e.Key] = plainValue(e.Value)
+		}
+		return m
+	case primitive.M:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = plainValue(e)
+		}
+		return m
+	case primitive.A:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = plainValue(e)
+		}
+		return out
+	case int32:
+		return float64(t)
+	case int64:
+		return float64(t)
+	}
+	return v
+}
+
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "(none)"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// parseDiffDoc reads a document in the extended json export writes
+func parseDiffDoc(line []byte) (*diffDoc, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, errors.Wrap(err, "failed to decode document")
+	}
+	id, ok := fields["_id"].(float64)
+	if !ok {
+		return nil, errors.Errorf("document has no numeric _id: %.80s", line)
+	}
+	delete(fields, "_id")
+	return &diffDoc{id: int64(id), fields: fields}, nil
+}
+
+func openExport(dir, collection string) (docIterator, error) {
+	f, err := os.Open(filepath.Join(dir, collection+".jsonl"))
+	if os.IsNotExist(err) {
+		return emptyIterator{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open export of %v", collection)
+	}
+	return &fileIterator{file: f, reader: bufio.NewReader(f)}, nil
+}
+
+func (it *fileIterator) next() (*diffDoc, error) {
+	for {
+		line, err := it.reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			return parseDiffDoc(line)
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read export")
+		}
+	}
+}
+
+func (it *fileIterator) close() { _ = it.file.Close() }
+
+func (it *cursorIterator) next() (*diffDoc, error) {
+	ctx := context.Background()
+	if !it.cursor.Next(ctx) {
+		return nil, it.cursor.Err()
+	}
+	line, err := bson.MarshalExtJSON(it.cursor.Current, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return parseDiffDoc(line)
+}
+
+func (it *cursorIterator) close() { _ = it.cursor.Close(context.Background()) }
+
+func (emptyIterator) next() (*diffDoc, error) { return nil, nil }
+func (emptyIterator) close()                  {}
+
+// iterate walks a collection in _id order, the same as ExportCollection writes it
+func (db *DB) iterate(collection string) (docIterator, error) {
+	c, err := db.Database.Database(db.DBName).Collection(collection).Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %v", collection)
+	}
+	return &cursorIterator{cursor: c}, nil
+}
@@ -0,0 +1,93 @@
+package higgs
+
+import (
+	"reflect"
+	"testing"
+)
+
+type jsonObject = map[string]interface{}
+type jsonList = []interface{}
+
+func TestDiffValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new interface{}
+		want     []FieldChange
+	}{
+		{"same", jsonObject{"name": "Jita", "security": 0.9}, jsonObject{"name": "Jita", "security": 0.9}, nil},
+		{"changed", jsonObject{"name": "Jita"}, jsonObject{"name": "Jita Prime"},
+			[]FieldChange{{Field: "name", Old: "Jita", New: "Jita Prime"}}},
+		{"added and removed fields", jsonObject{"a": 1.0}, jsonObject{"b": 2.0},
+			[]FieldChange{{Field: "a", Old: 1.0, New: nil}, {Field: "b", Old: nil, New: 2.0}}},
+		{"nested", jsonObject{"position": jsonObject{"x": 1.0, "y": 2.0}}, jsonObject{"position": jsonObject{"x": 1.0, "y": 3.0}},
+			[]FieldChange{{Field: "position.y", Old: 2.0, New: 3.0}}},
+		{"list by index", jsonObject{"planets": jsonList{1.0, 2.0}}, jsonObject{"planets": jsonList{1.0, 3.0}},
+			[]FieldChange{{Field: "planets[1]", Old: 2.0, New: 3.0}}},
+		{"list changing length", jsonObject{"moons": jsonList{1.0}}, jsonObject{"moons": jsonList{1.0, 2.0}},
+			[]FieldChange{{Field: "moons", Old: jsonList{1.0}, New: jsonList{1.0, 2.0}}}},
+		// Reordering a list of things with ids isnt a change
+		{"keyed list reordered",
+			jsonObject{"dogma_attributes": jsonList{jsonObject{"attribute_id": 9.0, "value": 1.0}, jsonObject{"attribute_id": 4.0, "value": 2.0}}},
+			jsonObject{"dogma_attributes": jsonList{jsonObject{"attribute_id": 4.0, "value": 2.0}, jsonObject{"attribute_id": 9.0, "value": 1.0}}},
+			nil},
+		{"keyed list changed",
+			jsonObject{"dogma_attributes": jsonList{jsonObject{"attribute_id": 9.0, "value": 1.0}, jsonObject{"attribute_id": 4.0, "value": 2.0}}},
+			jsonObject{"dogma_attributes": jsonList{jsonObject{"attribute_id": 4.0, "value": 2.0}, jsonObject{"attribute_id": 9.0, "value": 5.0}}},
+			[]FieldChange{{Field: "dogma_attributes[attribute_id=9].value", Old: 1.0, New: 5.0}}},
+		{"type changed", jsonObject{"radius": 1.0}, jsonObject{"radius": "big"},
+			[]FieldChange{{Field: "radius", Old: 1.0, New: "big"}}},
+	}
+
+	for _, tt := range tests {
+		var got []FieldChange
+		diffValues("", tt.old, tt.new, &got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestListKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		lists []jsonList
+		want  string
+	}{
+		{"ids", []jsonList{{jsonObject{"type_id": 1.0}, jsonObject{"type_id": 2.0}}, {jsonObject{"type_id": 2.0}}}, "type_id"},
+		{"first unique id in name order", []jsonList{{jsonObject{"group_id": 1.0, "type_id": 1.0}, jsonObject{"group_id": 1.0, "type_id": 2.0}}}, "type_id"},
+		{"not unique", []jsonList{{jsonObject{"type_id": 1.0}, jsonObject{"type_id": 1.0}}}, ""},
+		{"not unique in the other list", []jsonList{{jsonObject{"type_id": 1.0}}, {jsonObject{"type_id": 2.0}, jsonObject{"type_id": 2.0}}}, ""},
+		{"missing from one", []jsonList{{jsonObject{"type_id": 1.0}}, {jsonObject{"name": "x"}}}, ""},
+		{"no id", []jsonList{{jsonObject{"name": "x"}}}, ""},
+		{"not objects", []jsonList{{1.0, 2.0}}, ""},
+		{"empty", []jsonList{{}, {}}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := listKey(tt.lists...); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiffKeyedLists(t *testing.T) {
+	old := jsonList{
+		jsonObject{"material_type_id": 34.0, "quantity": 100.0},
+		jsonObject{"material_type_id": 35.0, "quantity": 50.0},
+	}
+	new := jsonList{
+		jsonObject{"material_type_id": 36.0, "quantity": 10.0},
+		jsonObject{"material_type_id": 34.0, "quantity": 120.0},
+	}
+
+	var got []FieldChange
+	diffKeyedLists("materials", "material_type_id", old, new, &got)
+	want := []FieldChange{
+		{Field: "materials[material_type_id=34].quantity", Old: 100.0, New: 120.0},
+		{Field: "materials[material_type_id=35]", Old: old[1], New: nil},
+		{Field: "materials[material_type_id=36]", Old: nil, New: new[0]},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
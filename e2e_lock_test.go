@@ -0,0 +1,229 @@
+package higgs_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/podded/higgs"
+	"github.com/podded/higgs/esitest"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const testLock = "e2e_test"
+
+// lockDB is a database of its own for the lock tests
+func lockDB(t *testing.T) *higgs.DB {
+	t.Helper()
+
+	esi := esitest.NewServer(nil)
+	t.Cleanup(esi.Close)
+
+	db, err := higgs.GetDatabaseHandle(e2eConfig(t, esi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestLeaseAcquireAndRelease(t *testing.T) {
+	db := lockDB(t)
+	ctx := context.Background()
+
+	lease, err := db.AcquireLease(ctx, testLock, "a", higgs.RunPopulate, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.GetLock(testLock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.Owner != "a" || info.Kind != higgs.RunPopulate || !info.Expires.After(time.Now()) {
+		t.Errorf("lock is %+v", info)
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := db.GetLock(testLock); err != nil || info != nil {
+		t.Errorf("lock is still %+v after release, %v", info, err)
+	}
+
+	// And it can be taken again
+	lease, err = db.AcquireLease(ctx, testLock, "b", higgs.RunPopulate, time.Minute)
+	if err != nil {
+		t.Fatalf("taking the lock after it was released: %v", err)
+	}
+	lease.Release()
+}
+
+func TestLeaseContention(t *testing.T) {
+	db := lockDB(t)
+	ctx := context.Background()
+
+	lease, err := db.AcquireLease(ctx, testLock, "a", higgs.RunPopulate, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody else gets it while it is held, not even another lease with the same owner
+	for _, owner := range []string{"b", "a"} {
+		_, err := db.AcquireLease(ctx, testLock, owner, higgs.RunImportSDE, time.Minute)
+		var held *higgs.LockHeldError
+		if !errors.Is(err, higgs.ErrLockHeld) || !errors.As(err, &held) || held.Holder.Owner != "a" {
+			t.Errorf("%v taking a held lock: got %v", owner, err)
+		}
+	}
+
+	// Two at once, only one of them wins
+	lease.Release()
+	results := make(chan error, 2)
+	for _, owner := range []string{"b", "c"} {
+		owner := owner
+		go func() {
+			lease, err := db.AcquireLease(ctx, testLock, owner, higgs.RunPopulate, time.Minute)
+			if err == nil {
+				defer lease.Release()
+				time.Sleep(100 * time.Millisecond)
+			}
+			results <- err
+		}()
+	}
+	won := 0
+	for i := 0; i < 2; i++ {
+		err := <-results
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, higgs.ErrLockHeld):
+			t.Errorf("racing for the lock: %v", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%v of two racing leases got the lock", won)
+	}
+}
+
+func TestLeaseExpiryAndRenewal(t *testing.T) {
+	db := lockDB(t)
+	ctx := context.Background()
+	locks := db.Database.Database(db.DBName).Collection("locks")
+
+	// A holder that went away without releasing is taken over once its lease runs out
+	past := time.Now().UTC().Add(-time.Second)
+	_, err := locks.InsertOne(ctx, bson.M{"_id": testLock, "owner": "crashed", "kind": higgs.RunPopulate,
+		"acquired": past.Add(-time.Minute), "heartbeat": past.Add(-time.Minute), "expires": past})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ttl = 300 * time.Millisecond
+	lease, err := db.AcquireLease(ctx, testLock, "a", higgs.RunPopulate, ttl)
+	if err != nil {
+		t.Fatalf("taking an expired lock: %v", err)
+	}
+	defer lease.Release()
+
+	// Kept alive well past the ttl by the heartbeat
+	time.Sleep(4 * ttl)
+	if _, err := db.AcquireLease(ctx, testLock, "b", higgs.RunPopulate, ttl); !errors.Is(err, higgs.ErrLockHeld) {
+		t.Errorf("want the renewed lock still held, got %v", err)
+	}
+	info, err := db.GetLock(testLock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Owner != "a" || !info.Heartbeat.After(lease.Info().Acquired) || !info.Expires.After(lease.Info().Expires) {
+		t.Errorf("lock wasnt renewed, it is %+v and was %+v", info, lease.Info())
+	}
+	if lease.Lost() {
+		t.Error("lease lost while it was being renewed")
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	db := lockDB(t)
+	ctx := context.Background()
+	locks := db.Database.Database(db.DBName).Collection("locks")
+
+	const ttl = 300 * time.Millisecond
+	lease, err := db.AcquireLease(ctx, testLock, "a", higgs.RunPopulate, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else takes it, as they would if a heartbeat went missing for longer than the ttl
+	if _, err := locks.UpdateOne(ctx, bson.M{"_id": testLock}, bson.M{"$set": bson.M{"owner": "b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-lease.Done():
+	case <-time.After(5 * ttl):
+		t.Fatal("lease never noticed it was lost")
+	}
+	if !lease.Lost() {
+		t.Error("Done closed without Lost")
+	}
+
+	// Releasing a lost lease leaves the new holder alone
+	lease.Release()
+	if info, err := db.GetLock(testLock); err != nil || info == nil || info.Owner != "b" {
+		t.Errorf("lock is %+v, %v", info, err)
+	}
+}
+
+func TestPopulateStopsWhenLockLost(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := e2eConfig(t, esi)
+	config.Lock.TTL = 300 * time.Millisecond
+
+	db, err := higgs.GetDatabaseHandle(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Slow enough that the populate is still going when the lock is taken from it
+	esi.Inject(esitest.Fault{Path: "/universe/", Delay: 50 * time.Millisecond})
+
+	done := make(chan error, 1)
+	go func() { done <- higgs.PopulateStaticData(config) }()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info, err := db.GetLock("static_data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("populate never took the lock")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	locks := db.Database.Database(db.DBName).Collection("locks")
+	if _, err := locks.UpdateOne(context.Background(), bson.M{"_id": "static_data"}, bson.M{"$set": bson.M{"owner": "someone else"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "lost the static_data lock") {
+			t.Errorf("want populate stopped for losing the lock, got %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("populate carried on without the lock")
+	}
+
+	// The other holder still has it
+	if info, err := db.GetLock("static_data"); err != nil || info == nil || info.Owner != "someone else" {
+		t.Errorf("lock is %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,383 @@
+package higgs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/podded/higgs"
+	"github.com/podded/higgs/esitest"
+)
+
+// The end to end tests run populate against esitest. Most need a mongo to write to, each test gets a
+// database of its own that is dropped afterwards. Those ending InMemory run without one.
+const mongoURIEnv = "HIGGS_TEST_MONGO_URI"
+
+// collectionFor is where each of the fake ESI's resources ends up
+var collectionFor = map[string]string{
+	"regions":        "regions",
+	"constellations": "constellations",
+	"systems":        "solarsystems",
+	"stars":          "stars",
+	"planets":        "planets",
+	"moons":          "moons",
+	"asteroid_belts": "asteroid_belts",
+	"stargates":      "stargates",
+	"stations":       "stations",
+	"types":          "types",
+	"groups":         "groups",
+	"categories":     "categories",
+}
+
+// memoryConfig is everything but the database
+func memoryConfig(esi *esitest.Server) higgs.Configuration {
+	var config higgs.Configuration
+	config.Web.UserAgent = "higgs e2e tests"
+	config.Web.TimeoutSec = 5
+	config.Web.ESIBaseURL = esi.URL
+	config.App.MaxRoutines = 4
+	config.App.LogLevel = "error"
+	return config
+}
+
+func e2eConfig(t *testing.T, esi *esitest.Server) higgs.Configuration {
+	t.Helper()
+
+	uri := os.Getenv(mongoURIEnv)
+	if uri == "" {
+		t.Skipf("%v is not set, skipping end to end test", mongoURIEnv)
+	}
+
+	config := memoryConfig(esi)
+	config.Database.URI = uri
+	config.Database.Database = fmt.Sprintf("higgs_e2e_%d", time.Now().UnixNano())
+
+	store, err := higgs.GetDatabaseHandle(config)
+	if err != nil {
+		t.Fatalf("failed to connect to mongo: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := store.Database.Database(config.Database.Database).Drop(context.Background()); err != nil {
+			t.Logf("failed to drop %v: %v", config.Database.Database, err)
+		}
+	})
+
+	return config
+}
+
+// assertComplete checks every entity in u made it into the database and verify is happy with it
+func assertComplete(t *testing.T, config higgs.Configuration, u *esitest.Universe) {
+	t.Helper()
+
+	report, err := higgs.VerifyStaticData(config)
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	assertReportComplete(t, report, u)
+}
+
+func assertReportComplete(t *testing.T, report *higgs.VerifyReport, u *esitest.Universe) {
+	t.Helper()
+
+	for resource, collection := range collectionFor {
+		if got, want := report.Counts[collection], int64(u.Count(resource)); got != want {
+			t.Errorf("%v has %v, want %v", collection, got, want)
+		}
+	}
+	if len(report.Missing) > 0 {
+		t.Errorf("verify found missing entities: %v", report.Missing)
+	}
+	if !report.OK() {
+		t.Errorf("verify failed, missing %v and empty %v", report.Missing, report.Empty())
+	}
+}
+
+func TestPopulateStaticData(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := e2eConfig(t, esi)
+
+	if err := higgs.PopulateStaticData(config); err != nil {
+		t.Fatalf("populate failed: %v", err)
+	}
+	assertComplete(t, config, esi.Universe())
+
+	store, err := higgs.GetDatabaseHandle(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	systems, err := store.GetSystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]struct {
+		region string
+		space  string
+		class  int
+	}{
+		30000142: {"The Forge", higgs.SpaceKnown, 0},
+		30002187: {"Domain", higgs.SpaceKnown, 0},
+		31000005: {"G-R00031", higgs.SpaceWormhole, higgs.WormholeClassThera},
+	}
+	for _, sys := range systems {
+		w, ok := want[sys.SystemID]
+		if !ok {
+			continue
+		}
+		if sys.RegionName != w.region || sys.SpaceType != w.space || sys.WormholeClass != w.class {
+			t.Errorf("system %v enriched as %v/%v/%v, want %v/%v/%v", sys.SystemID,
+				sys.RegionName, sys.SpaceType, sys.WormholeClass, w.region, w.space, w.class)
+		}
+	}
+
+	runs, err := higgs.History(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Status != higgs.RunSucceeded {
+		t.Errorf("want one succeeded run in the history, got %+v", runs)
+	}
+}
+
+func TestPopulateSurvivesESIErrors(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := e2eConfig(t, esi)
+	config.Web.TimeoutSec = 1
+	injectESIErrors(esi)
+
+	if err := higgs.PopulateStaticData(config); err != nil {
+		t.Fatalf("populate failed: %v", err)
+	}
+	assertComplete(t, config, esi.Universe())
+	assertRetried(t, esi)
+}
+
+func TestPopulateSurvivesESIErrorsInMemory(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := memoryConfig(esi)
+	config.Web.TimeoutSec = 1
+	injectESIErrors(esi)
+
+	store := higgs.NewMemoryStore()
+	if err := higgs.PopulateInto(config, store, higgs.PopulateOptions{}); err != nil {
+		t.Fatalf("populate failed: %v", err)
+	}
+	report, err := higgs.VerifyStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertReportComplete(t, report, esi.Universe())
+	assertRetried(t, esi)
+}
+
+// injectESIErrors has ESI fail in all the ways a populate should get past by trying again
+func injectESIErrors(esi *esitest.Server) {
+	esi.Inject(esitest.Fault{Path: "/universe/systems/", Status: 420, RetryAfter: time.Second, Times: 1})
+	esi.Inject(esitest.Fault{Path: "/universe/moons/", Status: 502, Times: 3})
+	esi.Inject(esitest.Fault{Path: "/universe/types/", Status: 504, Times: 2})
+	esi.Inject(esitest.Fault{Path: "/universe/stars/", Delay: 2 * time.Second, Times: 1})
+	esi.Inject(esitest.Fault{Path: "/universe/stations/", Delay: 200 * time.Millisecond, Times: 2})
+}
+
+func assertRetried(t *testing.T, esi *esitest.Server) {
+	t.Helper()
+
+	u := esi.Universe()
+	if got, min := esi.Requests("/universe/moons/"), u.Count("moons")+3; got < min {
+		t.Errorf("made %v moon requests, want at least %v with the retries", got, min)
+	}
+	if got, min := esi.Requests("/universe/stars/"), u.Count("stars")+1; got < min {
+		t.Errorf("made %v star requests, want at least %v with the timed out one retried", got, min)
+	}
+}
+
+func TestPopulateMalformedJSON(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := e2eConfig(t, esi)
+
+	// Broken json isnt retried, the moon is logged as failed and the rest carry on, but the moons stage fails
+	const brokenMoon = 40009078
+	esi.Inject(esitest.Fault{Path: fmt.Sprintf("/universe/moons/%v/", brokenMoon), Malformed: true})
+
+	err := higgs.PopulateStaticData(config)
+	var stageErrs higgs.StageErrors
+	if !errors.As(err, &stageErrs) || stageErrs["moons"] == nil || len(stageErrs) != 1 {
+		t.Fatalf("want only the moons stage to fail, got %v", err)
+	}
+
+	report, err := higgs.VerifyStaticData(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := report.Counts["moons"], int64(esi.Universe().Count("moons")-1); got != want {
+		t.Errorf("moons has %v, want %v", got, want)
+	}
+	if missing := report.Missing["moons"]; len(missing) != 1 || missing[0] != brokenMoon {
+		t.Errorf("want verify to find moon %v missing, got %v", brokenMoon, report.Missing)
+	}
+	if len(report.Missing) != 1 {
+		t.Errorf("want only the moon missing, got %v", report.Missing)
+	}
+}
+
+func TestPopulateRecordsChanges(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := e2eConfig(t, esi)
+
+	if err := higgs.PopulateStaticData(config); err != nil {
+		t.Fatalf("first populate failed: %v", err)
+	}
+
+	esi.Update(func(u *esitest.Universe) {
+		jita := u.Get("systems", 30000142)
+		jita["name"] = "Jita Prime"
+		u.Set("types", 622, esitest.Entity{"type_id": 622, "name": "Stabber", "description": "The Stabber",
+			"group_id": 26, "published": true})
+		u.Get("groups", 26)["types"] = []int{620, 621, 622}
+	})
+
+	if err := higgs.PopulateStaticData(config); err != nil {
+		t.Fatalf("second populate failed: %v", err)
+	}
+	assertComplete(t, config, esi.Universe())
+
+	changes, err := higgs.RunChangelog(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := changes.Counts()
+
+	want := map[string]higgs.ChangeCounts{
+		"solarsystems": {Changed: 1},
+		"types":        {Added: 1},
+		"groups":       {Changed: 1},
+	}
+	for collection, w := range want {
+		if counts[collection] != w {
+			t.Errorf("%v changes are %+v, want %+v", collection, counts[collection], w)
+		}
+	}
+	for collection, c := range counts {
+		if _, ok := want[collection]; !ok && c != (higgs.ChangeCounts{}) {
+			t.Errorf("unexpected changes to %v: %+v", collection, c)
+		}
+	}
+}
+
+func TestFailedPopulatePublishesRunFailed(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := e2eConfig(t, esi)
+
+	bus := higgs.NewLocalBus()
+	var subjects []string
+	bus.Subscribe("higgs.>", func(subject string, data []byte) { subjects = append(subjects, subject) })
+	config.Events.Bus = bus
+	config.Events.BusPrefix = "higgs"
+
+	esi.Inject(esitest.Fault{Path: "/universe/moons/40009078/", Malformed: true})
+	if err := higgs.PopulateStaticData(config); err == nil {
+		t.Fatal("want populate to fail")
+	}
+
+	// Just the failure, not a change for everything the run managed to put back
+	if len(subjects) != 1 || subjects[0] != "higgs.run.failed" {
+		t.Errorf("got %v", subjects)
+	}
+}
+
+func TestDaemonRefreshKeepsDataUntilDone(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := e2eConfig(t, esi)
+	config.Daemon.CheckEvery = 50 * time.Millisecond
+
+	if err := higgs.PopulateStaticData(config); err != nil {
+		t.Fatalf("first populate failed: %v", err)
+	}
+	store, err := higgs.GetDatabaseHandle(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	waitForVersion := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			version, err := store.GetDaemonVersion(higgs.SourceESI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("daemon never got to version %v, is on %q", want, version)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	d, err := higgs.NewDaemon(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("daemon stopped with %v", err)
+		}
+	}()
+
+	// There is already data, so the first version is just recorded
+	waitForVersion(esi.Universe().ServerVersion)
+
+	// A slow patch day. Readers should see the old data the whole time and then the new
+	esi.Update(func(u *esitest.Universe) {
+		u.ServerVersion = "2000001"
+		u.Get("systems", 30000142)["name"] = "Jita Prime"
+	})
+	esi.Inject(esitest.Fault{Path: "/universe/types/", Delay: 20 * time.Millisecond})
+
+	systems := int64(esi.Universe().Count("systems"))
+	types := int64(esi.Universe().Count("types"))
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		if n, err := store.Count("solarsystems"); err != nil || n != systems {
+			t.Fatalf("solarsystems has %v during the refresh, want %v, %v", n, systems, err)
+		}
+		if n, err := store.Count("types"); err != nil || n != types {
+			t.Fatalf("types has %v during the refresh, want %v, %v", n, types, err)
+		}
+		if version, _ := store.GetDaemonVersion(higgs.SourceESI); version == "2000001" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh never finished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	assertComplete(t, config, esi.Universe())
+	found, err := store.GetSystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sys := range found {
+		if sys.SystemID == 30000142 && sys.Name != "Jita Prime" {
+			t.Errorf("jita is still called %v", sys.Name)
+		}
+	}
+}
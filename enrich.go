@@ -0,0 +1,146 @@
+package higgs
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Space types a solar system can be classified as
+const (
+	SpaceKnown    = "k-space"
+	SpaceWormhole = "w-space"
+	SpaceAbyssal  = "abyssal"
+	SpacePochven  = "pochven"
+	SpaceJove     = "jove"
+	SpaceUnknown  = "unknown"
+)
+
+// Wormhole classes that are not just C1 to C6
+const (
+	WormholeClassThera     = 12
+	WormholeClassShattered = 13
+)
+
+// The three regions of jove space are the only k-space regions that cant be reached by gate
+var joveRegions = map[int]bool{
+	10000004: true, // UUA-F4
+	10000017: true, // J7HZ-F
+	10000019: true, // A821-A
+}
+
+// ClassifySystem works out what sort of space a system is in from its id and the id of its region.
+// The wormhole class is 0 for anything that isnt in w-space.
+func ClassifySystem(systemID, regionID int) (spaceType string, wormholeClass int) {
+	switch {
+	case systemID >= abyssalSystemMin && systemID <= abyssalSystemMax:
+		return SpaceAbyssal, 0
+	case systemID >= wormholeSystemMin && systemID < abyssalSystemMin:
+		return SpaceWormhole, wormholeClassForRegion(systemID, regionID)
+	case systemID >= knownSpaceSystemMin && systemID < wormholeSystemMin:
+		if regionID == pochvenRegionID {
+			return SpacePochven, 0
+		}
+		if joveRegions[regionID] {
+			return SpaceJove, 0
+		}
+		return SpaceKnown, 0
+	}
+
+	return SpaceUnknown, 0
+}
+
+// Wormhole regions are numbered in order of class, A-R00001 through to the drifter region
+func wormholeClassForRegion(systemID, regionID int) int {
+	if systemID == theraSystemID {
+		return WormholeClassThera
+	}
+
+	switch r := regionID - wormholeRegionMin; {
+	case r >= 1 && r <= 3:
+		return 1
+	case r >= 4 && r <= 8:
+		return 2
+	case r >= 9 && r <= 15:
+		return 3
+	case r >= 16 && r <= 23:
+		return 4
+	case r >= 24 && r <= 29:
+		return 5
+	case r == 30:
+		return 6
+	case r == 32:
+		return WormholeClassShattered
+	}
+
+	// Thera's region and the drifter region (classes 14 to 18 all share 11000033) cant be told apart by id alone
+	return 0
+}
+
+// enrichUniverse denormalises the region onto every system and everything in it, and classifies each
+// system by space type. Has to run after the universe has been populated as it works from the database.
+func enrichUniverse(ctx context.Context, client *Client) error {
+
+	regions, err := client.Store.GetRegions()
+	if err != nil {
+		return err
+	}
+
+	constellations, err := client.Store.GetConstellations()
+	if err != nil {
+		return err
+	}
+
+	systems, err := client.Store.GetSystems()
+	if err != nil {
+		return err
+	}
+
+	regionNames := make(map[int]string)
+	for _, r := range regions {
+		regionNames[r.RegionID] = r.Name
+	}
+
+	constellationRegions := make(map[int]int)
+	for _, c := range constellations {
+		constellationRegions[c.ConstellationID] = c.RegionID
+	}
+
+	client.Log.Info("Enriching systems", "stage", "enrich", "total", len(systems))
+	progressAddTotal("enrich", len(systems))
+
+	regionSystems := make(map[int][]int32)
+	for _, sys := range systems {
+		regionID, ok := constellationRegions[sys.ConstellationID]
+		if !ok {
+			client.Log.Warn("System is in an unknown constellation, skipping", "stage", "enrich", "entity_id", sys.SystemID, "constellation_id", sys.ConstellationID)
+			progressFailed("enrich")
+			continue
+		}
+
+		sys.RegionID = regionID
+		sys.RegionName = regionNames[regionID]
+		sys.SpaceType, sys.WormholeClass = ClassifySystem(sys.SystemID, regionID)
+
+		err = client.Store.UpdateSystemMetadata(ctx, sys)
+		if err != nil {
+			return err
+		}
+
+		regionSystems[regionID] = append(regionSystems[regionID], int32(sys.SystemID))
+		progressDone("enrich")
+	}
+
+	// Everything below a system only knows its system id, so do these a region at a time
+	children := []string{"planets", "moons", "asteroid_belts", "stargates", "stations"}
+	for regionID, ids := range regionSystems {
+		for _, collection := range children {
+			err = client.Store.SetRegion(ctx, collection, ids, int32(regionID), regionNames[regionID])
+			if err != nil {
+				return errors.Wrap(err, "Failed to denormalise region")
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package higgs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxErrorBody is as much of a response body as goes in an error message
+const maxErrorBody = 200
+
+type (
+	// RequestError is a GET that failed for good, after Attempts tries. Status is what the last try returned, 0 if
+	// there was no response, in which case Err is why. Message is the error ESI gave in the body, if it gave one.
+	//
+	// What went wrong is usually one of the types below, which all embed a RequestError, so errors.As works for
+	// them and for a *RequestError if all that matters is the url and status.
+	RequestError struct {
+		URL      string
+		Status   int
+		Attempts int
+		Body     []byte
+		Message  string
+		Err      error
+	}
+
+	// NotFound is a 404, the entity has gone, or never was. There is no point asking again
+	NotFound struct {
+		RequestError
+	}
+
+	// RateLimited is a 429 from making too many requests. RetryAfter is how long we were asked to wait
+	RateLimited struct {
+		RequestError
+		RetryAfter time.Duration
+	}
+
+	// ErrorLimited is a 420, ESI has had too many errors from us and wont answer until Reset has passed
+	ErrorLimited struct {
+		RequestError
+		Reset time.Duration
+	}
+
+	// ServerError is a 5xx, ESI or whatever is behind it is having a bad time
+	ServerError struct {
+		RequestError
+	}
+
+	// Timeout is no response coming back in time
+	Timeout struct {
+		RequestError
+	}
+
+	// DecodeError is a response that came back fine but couldnt be decoded
+	DecodeError struct {
+		RequestError
+	}
+
+	esiErrorBody struct {
+		Error string `json:"error"`
+	}
+)
+
+// newRequestError works out which error a request that failed after attempts tries is
+func newRequestError(url string, attempts, status int, body []byte, header http.Header, err error) error {
+	base := RequestError{URL: url, Status: status, Attempts: attempts, Body: body, Err: err}
+	var esiErr esiErrorBody
+	if len(body) > 0 && json.Unmarshal(body, &esiErr) == nil {
+		base.Message = esiErr.Error
+	}
+
+	switch {
+	case err != nil:
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return &Timeout{base}
+		}
+		return &base
+	case status == http.StatusNotFound:
+		return &NotFound{base}
+	case status == http.StatusTooManyRequests:
+		wait, _ := retryAfter(status, header)
+		return &RateLimited{RequestError: base, RetryAfter: wait}
+	case status == 420:
+		wait, _ := retryAfter(status, header)
+		return &ErrorLimited{RequestError: base, Reset: wait}
+	case status >= 500:
+		return &ServerError{base}
+	}
+	return &base
+}
+
+// decodeESI unmarshals an ESI response into v, failing with a *DecodeError
+func decodeESI(url string, body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return &DecodeError{RequestError{URL: url, Status: http.StatusOK, Attempts: 1, Body: body, Err: err}}
+	}
+	return nil
+}
+
+func (e *RequestError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("GET %v failed after %v attempts: %v", e.URL, e.Attempts, e.Err)
+	}
+
+	detail := e.Message
+	if detail == "" {
+		detail = errorBody(e.Body)
+	}
+	if e.Err != nil {
+		// ctx ended while waiting to retry
+		detail = e.Err.Error()
+	}
+	if detail == "" {
+		return fmt.Sprintf("GET %v returned %v after %v attempts", e.URL, e.Status, e.Attempts)
+	}
+	return fmt.Sprintf("GET %v returned %v after %v attempts: %v", e.URL, e.Status, e.Attempts, detail)
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode GET %v: %v; got %v", e.URL, e.Err, errorBody(e.Body))
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// As lets errors.As find the RequestError in any of the more specific errors
+func (e *RequestError) As(target interface{}) bool {
+	if t, ok := target.(**RequestError); ok {
+		*t = e
+		return true
+	}
+	return false
+}
+
+// errorBody is as much of body as is worth putting in an error message
+func errorBody(body []byte) string {
+	s := strings.TrimSpace(string(body))
+	if len(s) > maxErrorBody {
+		s = s[:maxErrorBody] + "..."
+	}
+	return s
+}
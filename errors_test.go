@@ -0,0 +1,79 @@
+package higgs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/podded/higgs/esitest"
+)
+
+func TestRequestErrors(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	client := memoryClient(esi, NewMemoryStore())
+	client.Retry.Attempts = 1
+	client.HTTP.Timeout = 100 * time.Millisecond
+
+	get := func(path string) error {
+		_, err := client.MakeESIGetContext(context.Background(), client.esiURL("/latest"+path))
+		return err
+	}
+
+	esi.Inject(esitest.Fault{Path: "/universe/moons/", Status: http.StatusNotFound})
+	err := get("/universe/moons/40009078/")
+	var notFound *NotFound
+	if !errors.As(err, &notFound) || notFound.Message != "Not Found" || notFound.Attempts != 1 {
+		t.Errorf("want NotFound with ESI's message, got %#v", err)
+	}
+
+	esi.Inject(esitest.Fault{Path: "/universe/planets/", Status: 420, RetryAfter: 5 * time.Second})
+	err = get("/universe/planets/40009077/")
+	var errorLimited *ErrorLimited
+	if !errors.As(err, &errorLimited) || errorLimited.Reset != 5*time.Second || !strings.Contains(errorLimited.Message, "error limit") {
+		t.Errorf("want ErrorLimited resetting in 5s, got %#v", err)
+	}
+
+	esi.Inject(esitest.Fault{Path: "/universe/stars/", Status: http.StatusTooManyRequests, RetryAfter: 2 * time.Second})
+	err = get("/universe/stars/40009076/")
+	var rateLimited *RateLimited
+	if !errors.As(err, &rateLimited) || rateLimited.RetryAfter != 2*time.Second {
+		t.Errorf("want RateLimited for 2s, got %#v", err)
+	}
+
+	esi.Inject(esitest.Fault{Path: "/universe/stargates/", Status: http.StatusBadGateway})
+	err = get("/universe/stargates/50001248/")
+	var serverError *ServerError
+	if !errors.As(err, &serverError) || serverError.Status != http.StatusBadGateway {
+		t.Errorf("want ServerError 502, got %#v", err)
+	}
+
+	esi.Inject(esitest.Fault{Path: "/universe/stations/", Delay: time.Second})
+	err = get("/universe/stations/60003760/")
+	var timeout *Timeout
+	if !errors.As(err, &timeout) || timeout.Status != 0 || timeout.Err == nil {
+		t.Errorf("want Timeout, got %#v", err)
+	}
+
+	// Every one of them is a RequestError too
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || !strings.Contains(reqErr.URL, "/universe/stations/60003760/") {
+		t.Errorf("want a RequestError with the url from a Timeout, got %#v", reqErr)
+	}
+
+	esi.Inject(esitest.Fault{Path: "/universe/types/", Malformed: true})
+	url := client.esiURL("/latest/universe/types/587/")
+	body, err := client.MakeESIGetContext(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var typeESI ESIType
+	err = decodeESI(url, body, &typeESI)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.URL != url || string(decodeErr.Body) != string(body) {
+		t.Errorf("want DecodeError, got %#v", err)
+	}
+}
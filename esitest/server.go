@@ -0,0 +1,254 @@
+// Package esitest is a fake ESI for tests. It serves a small Universe over httptest and can be told to
+// misbehave the way ESI does, error limiting, gateway errors, going slow and sending broken json.
+package esitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Server is a running fake ESI. Point Web.ESIBaseURL at URL.
+	Server struct {
+		*httptest.Server
+
+		mu       sync.Mutex
+		universe *Universe
+		faults   []*Fault
+		requests map[string]int
+	}
+
+	// Fault makes matching requests misbehave
+	Fault struct {
+		// Path is matched against the start of the request path once the version is taken off, eg
+		// /universe/moons/ or /universe/types/587/. Empty matches everything.
+		Path string
+		// Status is sent instead of the entity, with an ESI style error body. 420 also says the error limit is used up.
+		Status int
+		// Delay is waited before answering
+		Delay time.Duration
+		// RetryAfter is sent in Retry-After with Status, in whole seconds. For a 420 it is when the error limit
+		// resets too, which is otherwise a minute away
+		RetryAfter time.Duration
+		// Malformed sends a 200 with json that doesnt parse
+		Malformed bool
+		// Times is how many requests this fault applies to before it stops, 0 is all of them
+		Times int
+		// Page only matches that page of a paged list, 0 is any page. No page asked for is page 1
+		Page int
+		// Language only matches requests for that translation, empty is any of them
+		Language string
+	}
+)
+
+// versionPrefix is taken off every path so the routes dont care which version of an endpoint is asked for
+var versionPrefix = regexp.MustCompile(`^/(latest|dev|legacy|v[0-9]+)/`)
+
+// NewServer starts a fake ESI serving u, or NewUniverse if u is nil. Close it when done.
+func NewServer(u *Universe) *Server {
+	if u == nil {
+		u = NewUniverse()
+	}
+	s := &Server{universe: u, requests: make(map[string]int)}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Universe is what is being served. Change it with Update so it isnt changed under a request.
+func (s *Server) Universe() *Universe {
+	return s.universe
+}
+
+// Update changes the universe being served
+func (s *Server) Update(fn func(u *Universe)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s.universe)
+}
+
+// Inject adds a fault. Faults are checked in the order they were added and the first one that matches is used.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults takes away every fault
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests is how many requests there have been for paths starting with prefix, with the version taken off
+func (s *Server) Requests(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for path, count := range s.requests {
+		if strings.HasPrefix(path, prefix) {
+			n += count
+		}
+	}
+	return n
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "/")
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	s.mu.Lock()
+	s.requests[path]++
+	fault := s.fault(path, r.URL.Query().Get("page"), r.URL.Query().Get("language"))
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-Esi-Error-Limit-Reset", "60")
+	w.Header().Set("X-Esi-Error-Limit-Remain", "100")
+
+	if fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.Status != 0 {
+			if fault.RetryAfter > 0 {
+				secs := strconv.Itoa(int(math.Ceil(fault.RetryAfter.Seconds())))
+				w.Header().Set("Retry-After", secs)
+				w.Header().Set("X-Esi-Error-Limit-Reset", secs)
+			}
+			if fault.Status == 420 {
+				w.Header().Set("X-Esi-Error-Limit-Remain", "0")
+				writeError(w, fault.Status, "This software has exceeded the error limit for ESI. If you are a user, please contact the maintainer of this software. If you are a developer/maintainer, please make a greater effort in the future to receive valid responses.")
+				return
+			}
+			writeError(w, fault.Status, http.StatusText(fault.Status))
+			return
+		}
+		if fault.Malformed {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"name": "broken`)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	status, body := s.route(path, r, w.Header())
+	s.mu.Unlock()
+
+	if status != http.StatusOK {
+		writeError(w, status, string(body))
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// fault finds the fault for path, using up one of its times. Holds mu.
+func (s *Server) fault(path, page, lang string) *Fault {
+	n, err := strconv.Atoi(page)
+	if err != nil {
+		n = 1
+	}
+	for i, f := range s.faults {
+		if !strings.HasPrefix(path, f.Path) || (f.Page != 0 && f.Page != n) || (f.Language != "" && f.Language != lang) {
+			continue
+		}
+		found := *f
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return &found
+	}
+	return nil
+}
+
+// route answers a request from the universe. Holds mu. A status other than 200 comes with the error message as the body.
+func (s *Server) route(path string, r *http.Request, header http.Header) (int, []byte) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	if len(parts) == 1 && parts[0] == "status" {
+		return encode(Entity{"players": 12345, "server_version": s.universe.ServerVersion, "start_time": "2026-01-01T11:00:00Z"})
+	}
+
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "universe" {
+		return http.StatusNotFound, []byte("Requested page does not exist!")
+	}
+
+	resource := parts[1]
+	if _, ok := s.universe.Entities[resource]; !ok {
+		return http.StatusNotFound, []byte("Requested page does not exist!")
+	}
+
+	if len(parts) == 2 {
+		page := 1
+		if p := r.URL.Query().Get("page"); p != "" {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 1 {
+				return http.StatusBadRequest, []byte("page must be a positive integer")
+			}
+			page = n
+		}
+		if paged[resource] {
+			header.Set("X-Pages", strconv.Itoa(s.universe.Pages(resource)))
+		}
+		return encode(s.universe.Page(resource, page))
+	}
+
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return http.StatusBadRequest, []byte("id must be an integer")
+	}
+	e := s.universe.Get(resource, id)
+	if e == nil {
+		return http.StatusNotFound, []byte(fmt.Sprintf("%v not found", strings.TrimSuffix(resource, "s")))
+	}
+
+	if lang := r.URL.Query().Get("language"); lang != "" && lang != "en" && lang != "en-us" {
+		e = translate(e, lang)
+	}
+	return encode(e)
+}
+
+// translate fakes a translation by tagging the language onto the name and description
+func translate(e Entity, lang string) Entity {
+	out := make(Entity, len(e))
+	for k, v := range e {
+		out[k] = v
+	}
+	for _, field := range []string{"name", "description"} {
+		if text, ok := out[field].(string); ok && text != "" {
+			out[field] = fmt.Sprintf("%v [%v]", text, lang)
+		}
+	}
+	return out
+}
+
+func encode(v interface{}) (int, []byte) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	return http.StatusOK, body
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
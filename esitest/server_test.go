@@ -0,0 +1,185 @@
+package esitest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, s *Server, path string, out interface{}) *http.Response {
+	t.Helper()
+	res, err := http.Get(s.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if out != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("decoding %v: %v", path, err)
+		}
+	}
+	return res
+}
+
+// Everything the universe references has to be there, or verify would never pass against it
+func TestUniverseIsConsistent(t *testing.T) {
+	u := NewUniverse()
+
+	check := func(resource string, ids ...interface{}) {
+		t.Helper()
+		for _, id := range ids {
+			if u.Get(resource, id.(int)) == nil {
+				t.Errorf("%v %v is referenced but not there", resource, id)
+			}
+		}
+	}
+	ints := func(v interface{}) []interface{} {
+		var out []interface{}
+		for _, id := range v.([]int) {
+			out = append(out, id)
+		}
+		return out
+	}
+
+	for _, r := range u.Entities["regions"] {
+		check("constellations", ints(r["constellations"])...)
+	}
+	for _, c := range u.Entities["constellations"] {
+		check("regions", c["region_id"])
+		check("systems", ints(c["systems"])...)
+	}
+	for _, s := range u.Entities["systems"] {
+		check("constellations", s["constellation_id"])
+		check("stars", s["star_id"])
+		check("stargates", ints(s["stargates"])...)
+		check("stations", ints(s["stations"])...)
+		for _, p := range s["planets"].([]Entity) {
+			check("planets", p["planet_id"])
+			check("moons", ints(p["moons"])...)
+			check("asteroid_belts", ints(p["asteroid_belts"])...)
+		}
+	}
+	for _, g := range u.Entities["stargates"] {
+		dest := g["destination"].(Entity)
+		check("stargates", dest["stargate_id"])
+		check("systems", dest["system_id"])
+	}
+	for _, g := range u.Entities["groups"] {
+		check("categories", g["category_id"])
+		check("types", ints(g["types"])...)
+	}
+	for _, ty := range u.Entities["types"] {
+		check("groups", ty["group_id"])
+	}
+}
+
+func TestServerPages(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+	u := s.Universe()
+
+	var all []int
+	for page := 1; ; page++ {
+		var ids []int
+		res := get(t, s, fmt.Sprintf("/v1/universe/types/?datasource=tranquility&page=%v", page), &ids)
+		if got, want := res.Header.Get("X-Pages"), fmt.Sprint(u.Pages("types")); got != want {
+			t.Fatalf("X-Pages is %q, want %q", got, want)
+		}
+		if len(ids) == 0 {
+			break
+		}
+		all = append(all, ids...)
+	}
+	if len(all) != u.Count("types") || u.Pages("types") < 2 {
+		t.Errorf("paged through %v types over %v pages, want %v over more than one", len(all), u.Pages("types"), u.Count("types"))
+	}
+}
+
+func TestServerEntities(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	var system struct {
+		SystemID int    `json:"system_id"`
+		Name     string `json:"name"`
+	}
+	get(t, s, "/latest/universe/systems/30000142/?datasource=tranquility", &system)
+	if system.SystemID != 30000142 || system.Name != "Jita" {
+		t.Errorf("got system %+v", system)
+	}
+
+	get(t, s, "/latest/universe/systems/30000142/?datasource=tranquility&language=de", &system)
+	if system.Name != "Jita [de]" {
+		t.Errorf("translated name is %q", system.Name)
+	}
+
+	if res := get(t, s, "/v1/universe/moons/1/", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown moon returned %v", res.StatusCode)
+	}
+
+	var status struct {
+		ServerVersion string `json:"server_version"`
+	}
+	get(t, s, "/latest/status/?datasource=tranquility", &status)
+	if status.ServerVersion != s.Universe().ServerVersion {
+		t.Errorf("server version is %q", status.ServerVersion)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Close()
+
+	s.Inject(Fault{Path: "/universe/moons/", Status: 502, Times: 2})
+	s.Inject(Fault{Path: "/universe/types/", Status: 420})
+	s.Inject(Fault{Path: "/universe/planets/", Malformed: true, Times: 1})
+	s.Inject(Fault{Path: "/universe/stars/", Delay: 100 * time.Millisecond, Times: 1})
+
+	for i, want := range []int{502, 502, 200} {
+		if res := get(t, s, "/v1/universe/moons/40009078/", nil); res.StatusCode != want {
+			t.Errorf("moon request %v returned %v, want %v", i, res.StatusCode, want)
+		}
+	}
+
+	res := get(t, s, "/v3/universe/types/587/", nil)
+	if res.StatusCode != 420 || res.Header.Get("X-Esi-Error-Limit-Remain") != "0" {
+		t.Errorf("type returned %v with %v errors remaining", res.StatusCode, res.Header.Get("X-Esi-Error-Limit-Remain"))
+	}
+
+	var planet Entity
+	if err := json.NewDecoder(mustGet(t, s, "/v1/universe/planets/40009077/")).Decode(&planet); err == nil {
+		t.Error("malformed planet decoded")
+	}
+	get(t, s, "/v1/universe/planets/40009077/", &planet)
+	if planet["name"] != "Jita I" {
+		t.Errorf("planet after the fault is %v", planet)
+	}
+
+	start := time.Now()
+	get(t, s, "/v1/universe/stars/40009076/", nil)
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("slow star took %v", took)
+	}
+
+	if got := s.Requests("/universe/moons/"); got != 3 {
+		t.Errorf("counted %v moon requests, want 3", got)
+	}
+
+	s.ClearFaults()
+	if res := get(t, s, "/v3/universe/types/587/", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("type returned %v after clearing faults", res.StatusCode)
+	}
+}
+
+func mustGet(t *testing.T, s *Server, path string) io.Reader {
+	t.Helper()
+	res, err := http.Get(s.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res.Body
+}
@@ -0,0 +1,237 @@
+package esitest
+
+import (
+	"fmt"
+	"sort"
+)
+
+type (
+	// Universe is the data the fake ESI serves, keyed by the resource name in the ESI path
+	// (regions, constellations, systems, stars, planets, moons, asteroid_belts, stargates, stations,
+	// types, groups and categories) then by id. Each entity is the json ESI would send for it.
+	Universe struct {
+		Entities map[string]map[int]Entity
+		// PageSize is how many ids go in each page of types and groups
+		PageSize int
+		// ServerVersion is what /status says the game is on
+		ServerVersion string
+	}
+
+	// Entity is one thing as ESI sends it
+	Entity map[string]interface{}
+
+	systemSpec struct {
+		id, constellation, star int
+		name                    string
+		security                float64
+		// planets holds the number of moons and belts for each planet
+		planets  [][2]int
+		gates    []int
+		stations []int
+	}
+)
+
+// paged are the resources ESI only lists a page at a time
+var paged = map[string]bool{"types": true, "groups": true}
+
+// NewUniverse builds a small universe that hangs together, every id referenced is there. It has three
+// regions, one of them wormhole space, four systems with planets, moons, belts, stargates and stations,
+// and three categories of types split over a few pages.
+func NewUniverse() *Universe {
+	u := &Universe{Entities: make(map[string]map[int]Entity), PageSize: 3, ServerVersion: "2000000"}
+
+	u.add("regions", 10000002, Entity{"region_id": 10000002, "name": "The Forge", "description": "Caldari heartland", "constellations": []int{20000020}})
+	u.add("regions", 10000043, Entity{"region_id": 10000043, "name": "Domain", "description": "Amarr heartland", "constellations": []int{20000322}})
+	u.add("regions", 11000031, Entity{"region_id": 11000031, "name": "G-R00031", "description": "", "constellations": []int{21000324}})
+
+	u.add("constellations", 20000020, Entity{"constellation_id": 20000020, "name": "Kimotoro", "region_id": 10000002, "systems": []int{30000142, 30000144}, "position": position(1)})
+	u.add("constellations", 20000322, Entity{"constellation_id": 20000322, "name": "Throne Worlds", "region_id": 10000043, "systems": []int{30002187}, "position": position(2)})
+	u.add("constellations", 21000324, Entity{"constellation_id": 21000324, "name": "G-C00324", "region_id": 11000031, "systems": []int{31000005}, "position": position(3)})
+
+	systems := []systemSpec{
+		{id: 30000142, constellation: 20000020, star: 40009076, name: "Jita", security: 0.9459,
+			planets: [][2]int{{2, 1}, {0, 0}}, gates: []int{50001248}, stations: []int{60003760}},
+		{id: 30000144, constellation: 20000020, star: 40009116, name: "Perimeter", security: 0.9539,
+			planets: [][2]int{{1, 0}}, gates: []int{50001249, 50001250}},
+		{id: 30002187, constellation: 20000322, star: 40139211, name: "Amarr", security: 1.0,
+			planets: [][2]int{{1, 1}}, gates: []int{50001251}, stations: []int{60008494}},
+		{id: 31000005, constellation: 21000324, star: 40600000, name: "Thera", security: -0.99,
+			planets: [][2]int{{0, 0}}},
+	}
+	for _, s := range systems {
+		u.addSystem(s)
+	}
+
+	u.addGate(50001248, 30000142, "Perimeter", 50001249, 30000144)
+	u.addGate(50001249, 30000144, "Jita", 50001248, 30000142)
+	u.addGate(50001250, 30000144, "Amarr", 50001251, 30002187)
+	u.addGate(50001251, 30002187, "Perimeter", 50001250, 30000144)
+
+	u.add("stations", 60003760, Entity{"station_id": 60003760, "name": "Jita IV - Moon 4 - Caldari Navy Assembly Plant", "system_id": 30000142,
+		"type_id": 1531, "owner": 1000035, "race_id": 1, "position": position(60003760), "max_dockable_ship_volume": 50000000,
+		"office_rental_cost": 10000, "reprocessing_efficiency": 0.5, "reprocessing_stations_take": 0.05, "services": []string{"market", "repair-facilities"}})
+	u.add("stations", 60008494, Entity{"station_id": 60008494, "name": "Amarr VIII (Oris) - Emperor Family Academy", "system_id": 30002187,
+		"type_id": 1932, "owner": 1000086, "race_id": 4, "position": position(60008494), "max_dockable_ship_volume": 50000000,
+		"office_rental_cost": 10000, "reprocessing_efficiency": 0.5, "reprocessing_stations_take": 0.05, "services": []string{"market"}})
+
+	u.add("categories", 4, Entity{"category_id": 4, "name": "Material", "published": true, "groups": []int{18}})
+	u.add("categories", 6, Entity{"category_id": 6, "name": "Ship", "published": true, "groups": []int{25, 26}})
+	u.add("categories", 9, Entity{"category_id": 9, "name": "Blueprint", "published": true, "groups": []int{105}})
+
+	u.add("groups", 18, Entity{"group_id": 18, "name": "Mineral", "category_id": 4, "published": true, "types": []int{34, 35, 36}})
+	u.add("groups", 25, Entity{"group_id": 25, "name": "Frigate", "category_id": 6, "published": true, "types": []int{587, 603}})
+	u.add("groups", 26, Entity{"group_id": 26, "name": "Cruiser", "category_id": 6, "published": true, "types": []int{620, 621}})
+	u.add("groups", 105, Entity{"group_id": 105, "name": "Frigate Blueprint", "category_id": 9, "published": true, "types": []int{691}})
+
+	u.addType(34, 18, "Tritanium", 0.01)
+	u.addType(35, 18, "Pyerite", 0.01)
+	u.addType(36, 18, "Mexallon", 0.01)
+	u.addType(587, 25, "Rifter", 27289)
+	u.addType(603, 25, "Merlin", 16500)
+	u.addType(620, 26, "Osprey", 107000)
+	u.addType(621, 26, "Caracal", 92000)
+	u.addType(691, 105, "Rifter Blueprint", 0.01)
+
+	return u
+}
+
+// Get returns an entity, nil if there isnt one
+func (u *Universe) Get(resource string, id int) Entity {
+	return u.Entities[resource][id]
+}
+
+// Set adds or replaces an entity, for changing the universe between runs
+func (u *Universe) Set(resource string, id int, e Entity) {
+	u.add(resource, id, e)
+}
+
+// Delete takes an entity out of the universe. Anything referencing it is left alone.
+func (u *Universe) Delete(resource string, id int) {
+	delete(u.Entities[resource], id)
+}
+
+// IDs returns the ids of everything of a resource, in order
+func (u *Universe) IDs(resource string) []int {
+	ids := make([]int, 0, len(u.Entities[resource]))
+	for id := range u.Entities[resource] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Count is how many of a resource there are
+func (u *Universe) Count(resource string) int {
+	return len(u.Entities[resource])
+}
+
+// Pages is how many pages a paged resource takes
+func (u *Universe) Pages(resource string) int {
+	n := u.Count(resource)
+	if !paged[resource] || u.PageSize < 1 || n == 0 {
+		return 1
+	}
+	return (n + u.PageSize - 1) / u.PageSize
+}
+
+// Page returns the ids on a page of a resource, pages start at 1. Past the end is empty.
+func (u *Universe) Page(resource string, page int) []int {
+	ids := u.IDs(resource)
+	if !paged[resource] || u.PageSize < 1 {
+		if page == 1 {
+			return ids
+		}
+		return []int{}
+	}
+
+	start := (page - 1) * u.PageSize
+	if page < 1 || start >= len(ids) {
+		return []int{}
+	}
+	end := start + u.PageSize
+	if end > len(ids) {
+		end = len(ids)
+	}
+	return ids[start:end]
+}
+
+func (u *Universe) add(resource string, id int, e Entity) {
+	if u.Entities[resource] == nil {
+		u.Entities[resource] = make(map[int]Entity)
+	}
+	u.Entities[resource][id] = e
+}
+
+// addSystem adds a system along with its star, planets, moons and belts. Their ids follow on from the star's.
+func (u *Universe) addSystem(s systemSpec) {
+	next := s.star + 1
+
+	var planets []Entity
+	for i, counts := range s.planets {
+		planetID := next
+		next++
+		planetName := fmt.Sprintf("%v %v", s.name, roman(i+1))
+		u.add("planets", planetID, Entity{"planet_id": planetID, "name": planetName, "system_id": s.id, "type_id": 11, "position": position(planetID)})
+
+		moons := []int{}
+		for m := 0; m < counts[0]; m++ {
+			u.add("moons", next, Entity{"moon_id": next, "name": fmt.Sprintf("%v - Moon %v", planetName, m+1), "system_id": s.id, "position": position(next)})
+			moons = append(moons, next)
+			next++
+		}
+
+		belts := []int{}
+		for b := 0; b < counts[1]; b++ {
+			u.add("asteroid_belts", next, Entity{"name": fmt.Sprintf("%v - Asteroid Belt %v", planetName, b+1), "system_id": s.id, "position": position(next)})
+			belts = append(belts, next)
+			next++
+		}
+
+		planets = append(planets, Entity{"planet_id": planetID, "moons": moons, "asteroid_belts": belts})
+	}
+
+	u.add("stars", s.star, Entity{"name": s.name + " - Star", "solar_system_id": s.id, "type_id": 45041, "age": 4000000000,
+		"luminosity": 0.5, "radius": 60000000, "spectral_class": "K5 V", "temperature": 4000})
+
+	gates := s.gates
+	if gates == nil {
+		gates = []int{}
+	}
+	stations := s.stations
+	if stations == nil {
+		stations = []int{}
+	}
+
+	security := "B"
+	if s.security < 0.5 {
+		security = "E"
+	}
+
+	u.add("systems", s.id, Entity{"system_id": s.id, "name": s.name, "constellation_id": s.constellation, "star_id": s.star,
+		"security_status": s.security, "security_class": security, "position": position(s.id),
+		"planets": planets, "stargates": gates, "stations": stations})
+}
+
+func (u *Universe) addGate(id, system int, to string, destGate, destSystem int) {
+	u.add("stargates", id, Entity{"stargate_id": id, "name": "Stargate (" + to + ")", "system_id": system, "type_id": 16,
+		"position": position(id), "destination": Entity{"stargate_id": destGate, "system_id": destSystem}})
+}
+
+func (u *Universe) addType(id, group int, name string, mass float64) {
+	u.add("types", id, Entity{"type_id": id, "name": name, "description": "The " + name, "group_id": group, "published": true,
+		"mass": mass, "volume": 0.01, "portion_size": 1,
+		"dogma_attributes": []Entity{{"attribute_id": 4, "value": mass}, {"attribute_id": 161, "value": 0.01}}})
+}
+
+func position(seed int) Entity {
+	f := float64(seed % 1000)
+	return Entity{"x": f * 1e12, "y": -f * 1e10, "z": f * 1e11}
+}
+
+func roman(n int) string {
+	numerals := []string{"I", "II", "III", "IV", "V", "VI", "VII", "VIII", "IX", "X"}
+	if n >= 1 && n <= len(numerals) {
+		return numerals[n-1]
+	}
+	return fmt.Sprint(n)
+}
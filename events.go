@@ -0,0 +1,279 @@
+package higgs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// webhookBatch is how many events go in each webhook POST
+const webhookBatch = 500
+
+// A run that fails part way through may have left collections empty or half filled. Rather than the entity
+// changes it publishes one event of this kind and operation, with the error, so consumers know to stop trusting
+// what they have cached.
+const (
+	EventKindRun   = "run"
+	EventRunFailed = "failed"
+)
+
+type (
+	// ChangeEvent tells a downstream consumer that one entity changed, so they can drop whatever they cached
+	ChangeEvent struct {
+		RunID string `json:"run_id" bson:"run_id"`
+		// Kind is the collection the entity lives in, eg types or solarsystems
+		Kind      string `json:"kind" bson:"kind"`
+		ID        int64  `json:"id" bson:"id"`
+		Name      string `json:"name,omitempty" bson:"name,omitempty"`
+		Operation string `json:"operation" bson:"operation"`
+		// Fields are the paths of the fields that changed, only set for changes
+		Fields []string `json:"fields,omitempty" bson:"fields,omitempty"`
+		// Error is why the run failed, only set for run failed events
+		Error string    `json:"error,omitempty" bson:"error,omitempty"`
+		Time  time.Time `json:"time" bson:"time"`
+	}
+
+	// ChangeSink is somewhere change events are sent after a run
+	ChangeSink interface {
+		Publish(ctx context.Context, events []ChangeEvent) error
+	}
+
+	// MessageBus is the little bit of a NATS or Redis style bus we need. LocalBus is one for tests.
+	MessageBus interface {
+		Publish(ctx context.Context, subject string, data []byte) error
+	}
+
+	// WebhookSink POSTs events as a json list to URL
+	WebhookSink struct {
+		URL    string
+		Secret string
+		HTTP   *http.Client
+	}
+
+	// ChangeLogSink writes events to the change_log collection
+	ChangeLogSink struct {
+		Store *DB
+	}
+
+	// BusSink publishes each event as json on <Prefix>.<kind>.<operation>. Setting Bus in the events config
+	// adds one to every run.
+	BusSink struct {
+		Bus    MessageBus
+		Prefix string
+	}
+
+	// LocalBus is an in process MessageBus. Subjects are matched NATS style, * for one token and > for the rest.
+	LocalBus struct {
+		mu   sync.RWMutex
+		subs []localSub
+	}
+
+	localSub struct {
+		pattern string
+		fn      func(subject string, data []byte)
+	}
+)
+
+var (
+	sinksMu sync.Mutex
+	sinks   []ChangeSink
+)
+
+// RegisterChangeSink adds a sink that every run publishes to, on top of the ones in the config
+func RegisterChangeSink(sink ChangeSink) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinks = append(sinks, sink)
+}
+
+// Events turns a changelog into the events to publish for it
+func (c *Changelog) Events(runID primitive.ObjectID) []ChangeEvent {
+	now := time.Now().UTC()
+	var events []ChangeEvent
+	add := func(collection, op string, e EntityChange) {
+		event := ChangeEvent{RunID: runID.Hex(), Kind: collection, ID: e.ID, Name: e.Name, Operation: op, Time: now}
+		for _, f := range e.Fields {
+			event.Fields = append(event.Fields, f.Field)
+		}
+		events = append(events, event)
+	}
+
+	for _, cc := range c.Collections {
+		for _, e := range cc.Added {
+			add(cc.Collection, ChangeAdded, e)
+		}
+		for _, e := range cc.Removed {
+			add(cc.Collection, ChangeRemoved, e)
+		}
+		for _, e := range cc.Changed {
+			add(cc.Collection, ChangeChanged, e)
+		}
+	}
+	return events
+}
+
+// runFailedEvent is what is published instead of the changes when a run fails
+func runFailedEvent(runID primitive.ObjectID, err error) ChangeEvent {
+	return ChangeEvent{RunID: runID.Hex(), Kind: EventKindRun, Operation: EventRunFailed, Error: err.Error(), Time: time.Now().UTC()}
+}
+
+// changeSinks are the sinks from the config along with any that were registered
+func (c *Client) changeSinks(config EventsConfig) []ChangeSink {
+	var out []ChangeSink
+	for _, hook := range config.Webhooks {
+		out = append(out, &WebhookSink{URL: hook, Secret: config.WebhookSecret, HTTP: c.HTTP})
+	}
+	if db, ok := c.db(); ok && config.ChangeLog {
+		out = append(out, &ChangeLogSink{Store: db})
+	}
+	if config.Bus != nil {
+		out = append(out, &BusSink{Bus: config.Bus, Prefix: config.BusPrefix})
+	}
+
+	sinksMu.Lock()
+	out = append(out, sinks...)
+	sinksMu.Unlock()
+
+	return out
+}
+
+// publishChanges sends events to every sink. A sink failing is logged, the rest still get them.
+func (c *Client) publishChanges(ctx context.Context, sinks []ChangeSink, events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	for _, sink := range sinks {
+		err := sink.Publish(ctx, events)
+		if err != nil {
+			c.Log.Warn("Failed to publish change events", "sink", fmt.Sprintf("%T", sink), "events", len(events), "error", err)
+			continue
+		}
+		c.Log.Info("Published change events", "sink", fmt.Sprintf("%T", sink), "events", len(events))
+	}
+}
+
+func (s *WebhookSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	client := s.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for len(events) > 0 {
+		n := len(events)
+		if n > webhookBatch {
+			n = webhookBatch
+		}
+
+		body, err := json.Marshal(events[:n])
+		if err != nil {
+			return errors.Wrap(err, "failed to encode events")
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "Failed to build webhook request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if s.Secret != "" {
+			req.Header.Set("X-Higgs-Signature", "sha256="+SignWebhook(s.Secret, body))
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to call webhook %v", redactURL(s.URL))
+		}
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return errors.Errorf("webhook %v returned %v", redactURL(s.URL), res.StatusCode)
+		}
+
+		events = events[n:]
+	}
+
+	return nil
+}
+
+// SignWebhook is the hex hmac sha256 of body, for checking the X-Higgs-Signature header on the receiving end
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *ChangeLogSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	return s.Store.InsertChangeEvents(ctx, events)
+}
+
+func (s *BusSink) Publish(ctx context.Context, events []ChangeEvent) error {
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode event")
+		}
+
+		subject := event.Kind + "." + event.Operation
+		if s.Prefix != "" {
+			subject = s.Prefix + "." + subject
+		}
+
+		err = s.Bus.Publish(ctx, subject, data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to publish to %v", subject)
+		}
+	}
+	return nil
+}
+
+// NewLocalBus makes an empty in process bus
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+// Subscribe calls fn for everything published on a subject matching pattern. fn is called synchronously
+// from Publish so should be quick.
+func (b *LocalBus) Subscribe(pattern string, fn func(subject string, data []byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, localSub{pattern: pattern, fn: fn})
+}
+
+func (b *LocalBus) Publish(ctx context.Context, subject string, data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subs {
+		if subjectMatches(sub.pattern, subject) {
+			sub.fn(subject, data)
+		}
+	}
+	return ctx.Err()
+}
+
+func subjectMatches(pattern, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+	for i, token := range p {
+		if token == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (token != "*" && token != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
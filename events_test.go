@@ -0,0 +1,246 @@
+package higgs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	busMessage struct {
+		subject string
+		event   ChangeEvent
+	}
+
+	// failingBus errors on every publish
+	failingBus struct{}
+)
+
+func (failingBus) Publish(ctx context.Context, subject string, data []byte) error {
+	return errors.New("bus is down")
+}
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		want             bool
+	}{
+		{"types.added", "types.added", true},
+		{"types.added", "types.removed", false},
+		{"types.*", "types.removed", true},
+		{"*.changed", "solarsystems.changed", true},
+		{"*.changed", "solarsystems.added", false},
+		// * is exactly one token
+		{"types.*", "types", false},
+		{"types.*", "higgs.types.added", false},
+		{"higgs.*", "higgs.types.added", false},
+		// > is one or more
+		{"higgs.>", "higgs.types.added", true},
+		{"higgs.>", "higgs.run", true},
+		{"higgs.>", "higgs", false},
+		{">", "types.added", true},
+		{"higgs.*.added", "higgs.types.added", true},
+		{"higgs.*.added", "other.types.added", false},
+		{"types.added", "types.added.extra", false},
+		{"types.added.extra", "types.added", false},
+	}
+
+	for _, tt := range tests {
+		if got := subjectMatches(tt.pattern, tt.subject); got != tt.want {
+			t.Errorf("%q against %q: got %v, want %v", tt.pattern, tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestLocalBus(t *testing.T) {
+	bus := NewLocalBus()
+	got := make(map[string][]string)
+	for _, pattern := range []string{"higgs.>", "higgs.types.*", "higgs.*.removed"} {
+		pattern := pattern
+		bus.Subscribe(pattern, func(subject string, data []byte) {
+			got[pattern] = append(got[pattern], subject+" "+string(data))
+		})
+	}
+
+	ctx := context.Background()
+	for _, subject := range []string{"higgs.types.added", "higgs.groups.removed", "other.types.added"} {
+		if err := bus.Publish(ctx, subject, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string][]string{
+		"higgs.>":         {"higgs.types.added x", "higgs.groups.removed x"},
+		"higgs.types.*":   {"higgs.types.added x"},
+		"higgs.*.removed": {"higgs.groups.removed x"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := bus.Publish(cancelled, "higgs.types.added", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("want cancelled publishing after the context is done, got %v", err)
+	}
+}
+
+func TestBusSink(t *testing.T) {
+	events := []ChangeEvent{
+		{Kind: "types", ID: 587, Operation: ChangeChanged, Fields: []string{"name"}},
+		{Kind: "solarsystems", ID: 30000142, Operation: ChangeRemoved},
+		{Kind: EventKindRun, Operation: EventRunFailed, Error: "boom"},
+	}
+
+	tests := []struct {
+		prefix   string
+		subjects []string
+	}{
+		{"", []string{"types.changed", "solarsystems.removed", "run.failed"}},
+		{"higgs", []string{"higgs.types.changed", "higgs.solarsystems.removed", "higgs.run.failed"}},
+	}
+
+	for _, tt := range tests {
+		bus := NewLocalBus()
+		var got []busMessage
+		bus.Subscribe(">", func(subject string, data []byte) {
+			var event ChangeEvent
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, busMessage{subject, event})
+		})
+
+		sink := &BusSink{Bus: bus, Prefix: tt.prefix}
+		if err := sink.Publish(context.Background(), events); err != nil {
+			t.Fatalf("prefix %q: %v", tt.prefix, err)
+		}
+		if len(got) != len(events) {
+			t.Fatalf("prefix %q: got %v messages, want %v", tt.prefix, len(got), len(events))
+		}
+		for i, msg := range got {
+			if msg.subject != tt.subjects[i] || !reflect.DeepEqual(msg.event, events[i]) {
+				t.Errorf("prefix %q: got %v %+v, want %v %+v", tt.prefix, msg.subject, msg.event, tt.subjects[i], events[i])
+			}
+		}
+	}
+
+	err := (&BusSink{Bus: failingBus{}}).Publish(context.Background(), events)
+	if err == nil || !strings.Contains(err.Error(), "types.changed") {
+		t.Errorf("want the failing subject in the error, got %v", err)
+	}
+}
+
+func TestChangeSinksFromConfig(t *testing.T) {
+	bus := NewLocalBus()
+	client := &Client{}
+	got := client.changeSinks(EventsConfig{Webhooks: []string{"http://a", "http://b"}, Bus: bus, BusPrefix: "higgs"})
+
+	if len(got) != 3 {
+		t.Fatalf("want two webhooks and a bus, got %+v", got)
+	}
+	if b, ok := got[2].(*BusSink); !ok || b.Bus != bus || b.Prefix != "higgs" {
+		t.Errorf("want the bus from the config, got %+v", got[2])
+	}
+	// Without a database there is nowhere for the change log to go
+	if got := client.changeSinks(EventsConfig{ChangeLog: true}); len(got) != 0 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	tests := []struct {
+		secret, body, want string
+	}{
+		{"key", "The quick brown fox jumps over the lazy dog", "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{"", "", "b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+	}
+
+	for _, tt := range tests {
+		if got := SignWebhook(tt.secret, []byte(tt.body)); got != tt.want {
+			t.Errorf("%q %q: got %v, want %v", tt.secret, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		events  int
+		secret  string
+		status  int
+		batches []int
+		wantErr bool
+	}{
+		{"one batch", 3, "", http.StatusOK, []int{3}, false},
+		{"signed", 3, "s3cret", http.StatusNoContent, []int{3}, false},
+		{"exactly a batch", webhookBatch, "", http.StatusOK, []int{webhookBatch}, false},
+		{"split into batches", 2*webhookBatch + 1, "s3cret", http.StatusOK, []int{webhookBatch, webhookBatch, 1}, false},
+		// Stops at the first batch that isnt accepted
+		{"rejected", 2*webhookBatch + 1, "", http.StatusInternalServerError, []int{webhookBatch}, true},
+	}
+
+	for _, tt := range tests {
+		var (
+			mu      sync.Mutex
+			batches []int
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			var events []ChangeEvent
+			if err := json.Unmarshal(body, &events); err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			}
+
+			sig := r.Header.Get("X-Higgs-Signature")
+			if tt.secret == "" && sig != "" {
+				t.Errorf("%v: signed without a secret", tt.name)
+			}
+			if tt.secret != "" && sig != "sha256="+SignWebhook(tt.secret, body) {
+				t.Errorf("%v: bad signature %q", tt.name, sig)
+			}
+			if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("%v: content type %q", tt.name, ct)
+			}
+
+			mu.Lock()
+			batches = append(batches, len(events))
+			mu.Unlock()
+			w.WriteHeader(tt.status)
+		}))
+
+		events := make([]ChangeEvent, tt.events)
+		for i := range events {
+			events[i] = ChangeEvent{Kind: "types", ID: int64(i), Operation: ChangeAdded}
+		}
+
+		sink := &WebhookSink{URL: server.URL, Secret: tt.secret}
+		err := sink.Publish(context.Background(), events)
+		server.Close()
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(batches, tt.batches) {
+			t.Errorf("%v: got batches %v, want %v", tt.name, batches, tt.batches)
+		}
+	}
+}
+
+func TestRunFailedEvent(t *testing.T) {
+	id := primitive.NewObjectID()
+	event := runFailedEvent(id, errors.New("types stopped part way through"))
+	if event.RunID != id.Hex() || event.Kind != EventKindRun || event.Operation != EventRunFailed ||
+		event.Error != "types stopped part way through" || event.Time.IsZero() {
+		t.Errorf("got %+v", event)
+	}
+}
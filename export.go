@@ -0,0 +1,53 @@
+package higgs
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ExportStaticData dumps collections into dir as <collection>.jsonl, one extended json document per line.
+// An empty collection list exports everything.
+func ExportStaticData(config Configuration, dir string, collections []string) error {
+	store, err := GetDatabaseHandle(config)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to database")
+	}
+	defer store.Close()
+
+	if len(collections) == 0 {
+		collections = StaticCollections
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create export directory")
+	}
+
+	for _, collection := range collections {
+		err = exportCollection(store, collection, filepath.Join(dir, collection+".jsonl"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exportCollection(store *DB, collection, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %v", filename)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = store.ExportCollection(collection, w)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrapf(w.Flush(), "failed to write %v", filename)
+}
@@ -1,9 +1,8 @@
 package higgs
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
@@ -11,6 +10,15 @@ import (
 )
 
 // Eve ID Ranges - https://gist.github.com/a-tal/5ff5199fdbeb745b77cb633b7f4400bb
+const (
+	wormholeRegionMin   = 11000000
+	knownSpaceSystemMin = 30000000
+	wormholeSystemMin   = 31000000
+	abyssalSystemMin    = 32000000
+	abyssalSystemMax    = 32999999
+	pochvenRegionID     = 10000070
+	theraSystemID       = 31000005
+)
 
 
 func DeleteStaticData(config Configuration) error {
@@ -20,11 +28,27 @@ func DeleteStaticData(config Configuration) error {
 		err = errors.Wrap(err, "failed to create client")
 		return err
 	}
+	defer client.Close()
 
-	return client.Store.DeleteStaticData()
+	return client.withLock(context.Background(), config, RunDelete, func(ctx context.Context) error {
+		run := client.startRun(config, RunDelete, nil)
+		err := client.Store.DeleteStaticData()
+		run.finish(err)
+		return err
+	})
 }
 
 func PopulateStaticData(config Configuration) error {
+	return Populate(config, PopulateOptions{})
+}
+
+// Populate replaces the static data from ESI, leaving the industry data from the SDE alone. If only some
+// stages are selected only their collections are replaced.
+func Populate(config Configuration, opts PopulateOptions) error {
+
+	if _, err := selectStages(opts.Only); err != nil {
+		return err
+	}
 
 	client, err := newClient(config)
 
@@ -32,279 +56,333 @@ func PopulateStaticData(config Configuration) error {
 		err = errors.Wrap(err, "failed to create client")
 		return err
 	}
+	defer client.Close()
 
+	return client.populateWithRun(context.Background(), config, opts)
+}
 
-	err = client.Store.DeleteStaticData()
-	if err != nil{
-		return errors.Wrap(err, "Failed to delete existing static data")
-	}
+// PopulateInto is Populate writing to store, eg a MemoryStore, rather than the database in config
+func PopulateInto(config Configuration, store Store, opts PopulateOptions) error {
 
-	err = populateUniverse(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to populate the universe")
+	if _, err := selectStages(opts.Only); err != nil {
+		return err
 	}
 
-	err = populateTypes(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to populate types")
-	}
+	client, err := newClientWithStore(config, store)
 
-	err = populateGroups(client)
 	if err != nil {
-		return errors.Wrap(err, "Failed to populate groups")
-	}
-
-	err = populateCategories(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to populate categories")
+		err = errors.Wrap(err, "failed to create client")
+		return err
 	}
+	defer client.Close()
 
-	return nil
-
+	return client.populateWithRun(context.Background(), config, opts)
 }
 
-func populateUniverse(client *Client) error {
-
-	client.Log.Println("WARNING!!!!")
-	client.Log.Println("This command will take a very long time to run!!! I mean that!!!")
-	client.Log.Println("It is also not fault tolerant. If you see any errors you need to run it again!!!")
-
-	// Just in case it has bulk errors straight away
-	time.Sleep(30 * time.Second)
+// populateWithRun is Populate on a client that is already set up, giving up part way through if ctx is done
+func (c *Client) populateWithRun(ctx context.Context, config Configuration, opts PopulateOptions) error {
 
-	err := populateRegions(client)
+	selected, err := selectStages(opts.Only)
 	if err != nil {
-		return errors.Wrap(err, "Failed to import region information")
+		return err
 	}
 
-	err = populateConstellations(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to import constellation information")
+	names := make([]string, 0, len(selected))
+	var collections []string
+	for _, st := range selected {
+		names = append(names, st.name)
+		collections = append(collections, st.collections...)
 	}
 
-	err = populateSystems(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to import system information")
-	}
-
-	err = populateStars(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to import stars")
-	}
+	return c.withLock(ctx, config, RunPopulate, func(ctx context.Context) error {
+		run := c.startRun(config, RunPopulate, names)
+		run.snapshot(collections)
+		err := c.replace(ctx, collections, func(ctx context.Context, client *Client) error {
+			return populate(ctx, client, opts, selected)
+		})
+		run.finish(err)
+		return err
+	})
+}
 
-	err = populatePlanets(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to import planets")
-	}
+// stagingSuffix goes on the database name for the copy a staged client fills
+const stagingSuffix = "_staging"
 
-	err = populateMoons(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to import moons")
+// replace runs fill, which empties and refills collections. On a staged client fill gets a client writing to
+// an empty staging database, and the collections are moved into place only once it has worked.
+func (c *Client) replace(ctx context.Context, collections []string, fill func(ctx context.Context, client *Client) error) error {
+	if !c.staged {
+		return fill(ctx, c)
 	}
 
-	err = populateAsteroidBelts(client)
-	if err != nil {
-		return errors.Wrap(err, "Failed to import asteroid belts")
+	db, ok := c.db()
+	if !ok {
+		return errNotMongo
 	}
+	staging := &DB{Database: db.Database, DBName: db.DBName + stagingSuffix}
 
-	err = populateStargates(client)
+	// Start from nothing, a run that was stopped can leave some behind
+	err := staging.DropDatabase(ctx)
 	if err != nil {
-		return errors.Wrap(err, "Failed to import stargates")
+		return err
 	}
+	defer func() {
+		if err := staging.DropDatabase(context.Background()); err != nil {
+			c.Log.Warn("Failed to drop the staging database", "database", staging.DBName, "error", err)
+		}
+	}()
 
-	err = populateStations(client)
+	client := *c
+	client.Store = staging
+	err = fill(ctx, &client)
 	if err != nil {
-		return errors.Wrap(err, "Failed to import stations")
+		return err
 	}
 
-	return nil
+	return errors.Wrap(db.MoveCollections(ctx, staging, collections...), "Failed to swap in the refreshed data")
 }
 
-func populateRegions(client *Client) error {
-
-	var waitgroup sync.WaitGroup
+func populate(ctx context.Context, client *Client, opts PopulateOptions, selected []stage) error {
 
-	// First Step is to populate the region list. Will do a goroutine each, there isnt that many
-	const urlRegion = "https://esi.evetech.net/latest/universe/regions/?datasource=tranquility"
-	regionsBody, err := client.MakeESIGet(urlRegion)
-	var regions []int
-	err = json.Unmarshal(regionsBody, &regions)
+	// Only empty what the stages will fill again. ESI has no blueprints or reprocessing data, so those are
+	// left for import-sde and import-industry to replace
+	var collections []string
+	for _, st := range selected {
+		collections = append(collections, st.collections...)
+	}
+	err := client.Store.DeleteCollections(collections...)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "Failed to delete existing static data")
 	}
 
-	client.Log.Printf("Have to get %v regions", len(regions))
+	for _, st := range selected {
+		if st.universe {
+			warnUniverse(client)
+			break
+		}
+	}
 
-	const urlRegionSpecifc = "https://esi.evetech.net/latest/universe/regions/%v/?datasource=tranquility"
-	for _, rr := range regions {
-		r := rr
-		waitgroup.Add(1)
-		go func() {
-			regionURL := fmt.Sprintf(urlRegionSpecifc, r)
-			regionBody, err := client.MakeESIGet(regionURL)
-			if err != nil {
-				client.Log.Printf("Failed to query region %v", r)
-				waitgroup.Done()
-				return
-			}
+	ctx, span := tracer.Start(ctx, "populate")
+	err = runStages(ctx, client, selected)
+	endSpan(span, err)
 
-			region := ESIRegion{}
-			err = json.Unmarshal(regionBody, &region)
-			if err != nil {
-				client.Log.Printf("Failed to decode region %v from esi; %v", r, string(regionBody))
-				waitgroup.Done()
-				return
-			}
-			// client.Log.Printf("Adding Region - %v\n", region.Name)
-			err = client.Store.InsertRegion(region)
-			if err != nil {
-				log.Fatalln(errors.Wrap(err, "Failed to insert region"))
-			}
-			waitgroup.Done()
-		}()
+	return err
+}
 
-	}
+func warnUniverse(client *Client) {
 
-	// Only waiting because I want to be in order for my OCD :P
-	waitgroup.Wait()
+	client.Log.Warn("WARNING!!!!")
+	client.Log.Warn("This command will take a very long time to run!!! I mean that!!!")
+	client.Log.Warn("It is also not fault tolerant. If you see any errors you need to run it again!!!")
 
-	return nil
+	// Just in case it has bulk errors straight away
+	time.Sleep(client.StartDelay)
 }
 
-func populateConstellations(client *Client) error {
+// fetchAll splits ids into batches, one per goroutine, and fetches each of them from ESI in turn.
+// urlFormat has a single %v for the id. store is given the body for each id, anything that fails is
+// logged and counted but doesnt stop the rest. Once theyre all done the stage fails if anything did, things
+// ESI says arent there dont count.
+func fetchAll(ctx context.Context, client *Client, stageName, urlFormat string, ids []int, routines int, store func(ctx context.Context, id int, body []byte) error) error {
 
 	var waitgroup sync.WaitGroup
 
-	// Now grab all the constellations. Lets batch these out and do 50 goroutines... Dont want to go too fast...
-	const urlConstellation = "https://esi.evetech.net/latest/universe/constellations/?datasource=tranquility"
-	constellationsBody, err := client.MakeESIGet(urlConstellation)
-	var constellations []int
-	err = json.Unmarshal(constellationsBody, &constellations)
-	if err != nil {
-		return err
+	var (
+		mu       sync.Mutex
+		failed   int
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		failed++
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
 	}
 
-	client.Log.Printf("Have to get %v constellations", len(constellations))
-
-	const urlConstellationSpecifc = "https://esi.evetech.net/latest/universe/constellations/%v/?datasource=tranquility"
-
 	var batches [][]int
 
-	batchSize := (len(constellations) / client.MaxRoutines) + 1
+	total := 0
+	for _, id := range ids {
+		if id != 0 {
+			total++
+		}
+	}
+	progressAddTotal(stageName, total)
 
-	for batchSize < len(constellations) {
-		constellations, batches = constellations[batchSize:], append(batches, constellations[0:batchSize:batchSize])
+	if routines < 1 {
+		routines = 1
 	}
+	batchSize := (len(ids) / routines) + 1
 
-	batches = append(batches, constellations)
+	for batchSize < len(ids) {
+		ids, batches = ids[batchSize:], append(batches, ids[0:batchSize:batchSize])
+	}
+
+	batches = append(batches, ids)
 
 	for _, b := range batches {
 		batch := b
 		waitgroup.Add(1)
 		go func() {
+			defer waitgroup.Done()
 			for _, r := range batch {
-				constellationURL := fmt.Sprintf(urlConstellationSpecifc, r)
-				constellationBody, err := client.MakeESIGet(constellationURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download constellation %v - got; %v\n", r, string(constellationBody))
-
+				if ctx.Err() != nil {
 					return
 				}
+				if r == 0 {
+					// There are 250 of these.......
+					continue
+				}
 
-				constellation := ESIConstellation{}
-				err = json.Unmarshal(constellationBody, &constellation)
+				url := fmt.Sprintf(urlFormat, r)
+				body, err := client.MakeESIGetContext(ctx, url)
+				var notFound *NotFound
+				if errors.As(err, &notFound) {
+					// Listed but deleted since, or never there. Theres nothing to store so it isnt a failure
+					stageItemsMissing(stageName)
+					progressDone(stageName)
+					client.Log.Warn("Not found on ESI, skipping", "stage", stageName, "entity_id", r, "url", url, "error", err)
+					continue
+				}
 				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode constellation %v - got; %v\n", r, string(constellationBody))
-					return
+					stageItemsFailed(stageName)
+					progressFailed(stageName)
+					client.Log.Error("Failed to download", "stage", stageName, "entity_id", r, "url", url, "error", err)
+					fail(err)
+					continue
 				}
+				stageItemsFetched(stageName)
 
-				// client.Log.Printf("Adding Constellation - %v\n", constellation.Name)
-				err = client.Store.InsertConstellation(constellation)
+				err = store(ctx, r, body)
 				if err != nil {
-					log.Fatalln(errors.Wrap(err, "Failed to insert constellation"))
+					stageItemsFailed(stageName)
+					progressFailed(stageName)
+					client.Log.Error("Failed to store", "stage", stageName, "entity_id", r, "error", err)
+					fail(errors.Wrapf(err, "failed to store %v %v", stageName, r))
+					continue
 				}
+				stageItemsInserted(stageName)
+				progressDone(stageName)
+				client.Log.Debug("Stored", "stage", stageName, "entity_id", r)
 			}
-			waitgroup.Done()
 		}()
 	}
 
 	waitgroup.Wait()
 
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "%v stopped part way through", stageName)
+	}
+	if failed > 0 {
+		return errors.Wrapf(firstErr, "%v of %v %v failed, the first", failed, total, stageName)
+	}
 	return nil
 }
 
-func populateSystems(client *Client) error {
+// getIDList fetches one of ESI's plain lists of ids
+func getIDList(ctx context.Context, client *Client, url string) ([]int, error) {
+	body, err := client.MakeESIGetContext(ctx, url)
+	if err != nil {
+		return nil, err
+	}
 
-	var waitgroup sync.WaitGroup
+	var ids []int
+	err = decodeESI(url, body, &ids)
+	if err != nil {
+		return nil, err
+	}
 
-	// Now grab all the systems. Lets definetly batch these out and do 50 goroutines... Dont want to go too fast...
-	const urlSystems = "https://esi.evetech.net/latest/universe/systems/?datasource=tranquility"
-	systemsBody, err := client.MakeESIGet(urlSystems)
-	var systems []int
-	err = json.Unmarshal(systemsBody, &systems)
+	return ids, nil
+}
+
+func populateRegions(ctx context.Context, client *Client) error {
+
+	// First Step is to populate the region list. Will do a goroutine each, there isnt that many
+	const urlRegion = "/latest/universe/regions/?datasource=tranquility"
+	regions, err := getIDList(ctx, client, client.esiURL(urlRegion))
 	if err != nil {
 		return err
 	}
 
-	client.Log.Printf("Have to get %v systems", len(systems))
+	client.Log.Info("Have to get regions", "stage", "regions", "total", len(regions))
 
-	const urlSystemSpecifc = "https://esi.evetech.net/latest/universe/systems/%v/?datasource=tranquility"
+	const urlRegionSpecifc = "/latest/universe/regions/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "regions", client.esiURL(urlRegionSpecifc), regions, len(regions), func(ctx context.Context, r int, regionBody []byte) error {
+		region := ESIRegion{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlRegionSpecifc), r), regionBody, &region)
+		if err != nil {
+			return err
+		}
 
-	batches := [][]int{}
+		region.Names, region.Descriptions, err = client.fetchLocalized(ctx, fmt.Sprintf(client.esiURL(urlRegionSpecifc), r), region.Name, region.Description)
+		if insertErr := client.Store.InsertRegion(ctx, region); insertErr != nil {
+			return insertErr
+		}
 
-	batchSize := (len(systems) / client.MaxRoutines) + 1
+		// Keep whichever translations we did get, but a missing one still fails the item
+		return err
+	})
+}
 
-	for batchSize < len(systems) {
-		systems, batches = systems[batchSize:], append(batches, systems[0:batchSize:batchSize])
-	}
+func populateConstellations(ctx context.Context, client *Client) error {
 
-	batches = append(batches, systems)
+	// Now grab all the constellations. Lets batch these out and do 50 goroutines... Dont want to go too fast...
+	const urlConstellation = "/latest/universe/constellations/?datasource=tranquility"
+	constellations, err := getIDList(ctx, client, client.esiURL(urlConstellation))
+	if err != nil {
+		return err
+	}
 
-	for _, b := range batches {
-		batch := b
-		waitgroup.Add(1)
-		go func() {
-			for _, r := range batch {
-				systemURL := fmt.Sprintf(urlSystemSpecifc, r)
-				systemBody, err := client.MakeESIGet(systemURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download System %v - got; %v; %v\n", r, string(systemBody), err)
+	client.Log.Info("Have to get constellations", "stage", "constellations", "total", len(constellations))
 
-					return
-				}
+	const urlConstellationSpecifc = "/latest/universe/constellations/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "constellations", client.esiURL(urlConstellationSpecifc), constellations, client.MaxRoutines, func(ctx context.Context, r int, constellationBody []byte) error {
+		constellation := ESIConstellation{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlConstellationSpecifc), r), constellationBody, &constellation)
+		if err != nil {
+			return err
+		}
 
-				system := ESISystem{}
-				err = json.Unmarshal(systemBody, &system)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode System %v - got; %v; %v\n", r, string(systemBody), err)
-					client.Log.Println(err)
-					return
-				}
+		constellation.Names, _, err = client.fetchLocalized(ctx, fmt.Sprintf(client.esiURL(urlConstellationSpecifc), r), constellation.Name, "")
+		if insertErr := client.Store.InsertConstellation(ctx, constellation); insertErr != nil {
+			return insertErr
+		}
 
-				// client.Log.Printf("Adding System - %v\n", system.Name)
-				err = client.Store.InsertSystem(system)
+		return err
+	})
+}
 
-				if err != nil {
-					client.Log.Printf("dup - %v\n", system.SystemID)
-				}
+func populateSystems(ctx context.Context, client *Client) error {
 
-			}
-			waitgroup.Done()
-		}()
+	// Now grab all the systems. Lets definetly batch these out and do 50 goroutines... Dont want to go too fast...
+	const urlSystems = "/latest/universe/systems/?datasource=tranquility"
+	systems, err := getIDList(ctx, client, client.esiURL(urlSystems))
+	if err != nil {
+		return err
 	}
 
-	waitgroup.Wait()
+	client.Log.Info("Have to get systems", "stage", "systems", "total", len(systems))
 
-	return nil
-}
+	const urlSystemSpecifc = "/latest/universe/systems/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "systems", client.esiURL(urlSystemSpecifc), systems, client.MaxRoutines, func(ctx context.Context, r int, systemBody []byte) error {
+		system := ESISystem{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlSystemSpecifc), r), systemBody, &system)
+		if err != nil {
+			return err
+		}
 
-func populateStars(client *Client) error {
+		system.Names, _, err = client.fetchLocalized(ctx, fmt.Sprintf(client.esiURL(urlSystemSpecifc), r), system.Name, "")
+		if insertErr := client.Store.InsertSystem(ctx, system); insertErr != nil {
+			return insertErr
+		}
 
-	var waitgroup sync.WaitGroup
+		return err
+	})
+}
+
+func populateStars(ctx context.Context, client *Client) error {
 
 	// All of the following will use parts from the systems objects so lets get all the systems here
 	systemlist, err := client.Store.GetSystems()
@@ -321,71 +399,23 @@ func populateStars(client *Client) error {
 	// Prevent duplicates
 	starIDs := uniqueIDs(starIDComplete)
 
-	client.Log.Printf("Have to get %v stars", len(starIDs))
-
-	const urlStar = "https://esi.evetech.net/v1/universe/stars/%v/?datasource=tranquility"
-
-	batches := [][]int{}
-
-	batchSize := (len(starIDs) / client.MaxRoutines) + 1
-
-	for batchSize < len(starIDs) {
-		starIDs, batches = starIDs[batchSize:], append(batches, starIDs[0:batchSize:batchSize])
-	}
+	client.Log.Info("Have to get stars", "stage", "stars", "total", len(starIDs))
 
-	batches = append(batches, starIDs)
-
-	for _, b := range batches {
-		batch := b
-		waitgroup.
-			Add(1)
-		go func() {
-			for _, r := range batch {
-				if r == 0 {
-					// There are 250 of these.......
-					continue
-				}
-				starURL := fmt.Sprintf(urlStar, r)
-				starBody, err := client.MakeESIGet(starURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download star %v - got; %v; %v\n", r, string(starBody), err)
-
-					return
-				}
-
-				star := ESIStar{}
-				err = json.Unmarshal(starBody, &star)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode star %v - got; %v; %v\n", r, string(starBody), err)
-					client.Log.Println(err)
-					return
-				}
-
-				star.StarID = r
-
-				// client.Log.Printf("Adding star - %v\n", star.Name)
-				err = client.Store.InsertStar(star)
-
-				if err != nil {
-					client.Log.Printf("dup - %v\n", star.StarID)
-				}
-
-			}
-			waitgroup.Done()
-		}()
-	}
+	const urlStar = "/v1/universe/stars/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "stars", client.esiURL(urlStar), starIDs, client.MaxRoutines, func(ctx context.Context, r int, starBody []byte) error {
+		star := ESIStar{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlStar), r), starBody, &star)
+		if err != nil {
+			return err
+		}
 
-	waitgroup.Wait()
+		star.StarID = r
 
-	return nil
+		return client.Store.InsertStar(ctx, star)
+	})
 }
 
-func populatePlanets(client *Client) error {
-
-	// Declare this early as we are going to use it a lot....
-	var waitgroup sync.WaitGroup
+func populatePlanets(ctx context.Context, client *Client) error {
 
 	// All of the following will use parts from the systems objects so lets get all the systems here
 	systemlist, err := client.Store.GetSystems()
@@ -396,597 +426,221 @@ func populatePlanets(client *Client) error {
 	// So the suns are done.. Now get ids for all planets, moons and asteroid belts...
 	var planetList []int
 	for _, sys := range systemlist {
-		if sys.Planets != nil {
-			for _, planet := range sys.Planets {
-				planetList = append(planetList, planet.PlanetID)
-			}
+		for _, planet := range sys.Planets {
+			planetList = append(planetList, planet.PlanetID)
 		}
 	}
 	// Now lets scrape the planets!!
 
-	client.Log.Printf("Have to get %v planets", len(planetList))
-
-	const urlPlanets = "https://esi.evetech.net/v1/universe/planets/%v/?datasource=tranquility"
-
-	batches := [][]int{}
-
-	batchSize := (len(planetList) / client.MaxRoutines) + 1
+	client.Log.Info("Have to get planets", "stage", "planets", "total", len(planetList))
 
-	for batchSize < len(planetList) {
-		planetList, batches = planetList[batchSize:], append(batches, planetList[0:batchSize:batchSize])
-	}
-
-	batches = append(batches, planetList)
-
-	for _, b := range batches {
-		batch := b
-		waitgroup.
-			Add(1)
-		go func() {
-			for _, r := range batch {
-				if r == 0 {
-					// There are 250 of these.......
-					continue
-				}
-				planetURL := fmt.Sprintf(urlPlanets, r)
-				planetBody, err := client.MakeESIGet(planetURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download planet %v - got; %v; %v\n", r, string(planetBody), err)
-
-					return
-				}
-
-				planetData := ESIPlanet{}
-				err = json.Unmarshal(planetBody, &planetData)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode planet %v - got; %v; %v\n", r, string(planetBody), err)
-					client.Log.Println(err)
-					return
-				}
-
-				// client.Log.Printf("Adding planet - %v\n", planetData.Name)
-				err = client.Store.InsertPlanet(planetData)
-
-				if err != nil {
-					client.Log.Printf("dup - %v; %v\n", planetData.PlanetID, err)
-				}
-
-			}
-			waitgroup.Done()
-		}()
-	}
-
-	waitgroup.Wait()
+	const urlPlanets = "/v1/universe/planets/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "planets", client.esiURL(urlPlanets), planetList, client.MaxRoutines, func(ctx context.Context, r int, planetBody []byte) error {
+		planetData := ESIPlanet{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlPlanets), r), planetBody, &planetData)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return client.Store.InsertPlanet(ctx, planetData)
+	})
 }
 
-func populateMoons(client *Client) error {
+func populateMoons(ctx context.Context, client *Client) error {
 
 	systemlist, err := client.Store.GetSystems()
 	if err != nil {
 		return err
 	}
 
-	// Declare this early as we are going to use it a lot....
-	var waitgroup sync.WaitGroup
-
 	var moonList []int
 	for _, sys := range systemlist {
-		if sys.Planets != nil {
-			for _, planet := range sys.Planets {
-				if planet.Moons != nil {
-					for _, moon := range planet.Moons {
-						moonList = append(moonList, moon)
-					}
-				}
-			}
+		for _, planet := range sys.Planets {
+			moonList = append(moonList, planet.Moons...)
 		}
 	}
 
-	client.Log.Printf("Have to get %v moons", len(moonList))
+	client.Log.Info("Have to get moons", "stage", "moons", "total", len(moonList))
 
 	// THATS NO MOON!!!
 
-	const urlMoon = "https://esi.evetech.net/v1/universe/moons/%v/?datasource=tranquility"
-
-	batches := [][]int{}
-
-	batchSize := (len(moonList) / client.MaxRoutines) + 1
-
-	for batchSize < len(moonList) {
-		moonList, batches = moonList[batchSize:], append(batches, moonList[0:batchSize:batchSize])
-	}
-
-	batches = append(batches, moonList)
-
-	for _, b := range batches {
-		batch := b
-		waitgroup.
-			Add(1)
-		go func() {
-			for _, r := range batch {
-				if r == 0 {
-					// There are 250 of these.......
-					continue
-				}
-				moonURL := fmt.Sprintf(urlMoon, r)
-				moonBody, err := client.MakeESIGet(moonURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download moon %v - got; %v; %v\n", r, string(moonBody), err)
-
-					return
-				}
-
-				moon := ESIMoon{}
-				err = json.Unmarshal(moonBody, &moon)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode planet %v - got; %v; %v\n", r, string(moonBody), err)
-					client.Log.Println(err)
-					return
-				}
-
-				// client.Log.Printf("Adding moon - %v\n", moon.Name)
-				err = client.Store.InsertMoon(moon)
-
-				if err != nil {
-					client.Log.Printf("dup - %v; %v\n", moon.MoonID, err)
-				}
-
-			}
-			waitgroup.Done()
-		}()
-	}
-
-	waitgroup.Wait()
+	const urlMoon = "/v1/universe/moons/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "moons", client.esiURL(urlMoon), moonList, client.MaxRoutines, func(ctx context.Context, r int, moonBody []byte) error {
+		moon := ESIMoon{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlMoon), r), moonBody, &moon)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return client.Store.InsertMoon(ctx, moon)
+	})
 }
 
-func populateAsteroidBelts(client *Client) error {
+func populateAsteroidBelts(ctx context.Context, client *Client) error {
 	systemlist, err := client.Store.GetSystems()
 	if err != nil {
 		return err
 	}
 
-	// Declare this early as we are going to use it a lot....
-	var waitgroup sync.WaitGroup
-
 	var beltList []int
 	for _, sys := range systemlist {
-		if sys.Planets != nil {
-			for _, planet := range sys.Planets {
-				if planet.AsteroidBelts != nil {
-					for _, belt := range planet.AsteroidBelts {
-						beltList = append(beltList, belt)
-					}
-				}
-			}
+		for _, planet := range sys.Planets {
+			beltList = append(beltList, planet.AsteroidBelts...)
 		}
 	}
 
-	client.Log.Printf("Have to get %v asteroid belts", len(beltList))
-
-	const urlBelt = "https://esi.evetech.net/v1/universe/asteroid_belts/%v/?datasource=tranquility"
-
-	batches := [][]int{}
-
-	batchSize := (len(beltList) / client.MaxRoutines) + 1
-
-	for batchSize < len(beltList) {
-		beltList, batches = beltList[batchSize:], append(batches, beltList[0:batchSize:batchSize])
-	}
-
-	batches = append(batches, beltList)
+	client.Log.Info("Have to get asteroid belts", "stage", "belts", "total", len(beltList))
 
-	for _, b := range batches {
-		batch := b
-		waitgroup.
-			Add(1)
-		go func() {
-			for _, r := range batch {
-				if r == 0 {
-					// There are 250 of these.......
-					continue
-				}
-				beltURL := fmt.Sprintf(urlBelt, r)
-				beltBody, err := client.MakeESIGet(beltURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download belt %v - got; %v; %v\n", r, string(beltBody), err)
-
-					return
-				}
-
-				belt := ESIAsteroidBelt{}
-				err = json.Unmarshal(beltBody, &belt)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode belt %v - got; %v; %v\n", r, string(beltBody), err)
-					client.Log.Println(err)
-					return
-				}
-
-				belt.BeltID = int32(r)
-				// client.Log.Printf("Adding moon - %v\n", moon.Name)
-				err = client.Store.InsertAsteroidBelt(belt)
-
-				if err != nil {
-					client.Log.Printf("dup - %v; %v\n", belt.BeltID, err)
-				}
-
-			}
-			waitgroup.Done()
-		}()
-	}
-
-	waitgroup.Wait()
+	const urlBelt = "/v1/universe/asteroid_belts/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "belts", client.esiURL(urlBelt), beltList, client.MaxRoutines, func(ctx context.Context, r int, beltBody []byte) error {
+		belt := ESIAsteroidBelt{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlBelt), r), beltBody, &belt)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		belt.BeltID = int32(r)
+		return client.Store.InsertAsteroidBelt(ctx, belt)
+	})
 }
 
-func populateStargates(client *Client) error {
+func populateStargates(ctx context.Context, client *Client) error {
 	systemlist, err := client.Store.GetSystems()
 	if err != nil {
 		return err
 	}
 
-	// Declare this early as we are going to use it a lot....
-	var waitgroup sync.WaitGroup
-
 	var gateList []int
 	for _, sys := range systemlist {
-		if sys.Stargates != nil {
-			for _, gate := range sys.Stargates {
-				gateList = append(gateList, gate)
-			}
-		}
+		gateList = append(gateList, sys.Stargates...)
 	}
 
-	client.Log.Printf("Have to get %v stargates", len(gateList))
-
-	const urlGate = "https://esi.evetech.net/v1/universe/stargates/%v/?datasource=tranquility"
+	client.Log.Info("Have to get stargates", "stage", "stargates", "total", len(gateList))
 
-	batches := [][]int{}
-
-	batchSize := (len(gateList) / client.MaxRoutines) + 1
-
-	for batchSize < len(gateList) {
-		gateList, batches = gateList[batchSize:], append(batches, gateList[0:batchSize:batchSize])
-	}
-
-	batches = append(batches, gateList)
-
-	for _, b := range batches {
-		batch := b
-		waitgroup.
-			Add(1)
-		go func() {
-			for _, r := range batch {
-				if r == 0 {
-					continue
-				}
-				gateURL := fmt.Sprintf(urlGate, r)
-				gateBody, err := client.MakeESIGet(gateURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download gate %v - got; %v; %v\n", r, string(gateBody), err)
-
-					return
-				}
-
-				gate := ESIStargate{}
-				err = json.Unmarshal(gateBody, &gate)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode gate %v - got; %v; %v\n", r, string(gateBody), err)
-					client.Log.Println(err)
-					return
-				}
-
-				// client.Log.Printf("Adding moon - %v\n", moon.Name)
-				err = client.Store.InsertStargate(gate)
-
-				if err != nil {
-					client.Log.Printf("dup - %v; %v\n", gate.StargateID, err)
-				}
-
-			}
-			waitgroup.Done()
-		}()
-	}
-
-	waitgroup.Wait()
+	const urlGate = "/v1/universe/stargates/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "stargates", client.esiURL(urlGate), gateList, client.MaxRoutines, func(ctx context.Context, r int, gateBody []byte) error {
+		gate := ESIStargate{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlGate), r), gateBody, &gate)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return client.Store.InsertStargate(ctx, gate)
+	})
 }
 
-func populateStations(client *Client) error {
+func populateStations(ctx context.Context, client *Client) error {
 	systemlist, err := client.Store.GetSystems()
 	if err != nil {
 		return err
 	}
 
-	// Declare this early as we are going to use it a lot....
-	var waitgroup sync.WaitGroup
-
 	var stationList []int
 	for _, sys := range systemlist {
-		if sys.Stations != nil {
-			for _, station := range sys.Stations {
-				stationList = append(stationList, station)
-			}
-		}
+		stationList = append(stationList, sys.Stations...)
 	}
 
-	client.Log.Printf("Have to get %v stations", len(stationList))
-
-	const urlStations = "https://esi.evetech.net/v2/universe/stations/%v/?datasource=tranquility"
-
-	batches := [][]int{}
-
-	batchSize := (len(stationList) / client.MaxRoutines) + 1
-
-	for batchSize < len(stationList) {
-		stationList, batches = stationList[batchSize:], append(batches, stationList[0:batchSize:batchSize])
-	}
-
-	batches = append(batches, stationList)
-
-	for _, b := range batches {
-		batch := b
-		waitgroup.
-			Add(1)
-		go func() {
-			for _, r := range batch {
-				if r == 0 {
-					continue
-				}
-				stationURL := fmt.Sprintf(urlStations, r)
-				stationBody, err := client.MakeESIGet(stationURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download station %v - got; %v; %v\n", r, string(stationBody), err)
-
-					return
-				}
+	client.Log.Info("Have to get stations", "stage", "stations", "total", len(stationList))
 
-				station := ESIStation{}
-				err = json.Unmarshal(stationBody, &station)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode station %v - got; %v; %v\n", r, string(stationBody), err)
-					client.Log.Println(err)
-					return
-				}
-
-				err = client.Store.InsertStation(station)
-
-				if err != nil {
-					client.Log.Printf("dup - %v; %v\n", station.StationID, err)
-				}
-
-			}
-			waitgroup.Done()
-		}()
-	}
-
-	waitgroup.Wait()
-
-	return nil
-}
-
-func populateTypes(client *Client) error {
-	var waitgroup sync.WaitGroup
-
-	// Now grab all the types
-	const urlTypes = "https://esi.evetech.net/v1/universe/types/?datasource=tranquility&page=%v"
-	var types []int
-
-	page := 1
-	for {
-		url := fmt.Sprintf(urlTypes, page)
-		typesBody, err := client.MakeESIGet(url)
-		if string(typesBody) == "[]" {
-			break
-		}
-		var t []int
-		err = json.Unmarshal(typesBody, &t)
+	const urlStations = "/v2/universe/stations/%v/?datasource=tranquility"
+	return fetchAll(ctx, client, "stations", client.esiURL(urlStations), stationList, client.MaxRoutines, func(ctx context.Context, r int, stationBody []byte) error {
+		station := ESIStation{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlStations), r), stationBody, &station)
 		if err != nil {
 			return err
 		}
 
-		// client.Log.Printf("Getting types page %v\n", page)
-		types = append(types, t...)
-
-		page++
-	}
-
-	client.Log.Printf("Have to get %v types from ESI", len(types))
-
-	const urlTypeSpecifc = "https://esi.evetech.net/v3/universe/types/%v/?datasource=tranquility"
-
-	var batches [][]int
-
-	// Because there are so many typeids to fetch, going to double the number of goroutines
-	batchSize := (len(types) / (client.MaxRoutines * 2)) + 1
-
-	for batchSize < len(types) {
-		types, batches = types[batchSize:], append(batches, types[0:batchSize:batchSize])
-	}
-
-	batches = append(batches, types)
-
-	for _, b := range batches {
-		batch := b
-		waitgroup.Add(1)
-		go func() {
-			for _, r := range batch {
-				typeURL := fmt.Sprintf(urlTypeSpecifc, r)
-				typeBody, err := client.MakeESIGet(typeURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download type %v - got; %v\n", r, string(typeBody))
-
-					return
-				}
+		return client.Store.InsertStation(ctx, station)
+	})
+}
 
-				typeESI := ESIType{}
-				err = json.Unmarshal(typeBody, &typeESI)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode type %v - got; %v\n", r, string(typeBody))
-					return
-				}
+func populateTypes(ctx context.Context, client *Client) error {
 
-				// client.Log.Printf("Adding type - %v - %v\n", typeESI.TypeID, typeESI.Name)
-				client.Store.InsertType(typeESI)
-			}
-			waitgroup.Done()
-		}()
+	// Now grab all the types
+	const urlTypes = "/v1/universe/types/?datasource=tranquility&page=%v"
+	types, err := getIDPages(ctx, client, client.esiURL(urlTypes))
+	if err != nil {
+		return err
 	}
 
-	waitgroup.Wait()
-
-	return nil
-}
+	client.Log.Info("Have to get types from ESI", "stage", "types", "total", len(types))
 
-func populateGroups(client *Client) error {
-	var waitgroup sync.WaitGroup
+	const urlTypeSpecifc = "/v3/universe/types/%v/?datasource=tranquility"
 
-	// Now grab all the types
-	const urlGroups = "https://esi.evetech.net/v1/universe/groups/?datasource=tranquility&page=%v"
-	var groups []int
-
-	page := 1
-	for {
-		url := fmt.Sprintf(urlGroups, page)
-		groupBody, err := client.MakeESIGet(url)
-		if string(groupBody) == "[]" {
-			break
-		}
-		var t []int
-		err = json.Unmarshal(groupBody, &t)
+	// Because there are so many typeids to fetch, going to double the number of goroutines
+	return fetchAll(ctx, client, "types", client.esiURL(urlTypeSpecifc), types, client.MaxRoutines*2, func(ctx context.Context, r int, typeBody []byte) error {
+		typeESI := ESIType{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlTypeSpecifc), r), typeBody, &typeESI)
 		if err != nil {
 			return err
 		}
 
-		// client.Log.Printf("Getting groups page %v\n", page)
-		groups = append(groups, t...)
-
-		page++
-	}
-
-	client.Log.Printf("Have to get %v groups from ESI", len(groups))
-
-	const urlGroupSpecifc = "https://esi.evetech.net/v1/universe/groups/%v/?datasource=tranquility"
+		typeESI.Names, typeESI.Descriptions, err = client.fetchLocalized(ctx, fmt.Sprintf(client.esiURL(urlTypeSpecifc), r), typeESI.Name, typeESI.Description)
+		if insertErr := client.Store.InsertType(ctx, typeESI); insertErr != nil {
+			return insertErr
+		}
 
-	var batches [][]int
+		return err
+	})
+}
 
-	// Because there are so many typeids to fetch, going to double the number of goroutines
-	batchSize := (len(groups) / (client.MaxRoutines * 2)) + 1
+func populateGroups(ctx context.Context, client *Client) error {
 
-	for batchSize < len(groups) {
-		groups, batches = groups[batchSize:], append(batches, groups[0:batchSize:batchSize])
+	// Now grab all the types
+	const urlGroups = "/v1/universe/groups/?datasource=tranquility&page=%v"
+	groups, err := getIDPages(ctx, client, client.esiURL(urlGroups))
+	if err != nil {
+		return err
 	}
 
-	batches = append(batches, groups)
-
-	for _, b := range batches {
-		batch := b
-		waitgroup.Add(1)
-		go func() {
-			for _, r := range batch {
-				groupURL := fmt.Sprintf(urlGroupSpecifc, r)
-				groupBody, err := client.MakeESIGet(groupURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download group %v - got; %v\n", r, string(groupBody))
-
-					return
-				}
+	client.Log.Info("Have to get groups from ESI", "stage", "groups", "total", len(groups))
 
-				group := ESIGroup{}
-				err = json.Unmarshal(groupBody, &group)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode group %v - got; %v\n", r, string(groupBody))
-					return
-				}
+	const urlGroupSpecifc = "/v1/universe/groups/%v/?datasource=tranquility"
 
-				// client.Log.Printf("Adding group - %v - %v\n", group.GroupID, group.Name)
-				client.Store.InsertGroup(group)
-			}
-			waitgroup.Done()
-		}()
-	}
+	// Because there are so many typeids to fetch, going to double the number of goroutines
+	return fetchAll(ctx, client, "groups", client.esiURL(urlGroupSpecifc), groups, client.MaxRoutines*2, func(ctx context.Context, r int, groupBody []byte) error {
+		group := ESIGroup{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlGroupSpecifc), r), groupBody, &group)
+		if err != nil {
+			return err
+		}
 
-	waitgroup.Wait()
+		group.Names, _, err = client.fetchLocalized(ctx, fmt.Sprintf(client.esiURL(urlGroupSpecifc), r), group.Name, "")
+		if insertErr := client.Store.InsertGroup(ctx, group); insertErr != nil {
+			return insertErr
+		}
 
-	return nil
+		return err
+	})
 }
 
-func populateCategories(client *Client) error {
-	var waitgroup sync.WaitGroup
+func populateCategories(ctx context.Context, client *Client) error {
 
-	const urlCategories = "https://esi.evetech.net/v1/universe/categories/?datasource=tranquility"
-	categoriesBody, err := client.MakeESIGet(urlCategories)
-	var categories []int
-	err = json.Unmarshal(categoriesBody, &categories)
+	const urlCategories = "/v1/universe/categories/?datasource=tranquility"
+	categories, err := getIDList(ctx, client, client.esiURL(urlCategories))
 	if err != nil {
 		return err
 	}
 
-	client.Log.Printf("Have to get %v categories from ESI", len(categories))
-
-	const urlGroupSpecifc = "https://esi.evetech.net/v1/universe/categories/%v/?datasource=tranquility"
+	client.Log.Info("Have to get categories from ESI", "stage", "categories", "total", len(categories))
 
-	var batches [][]int
+	const urlCategorySpecifc = "/v1/universe/categories/%v/?datasource=tranquility"
 
 	// Because there are so many typeids to fetch, going to double the number of goroutines
-	batchSize := (len(categories) / (client.MaxRoutines * 2)) + 1
-
-	for batchSize < len(categories) {
-		categories, batches = categories[batchSize:], append(batches, categories[0:batchSize:batchSize])
-	}
-
-	batches = append(batches, categories)
-
-	for _, b := range batches {
-		batch := b
-		waitgroup.Add(1)
-		go func() {
-			for _, r := range batch {
-				categoryURL := fmt.Sprintf(urlGroupSpecifc, r)
-				categoryBody, err := client.MakeESIGet(categoryURL)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to download category %v - got; %v\n", r, string(categoryBody))
-
-					return
-				}
-
-				category := ESICategory{}
-				err = json.Unmarshal(categoryBody, &category)
-				if err != nil {
-					waitgroup.Done()
-					client.Log.Printf("Failed to decode category %v - got; %v\n", r, string(categoryBody))
-					return
-				}
+	return fetchAll(ctx, client, "categories", client.esiURL(urlCategorySpecifc), categories, client.MaxRoutines*2, func(ctx context.Context, r int, categoryBody []byte) error {
+		category := ESICategory{}
+		err := decodeESI(fmt.Sprintf(client.esiURL(urlCategorySpecifc), r), categoryBody, &category)
+		if err != nil {
+			return err
+		}
 
-				// client.Log.Printf("Adding category - %v - %v\n", category.CategoryID, category.Name)
-				client.Store.InsertCategory(category)
-			}
-			waitgroup.Done()
-		}()
-	}
+		category.Names, _, err = client.fetchLocalized(ctx, fmt.Sprintf(client.esiURL(urlCategorySpecifc), r), category.Name, "")
+		if insertErr := client.Store.InsertCategory(ctx, category); insertErr != nil {
+			return insertErr
+		}
 
-	waitgroup.Wait()
-	return nil
+		return err
+	})
 }
 
 func uniqueIDs(intSlice []int) []int {
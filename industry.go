@@ -0,0 +1,176 @@
+package higgs
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Blueprint activities as they are named in the SDE
+const (
+	ActivityCopying          = "copying"
+	ActivityInvention        = "invention"
+	ActivityManufacturing    = "manufacturing"
+	ActivityReaction         = "reaction"
+	ActivityResearchMaterial = "research_material"
+	ActivityResearchTime     = "research_time"
+)
+
+type (
+	Blueprint struct {
+		BlueprintTypeID    int32               `json:"blueprint_type_id" bson:"_id" yaml:"blueprintTypeID"`
+		MaxProductionLimit int32               `json:"max_production_limit" bson:"max_production_limit" yaml:"maxProductionLimit"`
+		Activities         BlueprintActivities `json:"activities" bson:"activities" yaml:"activities"`
+	}
+
+	BlueprintActivities struct {
+		Copying          *BlueprintActivity `json:"copying,omitempty" bson:"copying,omitempty" yaml:"copying"`
+		Invention        *BlueprintActivity `json:"invention,omitempty" bson:"invention,omitempty" yaml:"invention"`
+		Manufacturing    *BlueprintActivity `json:"manufacturing,omitempty" bson:"manufacturing,omitempty" yaml:"manufacturing"`
+		Reaction         *BlueprintActivity `json:"reaction,omitempty" bson:"reaction,omitempty" yaml:"reaction"`
+		ResearchMaterial *BlueprintActivity `json:"research_material,omitempty" bson:"research_material,omitempty" yaml:"research_material"`
+		ResearchTime     *BlueprintActivity `json:"research_time,omitempty" bson:"research_time,omitempty" yaml:"research_time"`
+	}
+
+	BlueprintActivity struct {
+		// Time is in seconds
+		Time      int32               `json:"time" bson:"time" yaml:"time"`
+		Materials []BlueprintMaterial `json:"materials,omitempty" bson:"materials,omitempty" yaml:"materials"`
+		Products  []BlueprintProduct  `json:"products,omitempty" bson:"products,omitempty" yaml:"products"`
+		Skills    []BlueprintSkill    `json:"skills,omitempty" bson:"skills,omitempty" yaml:"skills"`
+	}
+
+	BlueprintMaterial struct {
+		TypeID   int32 `json:"type_id" bson:"type_id" yaml:"typeID"`
+		Quantity int32 `json:"quantity" bson:"quantity" yaml:"quantity"`
+	}
+
+	BlueprintProduct struct {
+		TypeID      int32   `json:"type_id" bson:"type_id" yaml:"typeID"`
+		Quantity    int32   `json:"quantity" bson:"quantity" yaml:"quantity"`
+		Probability float64 `json:"probability,omitempty" bson:"probability,omitempty" yaml:"probability"`
+	}
+
+	BlueprintSkill struct {
+		TypeID int32 `json:"type_id" bson:"type_id" yaml:"typeID"`
+		Level  int32 `json:"level" bson:"level" yaml:"level"`
+	}
+
+	// TypeMaterials is what a type reprocesses into
+	TypeMaterials struct {
+		TypeID    int32          `json:"type_id" bson:"_id"`
+		Materials []TypeMaterial `json:"materials" bson:"materials" yaml:"materials"`
+	}
+
+	TypeMaterial struct {
+		MaterialTypeID int32 `json:"material_type_id" bson:"material_type_id" yaml:"materialTypeID"`
+		Quantity       int32 `json:"quantity" bson:"quantity" yaml:"quantity"`
+	}
+)
+
+// Activity returns the named activity, or nil if the blueprint cant be used for it
+func (b Blueprint) Activity(name string) *BlueprintActivity {
+	switch name {
+	case ActivityCopying:
+		return b.Activities.Copying
+	case ActivityInvention:
+		return b.Activities.Invention
+	case ActivityManufacturing:
+		return b.Activities.Manufacturing
+	case ActivityReaction:
+		return b.Activities.Reaction
+	case ActivityResearchMaterial:
+		return b.Activities.ResearchMaterial
+	case ActivityResearchTime:
+		return b.Activities.ResearchTime
+	}
+	return nil
+}
+
+// Produces reports whether manufacturing or reacting with this blueprint makes typeID
+func (b Blueprint) Produces(typeID int32) bool {
+	for _, a := range []*BlueprintActivity{b.Activities.Manufacturing, b.Activities.Reaction} {
+		if a == nil {
+			continue
+		}
+		for _, p := range a.Products {
+			if p.TypeID == typeID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ImportIndustry replaces just the blueprint and reprocessing data with the contents of a local SDE zip
+func ImportIndustry(config Configuration, sdePath string) error {
+	client, err := newClient(config)
+	if err != nil {
+		return errors.Wrap(err, "failed to create client")
+	}
+	defer client.Close()
+
+	return client.withLock(context.Background(), config, RunImportIndustry, func(ctx context.Context) error {
+		run := client.startRun(config, RunImportIndustry, []string{"sde industry"})
+		run.snapshot([]string{"blueprints", "type_materials"})
+		err := importIndustryFile(ctx, client, sdePath)
+		run.finish(err)
+		return err
+	})
+}
+
+func importIndustryFile(ctx context.Context, client *Client, sdePath string) error {
+	err := client.Store.DeleteCollections("blueprints", "type_materials")
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete existing industry data")
+	}
+
+	archive, err := openSDE(sdePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return traceStage(ctx, "sde industry", func(ctx context.Context) error {
+		return importSDEIndustry(ctx, client, archive)
+	})
+}
+
+func importSDEIndustry(ctx context.Context, client *Client, archive *sdeArchive) error {
+
+	var blueprints map[int32]Blueprint
+	err := archive.decode("fsd/blueprints.yaml", &blueprints)
+	if err != nil {
+		return err
+	}
+
+	var materials map[int32]TypeMaterials
+	err = archive.decode("fsd/typeMaterials.yaml", &materials)
+	if err != nil {
+		return err
+	}
+
+	client.Log.Info("Importing industry data from the SDE", "blueprints", len(blueprints), "type_materials", len(materials))
+
+	writer := newSDEWriter(ctx, client, "sde industry")
+
+	for id, b := range blueprints {
+		if ctx.Err() != nil {
+			return writer.Wait()
+		}
+		blueprint := b
+		blueprint.BlueprintTypeID = id
+		writer.insert("blueprint", id, func() error { return client.Store.InsertBlueprint(ctx, blueprint) })
+	}
+
+	for id, m := range materials {
+		if ctx.Err() != nil {
+			return writer.Wait()
+		}
+		typeMaterials := m
+		typeMaterials.TypeID = id
+		writer.insert("type materials", id, func() error { return client.Store.InsertTypeMaterials(ctx, typeMaterials) })
+	}
+
+	return writer.Wait()
+}
@@ -0,0 +1,137 @@
+package higgs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultLanguage is what ESI gives us when we dont ask for anything, and what we fall back to
+const DefaultLanguage = "en"
+
+// SupportedLanguages are the languages ESI will translate static data into
+var SupportedLanguages = []string{"en", "de", "fr", "ja", "ru", "zh", "ko", "es"}
+
+type localizedText struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func (r ESIRegion) LocalizedName(lang string) string { return localized(r.Names, r.Name, lang) }
+func (r ESIRegion) LocalizedDescription(lang string) string {
+	return localized(r.Descriptions, r.Description, lang)
+}
+func (c ESIConstellation) LocalizedName(lang string) string { return localized(c.Names, c.Name, lang) }
+func (s ESISystem) LocalizedName(lang string) string        { return localized(s.Names, s.Name, lang) }
+func (t ESIType) LocalizedName(lang string) string          { return localized(t.Names, t.Name, lang) }
+func (t ESIType) LocalizedDescription(lang string) string {
+	return localized(t.Descriptions, t.Description, lang)
+}
+func (g ESIGroup) LocalizedName(lang string) string    { return localized(g.Names, g.Name, lang) }
+func (c ESICategory) LocalizedName(lang string) string { return localized(c.Names, c.Name, lang) }
+
+// localized picks lang out of the translations, falling back to the english text we always have
+func localized(translations map[string]string, english, lang string) string {
+	if t, ok := translations[normaliseLanguage(lang)]; ok && t != "" {
+		return t
+	}
+	return english
+}
+
+func normaliseLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	// ESI also accepts en-us, which is the same thing as far as we care
+	if lang == "en-us" {
+		return DefaultLanguage
+	}
+	return lang
+}
+
+// validateLanguages normalises the configured languages and makes sure ESI will understand them
+func validateLanguages(langs []string) ([]string, error) {
+	supported := make(map[string]bool)
+	for _, l := range SupportedLanguages {
+		supported[l] = true
+	}
+
+	seen := make(map[string]bool)
+	var out []string
+	for _, l := range langs {
+		l = normaliseLanguage(l)
+		if !supported[l] {
+			return nil, fmt.Errorf("unsupported language %q, must be one of %v", l, SupportedLanguages)
+		}
+		if !seen[l] {
+			seen[l] = true
+			out = append(out, l)
+		}
+	}
+
+	return out, nil
+}
+
+// fetchLocalized grabs every configured translation of an ESI object. The english text we already have is
+// passed in so we dont fetch it twice. Returns nil maps if english is all we have been asked for.
+// If some languages fail the ones that worked are still returned along with the error.
+func (c *Client) fetchLocalized(ctx context.Context, esiURL, name, description string) (names, descriptions map[string]string, err error) {
+	u, err := url.Parse(esiURL)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse esi url")
+	}
+
+	var (
+		failed   []string
+		firstErr error
+	)
+	for _, lang := range c.Languages {
+		if lang == DefaultLanguage {
+			continue
+		}
+		if names == nil {
+			names = map[string]string{DefaultLanguage: name}
+			descriptions = map[string]string{DefaultLanguage: description}
+		}
+
+		q := u.Query()
+		q.Set("language", lang)
+		langURL := *u
+		langURL.RawQuery = q.Encode()
+
+		text, err := c.fetchTranslation(ctx, langURL.String())
+		if err != nil {
+			failed = append(failed, lang)
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "failed to fetch %v translation", lang)
+			}
+			continue
+		}
+
+		names[lang] = text.Name
+		if text.Description != "" {
+			descriptions[lang] = text.Description
+		}
+	}
+
+	if len(descriptions) == 1 && descriptions[DefaultLanguage] == "" {
+		descriptions = nil
+	}
+
+	if firstErr != nil {
+		return names, descriptions, errors.Wrapf(firstErr, "missing %v translations", strings.Join(failed, ", "))
+	}
+	return names, descriptions, nil
+}
+
+func (c *Client) fetchTranslation(ctx context.Context, url string) (localizedText, error) {
+	var text localizedText
+	body, err := c.MakeESIGetContext(ctx, url)
+	if err != nil {
+		return text, err
+	}
+
+	err = decodeESI(url, body, &text)
+	return text, err
+}
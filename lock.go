@@ -0,0 +1,277 @@
+package higgs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	stderrors "errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// staticDataLock is held by anything that changes the static data
+	staticDataLock = "static_data"
+
+	defaultLockTTL = 2 * time.Minute
+	// lockRetryEvery is how often to try again for a held lock when waiting for it
+	lockRetryEvery = 5 * time.Second
+)
+
+// ErrLockHeld is returned when another run holds the lock, check for it with errors.Is
+var ErrLockHeld = stderrors.New("lock is held by another run")
+
+type (
+	// LockInfo is who holds a lock, as kept in the locks collection
+	LockInfo struct {
+		Name      string    `json:"name" bson:"_id"`
+		Owner     string    `json:"owner" bson:"owner"`
+		Kind      string    `json:"kind" bson:"kind"`
+		Acquired  time.Time `json:"acquired" bson:"acquired"`
+		Heartbeat time.Time `json:"heartbeat" bson:"heartbeat"`
+		Expires   time.Time `json:"expires" bson:"expires"`
+	}
+
+	// LockHeldError says who has the lock we wanted
+	LockHeldError struct {
+		Holder LockInfo
+	}
+
+	// Lease is a held lock. It is kept alive in the background until Release.
+	Lease struct {
+		db   *DB
+		info LockInfo
+		ttl  time.Duration
+		stop chan struct{}
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		lost bool
+		// done is closed once the lease is lost
+		done  chan struct{}
+		onErr func(error)
+	}
+)
+
+func (e *LockHeldError) Error() string {
+	return fmt.Sprintf("%v: %v has held it for %v running %v, it expires at %v unless they keep it alive",
+		ErrLockHeld, e.Holder.Owner, time.Since(e.Holder.Acquired).Round(time.Second), e.Holder.Kind,
+		e.Holder.Expires.Local().Format(time.RFC3339))
+}
+
+func (e *LockHeldError) Is(target error) bool {
+	return target == ErrLockHeld
+}
+
+// lockOwner names this process, so whoever finds the lock held knows who to go and look at. The random part
+// makes it different for every lease, so two runs in the same process dont both think they have it.
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%v:%v:%v", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// AcquireLease takes the named lock for owner if nobody has it or their lease has expired. Each lease wants
+// an owner of its own, it isnt taken over even by the same owner while it is held.
+// If someone else has it the error is a *LockHeldError.
+func (db *DB) AcquireLease(ctx context.Context, name, owner, kind string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+
+	now := time.Now().UTC()
+	info := LockInfo{Name: name, Owner: owner, Kind: kind, Acquired: now, Heartbeat: now, Expires: now.Add(ttl)}
+
+	collection := db.Database.Database(db.DBName).Collection("locks")
+	filter := bson.M{"_id": name, "expires": bson.M{"$lt": now}}
+	update := bson.M{"$set": bson.M{"owner": owner, "kind": kind, "acquired": now, "heartbeat": now, "expires": info.Expires}}
+
+	_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		if !isDuplicateKey(err) {
+			return nil, errors.Wrapf(err, "failed to take the %v lock", name)
+		}
+
+		// The filter didnt match so the upsert tried to insert a second one, someone else has it
+		var holder LockInfo
+		if ferr := collection.FindOne(ctx, bson.M{"_id": name}).Decode(&holder); ferr != nil {
+			return nil, errors.Wrapf(ferr, "failed to find who holds the %v lock", name)
+		}
+		return nil, &LockHeldError{Holder: holder}
+	}
+
+	lease := &Lease{db: db, info: info, ttl: ttl, stop: make(chan struct{}), done: make(chan struct{})}
+	lease.wg.Add(1)
+	go lease.heartbeat()
+
+	return lease, nil
+}
+
+// Info is the lock as it was taken
+func (l *Lease) Info() LockInfo {
+	return l.info
+}
+
+// Lost is true if the lease couldnt be kept alive and someone else may have taken it
+func (l *Lease) Lost() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// Done is closed if the lease is lost
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *Lease) heartbeat() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	collection := l.db.Database.Database(l.db.DBName).Collection("locks")
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+			res, err := collection.UpdateOne(context.Background(),
+				bson.M{"_id": l.info.Name, "owner": l.info.Owner},
+				bson.M{"$set": bson.M{"heartbeat": now, "expires": now.Add(l.ttl)}})
+			if err == nil && res.MatchedCount == 0 {
+				err = fmt.Errorf("the %v lock was taken by someone else", l.info.Name)
+				l.mu.Lock()
+				if !l.lost {
+					l.lost = true
+					close(l.done)
+				}
+				l.mu.Unlock()
+			}
+			l.mu.Lock()
+			onErr := l.onErr
+			l.mu.Unlock()
+			if err != nil && onErr != nil {
+				onErr(err)
+			}
+		}
+	}
+}
+
+// Release stops keeping the lease alive and gives the lock up
+func (l *Lease) Release() error {
+	close(l.stop)
+	l.wg.Wait()
+
+	_, err := l.db.Database.Database(l.db.DBName).Collection("locks").DeleteOne(context.Background(),
+		bson.M{"_id": l.info.Name, "owner": l.info.Owner})
+	return errors.Wrapf(err, "failed to release the %v lock", l.info.Name)
+}
+
+// GetLock returns who holds the named lock, nil if nobody does
+func (db *DB) GetLock(name string) (*LockInfo, error) {
+	var info LockInfo
+	err := db.Database.Database(db.DBName).Collection("locks").FindOne(context.Background(), bson.M{"_id": name}).Decode(&info)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the %v lock", name)
+	}
+	return &info, nil
+}
+
+// withLock runs fn holding the static data lock, waiting for it for up to config.Lock.Wait if someone
+// else has it. If the lease is lost part way through the ctx given to fn is cancelled, so it stops rather than
+// carrying on alongside whoever has it now.
+func (c *Client) withLock(ctx context.Context, config Configuration, kind string, fn func(context.Context) error) error {
+	db, ok := c.db()
+	if !ok {
+		// Any other store belongs to this process alone
+		return fn(ctx)
+	}
+
+	waitCtx := ctx
+	if config.Lock.Wait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, config.Lock.Wait)
+		defer cancel()
+	}
+
+	var lease *Lease
+	for {
+		var err error
+		lease, err = db.AcquireLease(waitCtx, staticDataLock, lockOwner(), kind, config.Lock.TTL)
+		if err == nil {
+			break
+		}
+		if !stderrors.Is(err, ErrLockHeld) || config.Lock.Wait <= 0 {
+			return err
+		}
+
+		c.Log.Info("Waiting for the lock", "lock", staticDataLock, "error", err)
+		select {
+		case <-waitCtx.Done():
+			return errors.Wrap(err, "gave up waiting")
+		case <-time.After(lockRetryEvery):
+		}
+	}
+
+	lease.mu.Lock()
+	lease.onErr = func(err error) {
+		c.Log.Error("Failed to keep the lock alive", "lock", staticDataLock, "error", err)
+	}
+	lease.mu.Unlock()
+	c.Log.Debug("Took the lock", "lock", staticDataLock, "owner", lease.info.Owner)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lease.Done():
+			c.Log.Error("Lost the lock, stopping", "lock", staticDataLock)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := fn(ctx)
+
+	if rerr := lease.Release(); rerr != nil {
+		c.Log.Warn("Failed to release the lock, it will expire on its own", "lock", staticDataLock, "error", rerr)
+	}
+	if lease.Lost() {
+		lostErr := fmt.Sprintf("lost the %v lock part way through and stopped, the data may have been changed by someone else too", staticDataLock)
+		if err == nil {
+			err = errors.New(lostErr)
+		} else {
+			err = errors.Wrap(err, lostErr)
+		}
+	}
+
+	return err
+}
+
+func isDuplicateKey(err error) bool {
+	var we mongo.WriteException
+	if stderrors.As(err, &we) {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return strings.Contains(err.Error(), "E11000")
+}
@@ -0,0 +1,23 @@
+package higgs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLockOwnerIsPerLease(t *testing.T) {
+	host, _ := os.Hostname()
+	prefix := fmt.Sprintf("%v:%v:", host, os.Getpid())
+
+	a, b := lockOwner(), lockOwner()
+	if a == b {
+		t.Errorf("two leases in the same process both got owner %v", a)
+	}
+	for _, owner := range []string{a, b} {
+		if !strings.HasPrefix(owner, prefix) || len(owner) == len(prefix) {
+			t.Errorf("owner %q should be %v and something random", owner, prefix)
+		}
+	}
+}
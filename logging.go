@@ -0,0 +1,41 @@
+package higgs
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// NewLogger builds the logger the client uses from the app config, writing to stdout above any progress display
+func NewLogger(config AppConfig) (*slog.Logger, error) {
+	return newLogger(displayLogWriter{w: os.Stdout}, config)
+}
+
+func newLogger(w io.Writer, config AppConfig) (*slog.Logger, error) {
+	var level slog.Level
+	switch strings.ToLower(config.LogLevel) {
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q", config.LogLevel)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(config.LogFormat) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", config.LogFormat)
+	}
+}
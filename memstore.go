@@ -0,0 +1,480 @@
+package higgs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MemoryStore keeps the static data in memory. Documents are held as the same bson mongo would store, so
+// anything read back looks just like it would coming out of DB.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	collections map[string]map[int64]bson.Raw
+}
+
+// NewMemoryStore makes an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{collections: make(map[string]map[int64]bson.Raw)}
+}
+
+// LoadSnapshot reads a directory written by export into memory. Collections without a file are left empty.
+func LoadSnapshot(dir string) (*MemoryStore, error) {
+	m := NewMemoryStore()
+	for _, collection := range StaticCollections {
+		err := m.loadExport(filepath.Join(dir, collection+".jsonl"), collection)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *MemoryStore) loadExport(filename, collection string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to open export of %v", collection)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var doc bson.D
+			if uerr := bson.UnmarshalExtJSON(line, false, &doc); uerr != nil {
+				return errors.Wrapf(uerr, "failed to decode line %v of %v", n, filename)
+			}
+			if ierr := m.insert(context.Background(), collection, collection, doc); ierr != nil {
+				return errors.Wrapf(ierr, "failed to load line %v of %v", n, filename)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read %v", filename)
+		}
+	}
+}
+
+// insert adds doc to collection. what is the name used in the error, the same as DB uses.
+func (m *MemoryStore) insert(ctx context.Context, collection, what string, doc interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrapf(err, "failed to insert eve %v", what)
+	}
+
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to insert eve %v", what)
+	}
+	id, err := numericField(raw, "_id")
+	if err != nil {
+		return errors.Wrapf(err, "failed to insert eve %v", what)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	docs := m.collections[collection]
+	if docs == nil {
+		docs = make(map[int64]bson.Raw)
+		m.collections[collection] = docs
+	}
+	if _, ok := docs[id]; ok {
+		return errors.Wrapf(duplicateKeyError(collection, id), "failed to insert eve %v", what)
+	}
+	docs[id] = raw
+
+	return nil
+}
+
+// duplicateKeyError is what mongo gives back for inserting an _id that is already there
+func duplicateKeyError(collection string, id int64) error {
+	return mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+		Code:    11000,
+		Message: fmt.Sprintf("E11000 duplicate key error collection: memory.%v index: _id_ dup key: { _id: %v }", collection, id),
+	}}}
+}
+
+// numericField reads an integer field out of a document, however it was stored
+func numericField(raw bson.Raw, key string) (int64, error) {
+	v, err := raw.LookupErr(key)
+	if err != nil {
+		return 0, errors.Errorf("document has no %v", key)
+	}
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32()), nil
+	case bsontype.Int64:
+		return v.Int64(), nil
+	case bsontype.Double:
+		return int64(v.Double()), nil
+	}
+	return 0, errors.Errorf("document %v is a %v, not a number", key, v.Type)
+}
+
+// findAll calls decode with every document in collection, in _id order
+func (m *MemoryStore) findAll(collection string, decode func(raw bson.Raw) error) error {
+	m.mu.RLock()
+	docs := m.collections[collection]
+	ids := make([]int64, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	raws := make([]bson.Raw, 0, len(docs))
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		raws = append(raws, docs[id])
+	}
+	m.mu.RUnlock()
+
+	for _, raw := range raws {
+		if err := decode(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update sets fields on every document in collection that match, like a $set
+func (m *MemoryStore) update(collection string, match func(raw bson.Raw) bool, fields bson.D) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, raw := range m.collections[collection] {
+		if !match(raw) {
+			continue
+		}
+
+		var doc bson.D
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+	set:
+		for _, f := range fields {
+			for i := range doc {
+				if doc[i].Key == f.Key {
+					doc[i].Value = f.Value
+					continue set
+				}
+			}
+			doc = append(doc, f)
+		}
+
+		updated, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		m.collections[collection][id] = updated
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) DeleteStaticData() error {
+	// The same as DB clears, which includes a few collections we no longer fill in
+	names := append([]string{"ancestries", "bloodlines", "factions"}, StaticCollections...)
+	return m.DeleteCollections(names...)
+}
+
+func (m *MemoryStore) DeleteCollections(names ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range names {
+		delete(m.collections, name)
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertRegion(ctx context.Context, region ESIRegion) error {
+	return m.insert(ctx, "regions", "region", region)
+}
+
+func (m *MemoryStore) InsertConstellation(ctx context.Context, cons ESIConstellation) error {
+	return m.insert(ctx, "constellations", "constellation", cons)
+}
+
+func (m *MemoryStore) InsertSystem(ctx context.Context, system ESISystem) error {
+	return m.insert(ctx, "solarsystems", "system", system)
+}
+
+func (m *MemoryStore) InsertStar(ctx context.Context, star ESIStar) error {
+	return m.insert(ctx, "stars", "star", star)
+}
+
+func (m *MemoryStore) InsertPlanet(ctx context.Context, planet ESIPlanet) error {
+	return m.insert(ctx, "planets", "planet", planet)
+}
+
+func (m *MemoryStore) InsertMoon(ctx context.Context, moon ESIMoon) error {
+	return m.insert(ctx, "moons", "moon", moon)
+}
+
+func (m *MemoryStore) InsertAsteroidBelt(ctx context.Context, belt ESIAsteroidBelt) error {
+	return m.insert(ctx, "asteroid_belts", "asteroid belt", belt)
+}
+
+func (m *MemoryStore) InsertStargate(ctx context.Context, gate ESIStargate) error {
+	return m.insert(ctx, "stargates", "stargate", gate)
+}
+
+func (m *MemoryStore) InsertStation(ctx context.Context, station ESIStation) error {
+	return m.insert(ctx, "stations", "station", station)
+}
+
+func (m *MemoryStore) InsertType(ctx context.Context, typeESI ESIType) error {
+	return m.insert(ctx, "types", "type", typeESI)
+}
+
+func (m *MemoryStore) InsertGroup(ctx context.Context, group ESIGroup) error {
+	return m.insert(ctx, "groups", "group", group)
+}
+
+func (m *MemoryStore) InsertCategory(ctx context.Context, category ESICategory) error {
+	return m.insert(ctx, "categories", "category", category)
+}
+
+func (m *MemoryStore) InsertBlueprint(ctx context.Context, blueprint Blueprint) error {
+	return m.insert(ctx, "blueprints", "blueprint", blueprint)
+}
+
+func (m *MemoryStore) InsertTypeMaterials(ctx context.Context, materials TypeMaterials) error {
+	return m.insert(ctx, "type_materials", "type materials", materials)
+}
+
+// UpdateSystemMetadata writes the derived region and space classification back onto a system
+func (m *MemoryStore) UpdateSystemMetadata(ctx context.Context, system ESISystem) error {
+	err := m.update("solarsystems", func(raw bson.Raw) bool {
+		id, err := numericField(raw, "_id")
+		return err == nil && id == int64(system.SystemID)
+	}, bson.D{
+		{Key: "region_id", Value: system.RegionID},
+		{Key: "region_name", Value: system.RegionName},
+		{Key: "space_type", Value: system.SpaceType},
+		{Key: "wormhole_class", Value: system.WormholeClass},
+	})
+	return errors.Wrap(err, "failed to update eve system metadata")
+}
+
+// SetRegion denormalises a region onto everything in collection that sits in one of the given systems
+func (m *MemoryStore) SetRegion(ctx context.Context, collection string, systemIDs []int32, regionID int32, regionName string) error {
+	in := make(map[int64]bool, len(systemIDs))
+	for _, id := range systemIDs {
+		in[int64(id)] = true
+	}
+
+	err := m.update(collection, func(raw bson.Raw) bool {
+		id, err := numericField(raw, "system_id")
+		return err == nil && in[id]
+	}, bson.D{
+		{Key: "region_id", Value: regionID},
+		{Key: "region_name", Value: regionName},
+	})
+	return errors.Wrapf(err, "failed to set region on %v", collection)
+}
+
+func (m *MemoryStore) GetSystems() (systems []ESISystem, err error) {
+	err = m.findAll("solarsystems", func(raw bson.Raw) error {
+		var system ESISystem
+		if err := bson.Unmarshal(raw, &system); err != nil {
+			return errors.Wrap(err, "Failed to morp system into struct")
+		}
+		systems = append(systems, system)
+		return nil
+	})
+	return systems, err
+}
+
+func (m *MemoryStore) GetRegions() (regions []ESIRegion, err error) {
+	err = m.findAll("regions", func(raw bson.Raw) error {
+		var region ESIRegion
+		if err := bson.Unmarshal(raw, &region); err != nil {
+			return err
+		}
+		regions = append(regions, region)
+		return nil
+	})
+	return regions, errors.Wrap(err, "error retrieving existing regions")
+}
+
+func (m *MemoryStore) GetConstellations() (constellations []ESIConstellation, err error) {
+	err = m.findAll("constellations", func(raw bson.Raw) error {
+		var constellation ESIConstellation
+		if err := bson.Unmarshal(raw, &constellation); err != nil {
+			return err
+		}
+		constellations = append(constellations, constellation)
+		return nil
+	})
+	return constellations, errors.Wrap(err, "error retrieving existing constellations")
+}
+
+func (m *MemoryStore) GetStations() (stations []ESIStation, err error) {
+	err = m.findAll("stations", func(raw bson.Raw) error {
+		var station ESIStation
+		if err := bson.Unmarshal(raw, &station); err != nil {
+			return err
+		}
+		stations = append(stations, station)
+		return nil
+	})
+	return stations, errors.Wrap(err, "error retrieving existing stations")
+}
+
+func (m *MemoryStore) GetTypes() (types []ESIType, err error) {
+	err = m.findAll("types", func(raw bson.Raw) error {
+		var typeESI ESIType
+		if err := bson.Unmarshal(raw, &typeESI); err != nil {
+			return err
+		}
+		types = append(types, typeESI)
+		return nil
+	})
+	return types, errors.Wrap(err, "error retrieving existing types")
+}
+
+func (m *MemoryStore) GetGroups() (groups []ESIGroup, err error) {
+	err = m.findAll("groups", func(raw bson.Raw) error {
+		var group ESIGroup
+		if err := bson.Unmarshal(raw, &group); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+		return nil
+	})
+	return groups, errors.Wrap(err, "error retrieving existing groups")
+}
+
+func (m *MemoryStore) GetCategories() (categories []ESICategory, err error) {
+	err = m.findAll("categories", func(raw bson.Raw) error {
+		var category ESICategory
+		if err := bson.Unmarshal(raw, &category); err != nil {
+			return err
+		}
+		categories = append(categories, category)
+		return nil
+	})
+	return categories, errors.Wrap(err, "error retrieving existing categories")
+}
+
+// get decodes the document with id into out, mongo.ErrNoDocuments if there isnt one
+func (m *MemoryStore) get(collection string, id int32, out interface{}) error {
+	m.mu.RLock()
+	raw, ok := m.collections[collection][int64(id)]
+	m.mu.RUnlock()
+
+	if !ok {
+		return mongo.ErrNoDocuments
+	}
+	return bson.Unmarshal(raw, out)
+}
+
+// GetBlueprint is what a blueprint needs and makes for each of its activities
+func (m *MemoryStore) GetBlueprint(blueprintTypeID int32) (blueprint Blueprint, err error) {
+	err = m.get("blueprints", blueprintTypeID, &blueprint)
+	return blueprint, errors.Wrapf(err, "error retrieving blueprint %v", blueprintTypeID)
+}
+
+// GetBlueprintsProducing finds every blueprint that manufactures or reacts into typeID
+func (m *MemoryStore) GetBlueprintsProducing(typeID int32) (blueprints []Blueprint, err error) {
+	err = m.findAll("blueprints", func(raw bson.Raw) error {
+		var blueprint Blueprint
+		if err := bson.Unmarshal(raw, &blueprint); err != nil {
+			return err
+		}
+		if blueprint.Produces(typeID) {
+			blueprints = append(blueprints, blueprint)
+		}
+		return nil
+	})
+	return blueprints, errors.Wrapf(err, "error retrieving blueprints producing %v", typeID)
+}
+
+// GetTypeMaterials is what typeID reprocesses into
+func (m *MemoryStore) GetTypeMaterials(typeID int32) (materials TypeMaterials, err error) {
+	err = m.get("type_materials", typeID, &materials)
+	return materials, errors.Wrapf(err, "error retrieving materials for type %v", typeID)
+}
+
+// GetNames returns just the id and name of every document in a static data collection
+func (m *MemoryStore) GetNames(collection string) (names []EntityName, err error) {
+	err = m.findAll(collection, func(raw bson.Raw) error {
+		var name EntityName
+		if err := bson.Unmarshal(raw, &name); err != nil {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	})
+	return names, errors.Wrapf(err, "error retrieving names from %v", collection)
+}
+
+// GetLocalizedNames is GetNames but in the requested language, falling back to english where
+// we dont have a translation
+func (m *MemoryStore) GetLocalizedNames(collection, lang string) (names []EntityName, err error) {
+	lang = normaliseLanguage(lang)
+	if lang == DefaultLanguage {
+		return m.GetNames(collection)
+	}
+
+	err = m.findAll(collection, func(raw bson.Raw) error {
+		var doc struct {
+			ID    int32             `bson:"_id"`
+			Name  string            `bson:"name"`
+			Names map[string]string `bson:"names"`
+		}
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		names = append(names, EntityName{ID: doc.ID, Name: localized(doc.Names, doc.Name, lang)})
+		return nil
+	})
+	return names, errors.Wrapf(err, "error retrieving %v names from %v", lang, collection)
+}
+
+// GetIDs returns the _id of everything in a collection
+func (m *MemoryStore) GetIDs(collection string) (ids []int32, err error) {
+	err = m.findAll(collection, func(raw bson.Raw) error {
+		id, err := numericField(raw, "_id")
+		if err != nil {
+			return err
+		}
+		ids = append(ids, int32(id))
+		return nil
+	})
+	return ids, errors.Wrapf(err, "error retrieving ids from %v", collection)
+}
+
+func (m *MemoryStore) Count(collection string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.collections[collection])), nil
+}
+
+// ExportCollection writes every document in a collection to w as one line of extended json each, in _id order
+func (m *MemoryStore) ExportCollection(collection string, w io.Writer) error {
+	err := m.findAll(collection, func(raw bson.Raw) error {
+		line, err := bson.MarshalExtJSON(raw, false, false)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(line, '\n'))
+		return err
+	})
+	return errors.Wrapf(err, "failed to export %v", collection)
+}
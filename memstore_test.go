@@ -0,0 +1,283 @@
+package higgs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/podded/higgs/esitest"
+)
+
+// memoryClient is a client that fetches from esi and keeps everything in memory
+func memoryClient(esi *esitest.Server, store Store) *Client {
+	return &Client{
+		HTTP:        &http.Client{Timeout: 5 * time.Second},
+		Store:       store,
+		Log:         slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+		Retry:       RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 100 * time.Millisecond},
+		MaxRoutines: 4,
+		Languages:   []string{DefaultLanguage, "de"},
+		ESIBaseURL:  esi.URL,
+		pacer:       newPacer(HttpConfig{}, 4),
+	}
+}
+
+func TestMemoryStoreDuplicateID(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+
+	region := ESIRegion{RegionID: 10000002, Name: "The Forge"}
+	if err := store.InsertRegion(ctx, region); err != nil {
+		t.Fatal(err)
+	}
+	err := store.InsertRegion(ctx, region)
+	if err == nil || !isDuplicateKey(err) {
+		t.Fatalf("want a duplicate key error inserting the same region twice, got %v", err)
+	}
+
+	// The same id in another collection is fine
+	if err := store.InsertConstellation(ctx, ESIConstellation{ConstellationID: 10000002}); err != nil {
+		t.Errorf("inserting a constellation with a region's id: %v", err)
+	}
+
+	if err := store.DeleteStaticData(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertRegion(ctx, region); err != nil {
+		t.Errorf("inserting again after deleting: %v", err)
+	}
+}
+
+func TestPopulateIntoMemory(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	u := esi.Universe()
+
+	store := NewMemoryStore()
+	client := memoryClient(esi, store)
+	if err := populate(context.Background(), client, PopulateOptions{}, stages); err != nil {
+		t.Fatalf("populate failed: %v", err)
+	}
+
+	report, err := VerifyStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for resource, collection := range map[string]string{"regions": "regions", "systems": "solarsystems", "planets": "planets",
+		"moons": "moons", "asteroid_belts": "asteroid_belts", "stargates": "stargates", "types": "types", "groups": "groups"} {
+		if got, want := report.Counts[collection], int64(u.Count(resource)); got != want {
+			t.Errorf("%v has %v, want %v", collection, got, want)
+		}
+	}
+	if len(report.Missing) > 0 {
+		t.Errorf("missing %v", report.Missing)
+	}
+	// Populating from ESI never fills blueprints or type materials, that shouldnt fail verify
+	if !report.OK() {
+		t.Errorf("verify failed after populating, empty %v", report.Empty())
+	}
+
+	systems, err := store.GetSystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sys := range systems {
+		if sys.SystemID == theraSystemID && (sys.SpaceType != SpaceWormhole || sys.WormholeClass != WormholeClassThera) {
+			t.Errorf("thera is %v class %v", sys.SpaceType, sys.WormholeClass)
+		}
+		if sys.SystemID == 30000142 && (sys.RegionName != "The Forge" || sys.Names["de"] != "Jita [de]") {
+			t.Errorf("jita is %+v", sys)
+		}
+	}
+
+	// enrich sets the region on everything in a system through SetRegion
+	ids, err := store.GetIDs("planets")
+	if err != nil || len(ids) == 0 {
+		t.Fatalf("got planets %v, %v", ids, err)
+	}
+	var planet ESIPlanet
+	if err := store.get("planets", ids[0], &planet); err != nil {
+		t.Fatal(err)
+	}
+	if planet.RegionName == "" {
+		t.Errorf("planet %v has no region", planet.PlanetID)
+	}
+
+	names, err := store.GetLocalizedNames("types", "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range names {
+		if n.ID == 587 && n.Name != "Rifter [de]" {
+			t.Errorf("type 587 in german is %q", n.Name)
+		}
+	}
+}
+
+func TestPopulateKeepsIndustryData(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+
+	store := NewMemoryStore()
+	ctx := context.Background()
+	if err := store.InsertBlueprint(ctx, Blueprint{BlueprintTypeID: 691}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertTypeMaterials(ctx, TypeMaterials{TypeID: 587}); err != nil {
+		t.Fatal(err)
+	}
+
+	// ESI has nothing to put back, so populating mustnt empty them
+	if err := populate(ctx, memoryClient(esi, store), PopulateOptions{}, stages); err != nil {
+		t.Fatalf("populate failed: %v", err)
+	}
+	for _, collection := range industryCollections {
+		if n, _ := store.Count(collection); n != 1 {
+			t.Errorf("%v has %v after populating, want 1", collection, n)
+		}
+	}
+}
+
+func TestPopulateFailsStageWithHoles(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	u := esi.Universe()
+
+	// One moon that wont decode fails the moons stage, the rest of them still get stored
+	const brokenMoon = 40009078
+	esi.Inject(esitest.Fault{Path: fmt.Sprintf("/universe/moons/%v/", brokenMoon), Malformed: true})
+
+	store := NewMemoryStore()
+	err := populate(context.Background(), memoryClient(esi, store), PopulateOptions{}, stages)
+	var stageErrs StageErrors
+	if !errors.As(err, &stageErrs) || len(stageErrs) != 1 || stageErrs["moons"] == nil {
+		t.Fatalf("want only the moons stage to fail, got %v", err)
+	}
+	if want := fmt.Sprintf("1 of %v moons failed", u.Count("moons")); !strings.Contains(err.Error(), want) {
+		t.Errorf("want %q in %v", want, err)
+	}
+	var decodeErr *DecodeError
+	if !errors.As(stageErrs["moons"], &decodeErr) {
+		t.Errorf("want the DecodeError for the broken moon, got %#v", stageErrs["moons"])
+	}
+	if n, _ := store.Count("moons"); n != int64(u.Count("moons")-1) {
+		t.Errorf("stored %v moons, want %v", n, u.Count("moons")-1)
+	}
+
+	// Something ESI says isnt there is skipped, not a failure
+	esi = esitest.NewServer(nil)
+	defer esi.Close()
+	esi.Inject(esitest.Fault{Path: fmt.Sprintf("/universe/moons/%v/", brokenMoon), Status: http.StatusNotFound})
+	if err := populate(context.Background(), memoryClient(esi, NewMemoryStore()), PopulateOptions{Only: []string{"moons"}}, stages); err != nil {
+		t.Errorf("a moon ESI doesnt have failed populate: %v", err)
+	}
+}
+
+func TestPopulateFailsMissingTranslations(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	esi.Inject(esitest.Fault{Path: "/universe/types/587/", Language: "de", Malformed: true})
+
+	store := NewMemoryStore()
+	client := memoryClient(esi, store)
+	client.Languages = []string{DefaultLanguage, "de", "fr"}
+	err := populate(context.Background(), client, PopulateOptions{Only: []string{"types"}}, stages)
+	if err == nil || !strings.Contains(err.Error(), "1 of") || !strings.Contains(err.Error(), "missing de translations") {
+		t.Fatalf("want one type failed for its german translation, got %v", err)
+	}
+
+	// What did come back is still stored
+	var rifter ESIType
+	if err := store.get("types", 587, &rifter); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rifter.Names["de"]; ok || rifter.Names["fr"] != "Rifter [fr]" || rifter.Names[DefaultLanguage] != "Rifter" {
+		t.Errorf("rifter has names %v", rifter.Names)
+	}
+}
+
+func TestPopulateStopsWhenCancelled(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := populate(ctx, memoryClient(esi, NewMemoryStore()), PopulateOptions{}, stages)
+	var stageErrs StageErrors
+	if !errors.As(err, &stageErrs) || !errors.Is(stageErrs["regions"], context.Canceled) {
+		t.Fatalf("want the regions stage cancelled, got %v", err)
+	}
+	if n := esi.Requests("/universe/"); n != 0 {
+		t.Errorf("made %v requests after being cancelled", n)
+	}
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+
+	store := NewMemoryStore()
+	if err := populate(context.Background(), memoryClient(esi, store), PopulateOptions{}, stages); err != nil {
+		t.Fatalf("populate failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	exportStore(t, store, dir)
+
+	loaded, err := LoadSnapshot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What comes back out has to be exactly what went in
+	again := t.TempDir()
+	exportStore(t, loaded, again)
+	changes, err := DiffExports(dir, again, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.Empty() {
+		t.Errorf("loaded snapshot differs: %+v", changes.Counts())
+	}
+	for _, collection := range []string{"solarsystems", "types", "moons"} {
+		want, _ := store.Count(collection)
+		if got, _ := loaded.Count(collection); got != want || got == 0 {
+			t.Errorf("loaded %v %v, want %v", got, collection, want)
+		}
+	}
+
+	resolver, err := NewResolver(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resolver.Lookup("jita"); len(got) != 1 || got[0].ID != 30000142 {
+		t.Errorf("looking up jita gave %+v", got)
+	}
+}
+
+func exportStore(t *testing.T, store Store, dir string) {
+	t.Helper()
+	for _, collection := range StaticCollections {
+		f, err := os.Create(filepath.Join(dir, collection+".jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := bufio.NewWriter(f)
+		if err := store.ExportCollection(collection, w); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,167 @@
+package higgs
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Everything is registered on our own registry rather than the global one so embedding higgs doesnt
+// pollute someone else's metrics
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	esiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "higgs",
+		Subsystem: "esi",
+		Name:      "requests_total",
+		Help:      "ESI requests made, by endpoint and response status. Status is error if there was no response.",
+	}, []string{"endpoint", "status"})
+
+	esiRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "higgs",
+		Subsystem: "esi",
+		Name:      "retries_total",
+		Help:      "ESI requests that were retried, by endpoint.",
+	}, []string{"endpoint"})
+
+	esiErrorLimitRemain = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "higgs",
+		Subsystem: "esi",
+		Name:      "error_limit_remain",
+		Help:      "X-Esi-Error-Limit-Remain from the last ESI response that had it.",
+	})
+
+	esiConcurrencyLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "higgs",
+		Subsystem: "esi",
+		Name:      "concurrency_limit",
+		Help:      "How many ESI requests can be in flight at once, it shrinks when ESI is slow or erroring.",
+	})
+
+	esiPacingWait = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "higgs",
+		Subsystem: "esi",
+		Name:      "pacing_wait_seconds_total",
+		Help:      "Time spent waiting on the rate and concurrency limits before making ESI requests.",
+	})
+
+	esiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "higgs",
+		Subsystem: "esi",
+		Name:      "request_duration_seconds",
+		Help:      "How long ESI requests take, by endpoint.",
+		Buckets:   prometheus.ExponentialBuckets(0.025, 2, 10),
+	}, []string{"endpoint"})
+
+	stageItems = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "higgs",
+		Subsystem: "stage",
+		Name:      "items_total",
+		Help:      "Items handled by each populate stage, by result (fetched, inserted, missing from ESI or failed).",
+	}, []string{"stage", "result"})
+
+	stageDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "higgs",
+		Subsystem: "stage",
+		Name:      "duration_seconds",
+		Help:      "How long each populate stage took the last time it ran.",
+	}, []string{"stage"})
+
+	dbWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "higgs",
+		Subsystem: "db",
+		Name:      "write_duration_seconds",
+		Help:      "How long mongo writes take, by collection.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"collection"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		esiRequests,
+		esiRetries,
+		esiErrorLimitRemain,
+		esiConcurrencyLimit,
+		esiPacingWait,
+		esiRequestDuration,
+		stageItems,
+		stageDuration,
+		dbWriteDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// MetricsHandler serves everything higgs measures in the prometheus text format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// PushMetrics sends the current metrics to a prometheus Pushgateway, for one shot runs that
+// wont be around long enough to be scraped
+func PushMetrics(gateway, job string) error {
+	return push.New(gateway, job).Gatherer(metricsRegistry).Push()
+}
+
+// Ids in ESI paths would give every request its own label, so swap them for a placeholder
+var esiPathID = regexp.MustCompile(`/[0-9]+/`)
+
+func esiEndpoint(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "unknown"
+	}
+	// Run twice as the regexp cant match overlapping ids like /1/2/
+	return esiPathID.ReplaceAllString(esiPathID.ReplaceAllString(u.Path, "/{id}/"), "/{id}/")
+}
+
+func observeESIRequest(rawURL string, status int, header http.Header, took time.Duration) {
+	endpoint := esiEndpoint(rawURL)
+
+	label := "error"
+	if status > 0 {
+		label = strconv.Itoa(status)
+	}
+
+	esiRequests.WithLabelValues(endpoint, label).Inc()
+	esiRequestDuration.WithLabelValues(endpoint).Observe(took.Seconds())
+
+	if remain, err := strconv.Atoi(header.Get("X-Esi-Error-Limit-Remain")); err == nil {
+		esiErrorLimitRemain.Set(float64(remain))
+	}
+}
+
+func observeESIRetry(rawURL string) {
+	esiRetries.WithLabelValues(esiEndpoint(rawURL)).Inc()
+}
+
+func observeConcurrencyLimit(limit float64) {
+	esiConcurrencyLimit.Set(math.Floor(limit))
+}
+
+func observePacingWait(took time.Duration) {
+	esiPacingWait.Add(took.Seconds())
+}
+
+// observeDBWrite is meant to be deferred at the start of a write
+func observeDBWrite(collection string, start time.Time) {
+	dbWriteDuration.WithLabelValues(collection).Observe(time.Since(start).Seconds())
+}
+
+func observeStage(stageName string, took time.Duration) {
+	stageDuration.WithLabelValues(stageName).Set(took.Seconds())
+}
+
+func stageItemsFetched(stageName string)  { stageItems.WithLabelValues(stageName, "fetched").Inc() }
+func stageItemsInserted(stageName string) { stageItems.WithLabelValues(stageName, "inserted").Inc() }
+func stageItemsFailed(stageName string)   { stageItems.WithLabelValues(stageName, "failed").Inc() }
+func stageItemsMissing(stageName string)  { stageItems.WithLabelValues(stageName, "missing").Inc() }
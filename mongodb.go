@@ -28,4 +28,9 @@ func GetDatabaseHandle(config Configuration) (db *DB, err error) {
 	}
 
 	return &DB{Database: client, DBName:config.Database.Database}, nil
-}
\ No newline at end of file
+}
+
+// Close disconnects from mongo
+func (db *DB) Close() error {
+	return db.Database.Disconnect(context.Background())
+}
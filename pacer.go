@@ -0,0 +1,188 @@
+package higgs
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRequestsPerSecond = 100
+	defaultLatencyTarget     = 2 * time.Second
+)
+
+type (
+	// pacer is shared by every stage so ESI sees one steady client rather than one per stage. Every request waits
+	// for a token from the bucket, then for a slot under the concurrency limit.
+	pacer struct {
+		bucket *tokenBucket
+		limit  *adaptiveLimit
+	}
+
+	// tokenBucket lets through rate requests a second on average, and up to burst at once after being idle
+	tokenBucket struct {
+		mu     sync.Mutex
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+
+	// adaptiveLimit is how many requests can be in flight at once. It grows by one every time that many requests
+	// come back healthy, and halves when ESI is slow or erroring, at most once every target so one bad wave of
+	// requests only counts once.
+	adaptiveLimit struct {
+		mu       sync.Mutex
+		limit    float64
+		min      float64
+		max      float64
+		inflight int
+		target   time.Duration
+		// changed is closed and replaced whenever a slot frees up or the limit changes
+		changed      chan struct{}
+		lastDecrease time.Time
+	}
+)
+
+// newPacer works out the pacing from the config. A negative RequestsPerSecond turns the rate limit off,
+// concurrency is always adaptive.
+func newPacer(web HttpConfig, maxRoutines int) *pacer {
+	p := &pacer{}
+
+	rate := web.RequestsPerSecond
+	if rate == 0 {
+		rate = defaultRequestsPerSecond
+	}
+	if rate > 0 {
+		burst := web.Burst
+		if burst < 1 {
+			burst = int(math.Max(1, rate))
+		}
+		p.bucket = newTokenBucket(rate, burst)
+	}
+
+	if maxRoutines < 1 {
+		maxRoutines = 1
+	}
+	max := web.MaxConcurrency
+	if max < 1 {
+		// The biggest stages run twice MaxRoutines
+		max = maxRoutines * 2
+	}
+	target := web.LatencyTarget
+	if target <= 0 {
+		target = defaultLatencyTarget
+	}
+	p.limit = newAdaptiveLimit(maxRoutines, max, target)
+
+	return p
+}
+
+// acquire waits until a request can be made. If it returns nil, release has to be called once the request is done.
+func (p *pacer) acquire(ctx context.Context) error {
+	if p.bucket != nil {
+		if err := p.bucket.wait(ctx); err != nil {
+			return err
+		}
+	}
+	return p.limit.acquire(ctx)
+}
+
+// release gives back the slot taken by acquire. status is 0 if there was no response, and a request that ctx
+// gave up on says nothing about how ESI is doing.
+func (p *pacer) release(ctx context.Context, took time.Duration, status int, err error) {
+	p.limit.release(took, status, err, ctx.Err() != nil)
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes a token, waiting for one to be added if there arent any. Tokens are taken in the order they are
+// asked for, going negative while there are people waiting.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give the token back so whoever is behind us doesnt wait for it
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func newAdaptiveLimit(start, max int, target time.Duration) *adaptiveLimit {
+	if start > max {
+		start = max
+	}
+	l := &adaptiveLimit{limit: float64(start), min: 1, max: float64(max), target: target, changed: make(chan struct{})}
+	observeConcurrencyLimit(l.limit)
+	return l
+}
+
+func (l *adaptiveLimit) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inflight < int(l.limit) {
+			l.inflight++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *adaptiveLimit) release(took time.Duration, status int, err error, gaveUp bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+
+	switch {
+	case gaveUp:
+	case err != nil, status >= 500, status == 420, status == http.StatusTooManyRequests, took > l.target:
+		now := time.Now()
+		if now.Sub(l.lastDecrease) >= l.target {
+			l.limit = math.Max(l.min, math.Floor(l.limit/2))
+			l.lastDecrease = now
+		}
+	default:
+		l.limit = math.Min(l.max, l.limit+1/l.limit)
+	}
+	observeConcurrencyLimit(l.limit)
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// current is the limit rounded down, as acquire sees it
+func (l *adaptiveLimit) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
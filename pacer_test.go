@@ -0,0 +1,90 @@
+package higgs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(200, 5)
+	ctx := context.Background()
+
+	// The burst goes straight away, the other 20 at 200 a second
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		if err := bucket.wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if took := time.Since(start); took < 90*time.Millisecond || took > time.Second {
+		t.Errorf("25 requests took %v, want about 100ms", took)
+	}
+
+	// Someone giving up doesnt hold up whoever is next
+	bucket = newTokenBucket(1, 1)
+	bucket.wait(ctx)
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := bucket.wait(cancelled); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want the deadline waiting on an empty bucket, got %v", err)
+	}
+	if bucket.tokens < -1e-3 {
+		t.Errorf("bucket kept the token of a cancelled wait, has %v", bucket.tokens)
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	limit := newAdaptiveLimit(4, 8, 50*time.Millisecond)
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		if err := limit.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := limit.acquire(full); err == nil {
+		t.Fatal("acquired a fifth slot with a limit of 4")
+	}
+
+	// A slot freeing up lets someone waiting through
+	got := make(chan error)
+	go func() { got <- limit.acquire(ctx) }()
+	limit.release(time.Millisecond, 200, nil, false)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+
+	// Healthy responses grow it, up to the max
+	for i := 0; i < 100; i++ {
+		limit.release(time.Millisecond, 200, nil, false)
+		limit.acquire(ctx)
+	}
+	if n := limit.current(); n != 8 {
+		t.Errorf("limit is %v after lots of healthy responses, want the max of 8", n)
+	}
+
+	// A 503 halves it, the rest of the same wave doesnt
+	limit.release(time.Millisecond, 503, nil, false)
+	limit.release(time.Millisecond, 502, nil, false)
+	if n := limit.current(); n != 4 {
+		t.Errorf("limit is %v after a wave of 5xx, want 4", n)
+	}
+
+	// Once the wave is over, being slow halves it again
+	time.Sleep(60 * time.Millisecond)
+	limit.release(time.Second, 200, nil, false)
+	if n := limit.current(); n != 2 {
+		t.Errorf("limit is %v after a slow response, want 2", n)
+	}
+
+	// Requests we gave up on dont count either way
+	time.Sleep(60 * time.Millisecond)
+	limit.release(time.Second, 0, context.Canceled, true)
+	if n := limit.current(); n != 2 {
+		t.Errorf("limit is %v after giving up on a request, want 2", n)
+	}
+}
@@ -0,0 +1,117 @@
+package higgs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// MakeESIGetPages fetches every page of one of ESI's paged lists. pageURL has a %v where the page number goes.
+// The first page says in X-Pages how many there are, the rest are then fetched at once. If any page fails, or the
+// number of pages changes part way through because ESI's cache rolled over, the whole lot fails rather than
+// returning a list with holes in it.
+func (c *Client) MakeESIGetPages(ctx context.Context, pageURL string) ([][]byte, error) {
+	first, header, err := c.getWithRetry(ctx, fmt.Sprintf(pageURL, 1), true)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get page 1")
+	}
+
+	total, err := xPages(header.Get("X-Pages"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "page 1 of %v", fmt.Sprintf(pageURL, 1))
+	}
+
+	pages := make([][]byte, total)
+	pages[0] = first
+	if total == 1 {
+		return pages, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	routines := c.MaxRoutines
+	if routines < 1 {
+		routines = 1
+	}
+	sem := make(chan struct{}, routines)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	for page := 2; page <= total; page++ {
+		page := page
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			body, header, err := c.getWithRetry(ctx, fmt.Sprintf(pageURL, page), true)
+			if err != nil {
+				fail(errors.Wrapf(err, "failed to get page %v of %v", page, total))
+				return
+			}
+			if n, err := xPages(header.Get("X-Pages")); err != nil || n != total {
+				fail(errors.Errorf("page %v of %v says there are %v pages, the list changed while it was being fetched", page, fmt.Sprintf(pageURL, page), header.Get("X-Pages")))
+				return
+			}
+			pages[page-1] = body
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return pages, nil
+}
+
+// xPages reads the X-Pages header, a list that fits on one page doesnt always have it
+func xPages(v string) (int, error) {
+	if v == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, errors.Errorf("bad X-Pages header %q", v)
+	}
+	return n, nil
+}
+
+// getIDPages fetches every page of a paged list of ids
+func getIDPages(ctx context.Context, client *Client, pageURL string) ([]int, error) {
+	pages, err := client.MakeESIGetPages(ctx, pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for i, body := range pages {
+		var page []int
+		if err := decodeESI(fmt.Sprintf(pageURL, i+1), body, &page); err != nil {
+			return nil, err
+		}
+		ids = append(ids, page...)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,92 @@
+package higgs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/podded/higgs/esitest"
+)
+
+const testTypesURL = "/v1/universe/types/?datasource=tranquility&page=%v"
+
+func TestMakeESIGetPages(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	u := esi.Universe()
+	client := memoryClient(esi, NewMemoryStore())
+	ctx := context.Background()
+
+	pages, err := client.MakeESIGetPages(ctx, client.esiURL(testTypesURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != u.Pages("types") || len(pages) < 2 {
+		t.Errorf("got %v pages of types, want %v", len(pages), u.Pages("types"))
+	}
+	// Only the pages there are get asked for, never one past the end
+	if n := esi.Requests("/universe/types/"); n != u.Pages("types") {
+		t.Errorf("asked for %v pages, want %v", n, u.Pages("types"))
+	}
+
+	ids, err := getIDPages(ctx, client, client.esiURL(testTypesURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := u.IDs("types")
+	sort.Ints(ids)
+	sort.Ints(want)
+	if len(ids) != len(want) {
+		t.Fatalf("got types %v, want %v", ids, want)
+	}
+	for i := range ids {
+		if ids[i] != want[i] {
+			t.Fatalf("got types %v, want %v", ids, want)
+		}
+	}
+
+	// A list that fits on one page
+	pages, err = client.MakeESIGetPages(ctx, client.esiURL("/v1/universe/categories/?datasource=tranquility&page=%v"))
+	if err != nil || len(pages) != 1 {
+		t.Errorf("got %v pages of categories, %v", len(pages), err)
+	}
+}
+
+func TestMakeESIGetPagesFails(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	client := memoryClient(esi, NewMemoryStore())
+	client.Retry.Attempts = 2
+
+	// Losing a page in the middle fails the whole list rather than leaving a hole in it
+	esi.Inject(esitest.Fault{Path: "/universe/types/", Page: 2, Status: http.StatusServiceUnavailable})
+	_, err := client.MakeESIGetPages(context.Background(), client.esiURL(testTypesURL))
+	var serverError *ServerError
+	if !errors.As(err, &serverError) || !strings.Contains(err.Error(), "page 2") {
+		t.Errorf("want a ServerError for page 2, got %v", err)
+	}
+
+	// and fails the stage
+	err = populate(context.Background(), client, PopulateOptions{Only: []string{"types"}}, stages)
+	var stageErrs StageErrors
+	if !errors.As(err, &stageErrs) || stageErrs["types"] == nil {
+		t.Errorf("want the types stage to fail, got %v", err)
+	}
+	if n, _ := client.Store.Count("types"); n != 0 {
+		t.Errorf("stored %v types from a partial list", n)
+	}
+
+	for _, v := range []string{"", "1", "12"} {
+		if _, err := xPages(v); err != nil {
+			t.Errorf("X-Pages %q: %v", v, err)
+		}
+	}
+	for _, v := range []string{"0", "-1", "lots"} {
+		if _, err := xPages(v); err == nil {
+			t.Errorf("X-Pages %q should be an error", v)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package higgs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The states a stage goes through in the progress tracker
+const (
+	StagePending = "pending"
+	StageRunning = "running"
+	StageDone    = "done"
+	StageFailed  = "failed"
+	StageSkipped = "skipped"
+)
+
+// progressWidth is how many characters the bar in the terminal display takes up
+const progressWidth = 20
+
+type (
+	// StageProgress is how far one stage has got. Rate is items a second and ETA is a guess
+	// based on it, both are zero until there is something to go on.
+	StageProgress struct {
+		Stage    string        `json:"stage" bson:"stage"`
+		State    string        `json:"state" bson:"state"`
+		Total    int           `json:"total" bson:"total"`
+		Done     int           `json:"done" bson:"done"`
+		Failed   int           `json:"failed" bson:"failed"`
+		Started  time.Time     `json:"started,omitempty" bson:"started,omitempty"`
+		Finished time.Time     `json:"finished,omitempty" bson:"finished,omitempty"`
+		Rate     float64       `json:"rate" bson:"rate"`
+		ETA      time.Duration `json:"-" bson:"-"`
+		// ETASeconds is ETA for anything reading the json
+		ETASeconds int    `json:"eta_seconds" bson:"eta_seconds"`
+		Error      string `json:"error,omitempty" bson:"error,omitempty"`
+	}
+
+	// progressTracker holds the progress of the current run, there is only ever one per process
+	progressTracker struct {
+		mu     sync.Mutex
+		order  []string
+		stages map[string]*StageProgress
+	}
+
+	// progressDisplay is what WatchProgress has drawn, so logging can get it out of the way first
+	progressDisplay struct {
+		mu    sync.Mutex
+		w     io.Writer
+		drawn int
+	}
+
+	// displayLogWriter is where logs go, it clears any display that would otherwise be drawn over them
+	displayLogWriter struct {
+		w io.Writer
+	}
+)
+
+var (
+	progress = &progressTracker{stages: make(map[string]*StageProgress)}
+	display  = &progressDisplay{}
+)
+
+// Progress returns a copy of how far each stage of the current, or last, run has got, in stage order
+func Progress() []StageProgress {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	now := time.Now()
+	out := make([]StageProgress, 0, len(progress.order))
+	for _, name := range progress.order {
+		sp := *progress.stages[name]
+		sp.Rate, sp.ETA = estimate(sp, now)
+		sp.ETASeconds = int(sp.ETA / time.Second)
+		out = append(out, sp)
+	}
+	return out
+}
+
+// ProgressHandler serves the current progress as json
+func ProgressHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(Progress())
+	})
+}
+
+// WatchProgress redraws the progress of every stage to w, a terminal, until ctx is done. Anything logged
+// while it is running is printed above the display rather than drawn over.
+func WatchProgress(ctx context.Context, w io.Writer, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	display.mu.Lock()
+	display.w, display.drawn = w, 0
+	display.mu.Unlock()
+
+	draw := func() {
+		stages := Progress()
+
+		display.mu.Lock()
+		defer display.mu.Unlock()
+		display.clear()
+		for _, sp := range stages {
+			fmt.Fprintf(w, "\033[2K%v\n", formatProgress(sp, true))
+		}
+		display.drawn = len(stages)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			draw()
+			// Leave the last of it on the screen
+			display.mu.Lock()
+			display.w, display.drawn = nil, 0
+			display.mu.Unlock()
+			return
+		case <-ticker.C:
+			draw()
+		}
+	}
+}
+
+// clear backs up over the display and wipes it, so whatever is written next starts where it was. Holds mu.
+func (d *progressDisplay) clear() {
+	if d.w != nil && d.drawn > 0 {
+		fmt.Fprintf(d.w, "\033[%dA\033[J", d.drawn)
+	}
+	d.drawn = 0
+}
+
+// Write clears the display before writing p, the next redraw puts it back underneath
+func (l displayLogWriter) Write(p []byte) (int, error) {
+	display.mu.Lock()
+	defer display.mu.Unlock()
+	display.clear()
+	return l.w.Write(p)
+}
+
+// LogProgress logs a line for every running stage each time every passes, until ctx is done.
+// It is what to use when nobody is watching a terminal.
+func LogProgress(ctx context.Context, logger *slog.Logger, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, sp := range Progress() {
+				if sp.State != StageRunning {
+					continue
+				}
+				logger.Info("Progress", "stage", sp.Stage, "done", sp.Done, "failed", sp.Failed, "total", sp.Total,
+					"rate", fmt.Sprintf("%.1f/s", sp.Rate), "eta", sp.ETA.String())
+			}
+		}
+	}
+}
+
+func formatProgress(sp StageProgress, bar bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-16s %-8s", sp.Stage, sp.State)
+
+	if bar {
+		filled := 0
+		if sp.Total > 0 {
+			filled = (sp.Done + sp.Failed) * progressWidth / sp.Total
+		}
+		if filled > progressWidth {
+			filled = progressWidth
+		}
+		fmt.Fprintf(&b, " [%v%v]", strings.Repeat("#", filled), strings.Repeat(" ", progressWidth-filled))
+	}
+
+	fmt.Fprintf(&b, " %v/%v", sp.Done, sp.Total)
+	if sp.Failed > 0 {
+		fmt.Fprintf(&b, " (%v failed)", sp.Failed)
+	}
+	if sp.State == StageRunning && sp.Rate > 0 {
+		fmt.Fprintf(&b, " %.1f/s eta %v", sp.Rate, sp.ETA)
+	}
+	return b.String()
+}
+
+// estimate works out the rate and time left for a stage as of now
+func estimate(sp StageProgress, now time.Time) (float64, time.Duration) {
+	if sp.Started.IsZero() {
+		return 0, 0
+	}
+	end := now
+	if !sp.Finished.IsZero() {
+		end = sp.Finished
+	}
+	elapsed := end.Sub(sp.Started).Seconds()
+	handled := sp.Done + sp.Failed
+	if elapsed <= 0 || handled == 0 {
+		return 0, 0
+	}
+
+	rate := float64(handled) / elapsed
+	left := sp.Total - handled
+	if left <= 0 || !sp.Finished.IsZero() {
+		return rate, 0
+	}
+	return rate, time.Duration(float64(left) / rate * float64(time.Second)).Round(time.Second)
+}
+
+// progressReset starts tracking a new run made up of stages
+func progressReset(stages ...string) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.order = append([]string(nil), stages...)
+	progress.stages = make(map[string]*StageProgress, len(stages))
+	for _, name := range stages {
+		progress.stages[name] = &StageProgress{Stage: name, State: StagePending}
+	}
+}
+
+// progressUpdate runs fn against a stage, adding the stage if it wasnt in the reset
+func progressUpdate(stageName string, fn func(sp *StageProgress)) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	sp, ok := progress.stages[stageName]
+	if !ok {
+		sp = &StageProgress{Stage: stageName, State: StagePending}
+		progress.stages[stageName] = sp
+		progress.order = append(progress.order, stageName)
+	}
+	fn(sp)
+}
+
+func progressStart(stageName string) {
+	progressUpdate(stageName, func(sp *StageProgress) {
+		sp.State = StageRunning
+		sp.Started = time.Now()
+	})
+}
+
+func progressFinish(stageName string, err error) {
+	progressUpdate(stageName, func(sp *StageProgress) {
+		sp.State = StageDone
+		sp.Finished = time.Now()
+		if err != nil {
+			sp.State = StageFailed
+			sp.Error = err.Error()
+		}
+	})
+}
+
+func progressSkip(stageName string, err error) {
+	progressUpdate(stageName, func(sp *StageProgress) {
+		sp.State = StageSkipped
+		if err != nil {
+			sp.Error = err.Error()
+		}
+	})
+}
+
+func progressAddTotal(stageName string, n int) {
+	progressUpdate(stageName, func(sp *StageProgress) { sp.Total += n })
+}
+
+func progressDone(stageName string) {
+	progressUpdate(stageName, func(sp *StageProgress) { sp.Done++ })
+}
+
+func progressFailed(stageName string) {
+	progressUpdate(stageName, func(sp *StageProgress) { sp.Failed++ })
+}
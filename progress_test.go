@@ -0,0 +1,45 @@
+package higgs
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogsClearTheProgressDisplay(t *testing.T) {
+	progressReset("regions", "types")
+
+	// A cancelled watch draws once and leaves it there
+	var term bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	WatchProgress(ctx, &term, time.Hour)
+	if got := strings.Count(term.String(), "\n"); got != 2 || strings.Contains(term.String(), "\033[J") {
+		t.Errorf("want two lines drawn, got %q", term.String())
+	}
+	if display.w != nil {
+		t.Errorf("display still set once watching stopped")
+	}
+
+	// Mid redraw a log line backs up over the display first, then the next redraw goes below it
+	term.Reset()
+	display.w, display.drawn = &term, 2
+	defer func() { display.w, display.drawn = nil, 0 }()
+
+	logger, err := newLogger(displayLogWriter{w: &term}, AppConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("first")
+	logger.Info("second")
+
+	out := term.String()
+	if !strings.HasPrefix(out, "\033[2A\033[J") || strings.Count(out, "\033[") != 2 {
+		t.Errorf("want the display cleared once before logging, got %q", out)
+	}
+	if !strings.Contains(out, "msg=first") || !strings.Contains(out, "msg=second") {
+		t.Errorf("log lines missing from %q", out)
+	}
+}
@@ -0,0 +1,282 @@
+package higgs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// Exchange is one recorded request and what came back for it. Error is set instead of a response if the
+	// request never got one, eg it timed out.
+	Exchange struct {
+		Method   string      `json:"method"`
+		URL      string      `json:"url"`
+		Status   int         `json:"status,omitempty"`
+		Header   http.Header `json:"header,omitempty"`
+		Body     []byte      `json:"body,omitempty"`
+		Error    string      `json:"error,omitempty"`
+		Took     string      `json:"took"`
+		Recorded time.Time   `json:"recorded"`
+	}
+
+	// Recorder is an http.RoundTripper that passes requests on to Base and writes each exchange to an archive,
+	// a gzipped file of one json Exchange per line. Each is flushed as it happens so a run that dies part way
+	// through still leaves everything up to that point.
+	Recorder struct {
+		Base http.RoundTripper
+		// Match picks which requests are recorded, nil records all of them
+		Match func(*http.Request) bool
+
+		mu  sync.Mutex
+		f   *os.File
+		gz  *gzip.Writer
+		enc *json.Encoder
+	}
+
+	// Replayer is an http.RoundTripper that answers from an archive written by a Recorder instead of the network.
+	// Requests are matched on method, path and query, whatever host they were recorded against. If the same
+	// request was recorded more than once the responses are given back in the order they were recorded, the
+	// last one repeating once they run out, so a run that retried gets the same failures it did first time.
+	Replayer struct {
+		// Base is used for requests Match doesnt pick, nil fails them
+		Base  http.RoundTripper
+		Match func(*http.Request) bool
+
+		mu        sync.Mutex
+		exchanges map[string][]Exchange
+		served    map[string]int
+	}
+)
+
+// NewRecorder creates the archive at path, replacing anything already there
+func NewRecorder(path string, base http.RoundTripper) (*Recorder, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the recording")
+	}
+
+	gz := gzip.NewWriter(f)
+	return &Recorder{Base: base, f: f, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if r.Match != nil && !r.Match(req) {
+		return r.Base.RoundTrip(req)
+	}
+
+	start := time.Now()
+	res, err := r.Base.RoundTrip(req)
+
+	ex := Exchange{Method: req.Method, URL: req.URL.String(), Recorded: start.UTC()}
+	if err != nil {
+		ex.Error = err.Error()
+		ex.Took = time.Since(start).String()
+		r.write(ex)
+		return nil, err
+	}
+
+	// Read it all now so it can be both recorded and handed back
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	ex.Took = time.Since(start).String()
+	if err != nil {
+		ex.Error = err.Error()
+		r.write(ex)
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	ex.Status = res.StatusCode
+	ex.Header = res.Header
+	ex.Body = body
+	r.write(ex)
+
+	return res, nil
+}
+
+// write adds ex to the archive. A recording that cant be written to shouldnt stop the run it is recording,
+// so failures are only complained about.
+func (r *Recorder) write(ex Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.enc == nil {
+		return
+	}
+	err := r.enc.Encode(ex)
+	if err == nil {
+		err = r.gz.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to record %v %v: %v\n", ex.Method, ex.URL, err)
+	}
+}
+
+// Close finishes the archive, anything recorded after is passed through without being written
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.enc == nil {
+		return nil
+	}
+	r.enc = nil
+
+	err := r.gz.Close()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrap(err, "failed to finish the recording")
+}
+
+// LoadReplay reads an archive written by a Recorder
+func LoadReplay(path string) (*Replayer, error) {
+	exchanges, err := ReadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replayer{exchanges: make(map[string][]Exchange), served: make(map[string]int)}
+	for _, ex := range exchanges {
+		key, err := replayKey(ex.Method, ex.URL)
+		if err != nil {
+			return nil, err
+		}
+		r.exchanges[key] = append(r.exchanges[key], ex)
+	}
+
+	return r, nil
+}
+
+// ReadRecording returns every exchange in an archive in the order they were recorded. An archive cut short,
+// because whatever was recording it died, is read up to where it stops.
+func ReadRecording(path string) ([]Exchange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open the recording")
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%v is not a recording", path)
+	}
+	defer gz.Close()
+
+	var exchanges []Exchange
+	scanner := bufio.NewScanner(gz)
+	// Bodies can be big, the types list pages are a good few kb and an error page could be anything
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var ex Exchange
+		if err := json.Unmarshal(scanner.Bytes(), &ex); err != nil {
+			return nil, errors.Wrapf(err, "failed to read exchange %v from the recording", len(exchanges)+1)
+		}
+		exchanges = append(exchanges, ex)
+	}
+	// Each exchange is flushed whole, so one cut short just ends without the gzip footer
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Wrap(err, "failed to read the recording")
+	}
+
+	return exchanges, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if r.Match != nil && !r.Match(req) {
+		if r.Base == nil {
+			return nil, fmt.Errorf("replaying, and %v %v is not something that was recorded", req.Method, req.URL)
+		}
+		return r.Base.RoundTrip(req)
+	}
+
+	key, err := replayKey(req.Method, req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	recorded := r.exchanges[key]
+	n := r.served[key]
+	r.served[key]++
+	r.mu.Unlock()
+
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("no recorded response for %v", key)
+	}
+	if n >= len(recorded) {
+		n = len(recorded) - 1
+	}
+	ex := recorded[n]
+
+	if ex.Error != "" {
+		return nil, fmt.Errorf("replayed: %v", ex.Error)
+	}
+
+	header := ex.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Status, http.StatusText(ex.Status)),
+		StatusCode:    ex.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(ex.Body)),
+		ContentLength: int64(len(ex.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Unplayed counts the requests in the archive that havent been asked for yet, handy for checking a replay
+// went the same way as the recording
+func (r *Replayer) Unplayed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for key, recorded := range r.exchanges {
+		if r.served[key] < len(recorded) {
+			n += len(recorded) - r.served[key]
+		}
+	}
+	return n
+}
+
+// replayKey is what a request is matched on, the query is put in order so it doesnt matter how it was built
+func replayKey(method, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "bad url %q", rawURL)
+	}
+	return method + " " + u.EscapedPath() + "?" + u.Query().Encode(), nil
+}
+
+// matchHost picks out requests to the host of baseURL
+func matchHost(baseURL string) func(*http.Request) bool {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil
+	}
+	return func(req *http.Request) bool {
+		return req.URL.Host == u.Host
+	}
+}
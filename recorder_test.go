@@ -0,0 +1,139 @@
+package higgs_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/podded/higgs"
+	"github.com/podded/higgs/esitest"
+)
+
+func fetch(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %v: %v", url, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+func TestRecordReplay(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	esi.Inject(esitest.Fault{Path: "/universe/moons/", Status: 502, Times: 1})
+
+	path := filepath.Join(t.TempDir(), "esi.jsonl.gz")
+	recorder, err := higgs.NewRecorder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moon := "/v1/universe/moons/40009078/?datasource=tranquility"
+	system := "/latest/universe/systems/30000142/?language=de&datasource=tranquility"
+
+	client := &http.Client{Transport: recorder}
+	var recorded []string
+	for _, path := range []string{moon, moon, system} {
+		_, body := fetch(t, client, esi.URL+path)
+		recorded = append(recorded, body)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	esi.Close()
+
+	exchanges, err := higgs.ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 3 {
+		t.Fatalf("recorded %v exchanges, want 3", len(exchanges))
+	}
+
+	replayer, err := higgs.LoadReplay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: replayer}
+
+	// The server is gone and the host is different, the query is in another order too
+	base := "http://esi.invalid"
+	want := []struct {
+		path   string
+		status int
+	}{
+		{moon, http.StatusBadGateway},
+		{moon, http.StatusOK},
+		{"/latest/universe/systems/30000142/?datasource=tranquility&language=de", http.StatusOK},
+	}
+	for i, w := range want {
+		status, body := fetch(t, client, base+w.path)
+		if status != w.status || body != recorded[i] {
+			t.Errorf("replay %v of %v gave %v %q, want %v %q", i, w.path, status, body, w.status, recorded[i])
+		}
+	}
+	if n := replayer.Unplayed(); n != 0 {
+		t.Errorf("%v exchanges werent replayed", n)
+	}
+
+	// Once they run out the last one repeats
+	if status, _ := fetch(t, client, base+moon); status != http.StatusOK {
+		t.Errorf("moon after the recording ran out returned %v", status)
+	}
+
+	_, err = client.Get(base + "/v1/universe/moons/1/")
+	if err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("want an error for something that wasnt recorded, got %v", err)
+	}
+}
+
+// A run that dies part way through still leaves a recording of everything up to then
+func TestRecordingCutShort(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+
+	path := filepath.Join(t.TempDir(), "esi.jsonl.gz")
+	recorder, err := higgs.NewRecorder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	client := &http.Client{Transport: recorder}
+	fetch(t, client, esi.URL+"/latest/universe/regions/")
+	fetch(t, client, esi.URL+"/latest/universe/regions/10000002/")
+
+	exchanges, err := higgs.ReadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 2 || exchanges[1].Status != http.StatusOK || !strings.Contains(string(exchanges[1].Body), "The Forge") {
+		t.Errorf("read back %+v", exchanges)
+	}
+}
+
+func TestPopulateReplaysRecording(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	config := e2eConfig(t, esi)
+	esi.Inject(esitest.Fault{Path: "/universe/stargates/", Status: 504, Times: 2})
+
+	config.Web.Record = filepath.Join(t.TempDir(), "populate.jsonl.gz")
+	if err := higgs.PopulateStaticData(config); err != nil {
+		t.Fatalf("recorded populate failed: %v", err)
+	}
+	esi.Close()
+
+	config.Web.Replay, config.Web.Record = config.Web.Record, ""
+	if err := higgs.PopulateStaticData(config); err != nil {
+		t.Fatalf("replayed populate failed: %v", err)
+	}
+	assertComplete(t, config, esi.Universe())
+}
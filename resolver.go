@@ -0,0 +1,371 @@
+package higgs
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Categories used to tag resolved names. Where ESI's /universe/ids has an equivalent we use its name.
+const (
+	CategoryRegions        = "regions"
+	CategoryConstellations = "constellations"
+	CategorySystems        = "systems"
+	CategoryStations       = "stations"
+	CategoryTypes          = "inventory_types"
+	CategoryGroups         = "groups"
+	CategoryCategories     = "categories"
+)
+
+// How a search result matched the query, best first
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchFuzzy  = "fuzzy"
+)
+
+type (
+	// Resolver is an offline name <-> id lookup over the static data, loaded once into memory.
+	Resolver struct {
+		entries []resolverEntry
+		byName  map[string][]int
+		byID    map[string]map[int32]int
+	}
+
+	ResolvedName struct {
+		ID       int32  `json:"id"`
+		Name     string `json:"name"`
+		Category string `json:"category"`
+		Match    string `json:"match,omitempty"`
+		Distance int    `json:"distance,omitempty"`
+	}
+
+	// ResolvedIDs is keyed by category in the same shape as ESI's /universe/ids response
+	ResolvedIDs map[string][]ResolvedName
+
+	SearchOptions struct {
+		// Limit the number of results, 0 means no limit
+		Limit int
+		// Only return results from these categories, empty means all of them
+		Categories []string
+		// Allow typo tolerant matches
+		Fuzzy bool
+	}
+
+	resolverEntry struct {
+		id       int32
+		name     string
+		lower    []rune
+		category string
+	}
+)
+
+var resolverCollections = []struct {
+	collection string
+	category   string
+}{
+	{"regions", CategoryRegions},
+	{"constellations", CategoryConstellations},
+	{"solarsystems", CategorySystems},
+	{"stations", CategoryStations},
+	{"types", CategoryTypes},
+	{"groups", CategoryGroups},
+	{"categories", CategoryCategories},
+}
+
+// LoadResolver connects to the database and builds a resolver from whatever static data is in there
+func LoadResolver(config Configuration) (*Resolver, error) {
+	store, err := GetDatabaseHandle(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to database")
+	}
+	defer store.Close()
+
+	return NewResolver(store)
+}
+
+func NewResolver(store Store) (*Resolver, error) {
+	r := &Resolver{
+		byName: make(map[string][]int),
+		byID:   make(map[string]map[int32]int),
+	}
+
+	for _, rc := range resolverCollections {
+		names, err := store.GetNames(rc.collection)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			r.add(rc.category, n.ID, n.Name)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Resolver) add(category string, id int32, name string) {
+	if name == "" {
+		return
+	}
+
+	lower := strings.ToLower(name)
+	r.entries = append(r.entries, resolverEntry{
+		id:       id,
+		name:     name,
+		lower:    []rune(lower),
+		category: category,
+	})
+
+	idx := len(r.entries) - 1
+	r.byName[lower] = append(r.byName[lower], idx)
+	if r.byID[category] == nil {
+		r.byID[category] = make(map[int32]int)
+	}
+	r.byID[category][id] = idx
+}
+
+// Name returns the name for an id within a category, eg Name(CategorySystems, 30000142) is Jita
+func (r *Resolver) Name(category string, id int32) (string, bool) {
+	idx, ok := r.byID[category][id]
+	if !ok {
+		return "", false
+	}
+	return r.entries[idx].name, true
+}
+
+// Lookup returns every entity whose name matches exactly, ignoring case
+func (r *Resolver) Lookup(name string) []ResolvedName {
+	var out []ResolvedName
+	for _, idx := range r.byName[strings.ToLower(strings.TrimSpace(name))] {
+		out = append(out, r.entries[idx].result(MatchExact, 0))
+	}
+	return out
+}
+
+// ResolveIDs is the offline equivalent of ESI's POST /universe/ids. Names that do not match are left out.
+func (r *Resolver) ResolveIDs(names []string) ResolvedIDs {
+	out := ResolvedIDs{}
+	for _, name := range names {
+		for _, res := range r.Lookup(name) {
+			res.Match = ""
+			out[res.Category] = append(out[res.Category], res)
+		}
+	}
+	return out
+}
+
+// Search finds names matching the query exactly, by case-insensitive prefix, and optionally
+// by edit distance. Results come back best match first.
+func (r *Resolver) Search(query string, opts SearchOptions) []ResolvedName {
+	q := []rune(strings.ToLower(strings.TrimSpace(query)))
+	if len(q) == 0 {
+		return nil
+	}
+
+	var wanted map[string]bool
+	if len(opts.Categories) > 0 {
+		wanted = make(map[string]bool)
+		for _, c := range opts.Categories {
+			wanted[c] = true
+		}
+	}
+
+	maxDistance := 0
+	if opts.Fuzzy {
+		maxDistance = fuzzyThreshold(len(q))
+	}
+
+	var out []ResolvedName
+	for _, e := range r.entries {
+		if wanted != nil && !wanted[e.category] {
+			continue
+		}
+
+		switch {
+		case runesEqual(e.lower, q):
+			out = append(out, e.result(MatchExact, 0))
+		case runesHavePrefix(e.lower, q):
+			out = append(out, e.result(MatchPrefix, 0))
+		case maxDistance > 0:
+			// Compare against the whole name and against the start of it so half typed names still match
+			d := boundedDistance(e.lower, q, maxDistance)
+			if len(e.lower) > len(q) {
+				if pd := boundedDistance(e.lower[:len(q)], q, maxDistance); pd < d {
+					d = pd
+				}
+			}
+			if d <= maxDistance {
+				out = append(out, e.result(MatchFuzzy, d))
+			}
+		}
+	}
+
+	rank := map[string]int{MatchExact: 0, MatchPrefix: 1, MatchFuzzy: 2}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if rank[a.Match] != rank[b.Match] {
+			return rank[a.Match] < rank[b.Match]
+		}
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		if len(a.Name) != len(b.Name) {
+			return len(a.Name) < len(b.Name)
+		}
+		return a.Name < b.Name
+	})
+
+	if opts.Limit > 0 && len(out) > opts.Limit {
+		out = out[:opts.Limit]
+	}
+
+	return out
+}
+
+// AutocompleteHandler serves Search over http.
+// GET ?q=jit&limit=10&categories=systems,stations&fuzzy=true
+func (r *Resolver) AutocompleteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := req.URL.Query()
+		opts := SearchOptions{Limit: 10, Fuzzy: true}
+
+		if l := params.Get("limit"); l != "" {
+			limit, err := strconv.Atoi(l)
+			if err != nil || limit < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			opts.Limit = limit
+		}
+		if f := params.Get("fuzzy"); f != "" {
+			fuzzy, err := strconv.ParseBool(f)
+			if err != nil {
+				http.Error(w, "fuzzy must be a boolean", http.StatusBadRequest)
+				return
+			}
+			opts.Fuzzy = fuzzy
+		}
+		if c := params.Get("categories"); c != "" {
+			opts.Categories = strings.Split(c, ",")
+		}
+
+		results := r.Search(params.Get("q"), opts)
+		if results == nil {
+			results = []ResolvedName{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(results)
+	})
+}
+
+func (e resolverEntry) result(match string, distance int) ResolvedName {
+	return ResolvedName{
+		ID:       e.id,
+		Name:     e.name,
+		Category: e.category,
+		Match:    match,
+		Distance: distance,
+	}
+}
+
+// Short queries get less slack, otherwise "Ji" matches half the universe
+func fuzzyThreshold(queryLen int) int {
+	switch {
+	case queryLen <= 2:
+		return 0
+	case queryLen <= 5:
+		return 1
+	case queryLen <= 10:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// boundedDistance is the optimal string alignment distance (levenshtein plus transpositions)
+// between a and b. Anything over max is returned as max+1 so we can bail out early.
+func boundedDistance(a, b []rune, max int) int {
+	if abs(len(a)-len(b)) > max {
+		return max + 1
+	}
+
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < cur[j] {
+				cur[j] = prev2[j-2] + 1
+			}
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	if prev[len(b)] > max {
+		return max + 1
+	}
+	return prev[len(b)]
+}
+
+func runesEqual(a, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	return runesHavePrefix(a, b)
+}
+
+func runesHavePrefix(s, prefix []rune) bool {
+	if len(prefix) > len(s) {
+		return false
+	}
+	for i := range prefix {
+		if s[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,121 @@
+package higgs
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testResolver() *Resolver {
+	r := &Resolver{
+		byName: make(map[string][]int),
+		byID:   make(map[string]map[int32]int),
+	}
+	r.add(CategorySystems, 30000142, "Jita")
+	r.add(CategorySystems, 1, "Jitaen")
+	r.add(CategorySystems, 30002187, "Amarr")
+	r.add(CategorySystems, 30002659, "Dodixie")
+	r.add(CategoryStations, 60003760, "Jita IV - Moon 4 - Caldari Navy Assembly Plant")
+	return r
+}
+
+func TestBoundedDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"", "", 0, 0},
+		{"jita", "jita", 1, 0},
+		{"jita", "jitb", 1, 1},
+		{"jita", "jit", 1, 1},
+		// A swap is one edit not two
+		{"jita", "ijta", 1, 1},
+		{"jita", "jiat", 1, 1},
+		{"kitten", "sitting", 3, 3},
+		// Over the bound comes back as max+1
+		{"kitten", "sitting", 2, 3},
+		{"amarr", "", 2, 3},
+		{"dodixie", "jita", 1, 2},
+		// Optimal string alignment, a transposed pair cant be edited again
+		{"ca", "abc", 3, 3},
+	}
+
+	for _, tt := range tests {
+		if got := boundedDistance([]rune(tt.a), []rune(tt.b), tt.max); got != tt.want {
+			t.Errorf("%q -> %q (max %v): got %v, want %v", tt.a, tt.b, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyThreshold(t *testing.T) {
+	tests := []struct {
+		length int
+		want   int
+	}{
+		{1, 0},
+		{2, 0},
+		{3, 1},
+		{5, 1},
+		{6, 2},
+		{10, 2},
+		{11, 3},
+		{40, 3},
+	}
+
+	for _, tt := range tests {
+		if got := fuzzyThreshold(tt.length); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	const station = "Jita IV - Moon 4 - Caldari Navy Assembly Plant"
+
+	tests := []struct {
+		name  string
+		query string
+		opts  SearchOptions
+		want  []string
+	}{
+		{"exact then prefix by length", "jita", SearchOptions{},
+			[]string{"Jita:exact:0", "Jitaen:prefix:0", station + ":prefix:0"}},
+		{"case and space", "  JITA ", SearchOptions{Limit: 1},
+			[]string{"Jita:exact:0"}},
+		{"limit", "jita", SearchOptions{Limit: 2},
+			[]string{"Jita:exact:0", "Jitaen:prefix:0"}},
+		{"categories", "jita", SearchOptions{Categories: []string{CategoryStations}},
+			[]string{station + ":prefix:0"}},
+		{"fuzzy doesnt change exact results", "jita", SearchOptions{Fuzzy: true},
+			[]string{"Jita:exact:0", "Jitaen:prefix:0", station + ":prefix:0"}},
+		{"no typos without fuzzy", "jtia", SearchOptions{}, nil},
+		// Longer names match on their start
+		{"typo", "jtia", SearchOptions{Fuzzy: true},
+			[]string{"Jita:fuzzy:1", "Jitaen:fuzzy:1", station + ":fuzzy:1"}},
+		{"prefix before fuzzy", "amar", SearchOptions{Fuzzy: true},
+			[]string{"Amarr:prefix:0"}},
+		{"empty", "  ", SearchOptions{Fuzzy: true}, nil},
+		// Two letters only ever prefix match
+		{"short prefix", "ji", SearchOptions{Fuzzy: true},
+			[]string{"Jita:prefix:0", "Jitaen:prefix:0", station + ":prefix:0"}},
+		{"short typo", "jx", SearchOptions{Fuzzy: true}, nil},
+		// Up to five letters allow one edit
+		{"one edit at five", "amxrr", SearchOptions{Fuzzy: true}, []string{"Amarr:fuzzy:1"}},
+		{"two edits at five", "amxxr", SearchOptions{Fuzzy: true}, nil},
+		// Up to ten allow two
+		{"two edits at seven", "dxdxxie", SearchOptions{Fuzzy: true}, []string{"Dodixie:fuzzy:2"}},
+		{"three edits at seven", "dxdxxxe", SearchOptions{Fuzzy: true}, nil},
+	}
+
+	r := testResolver()
+	for _, tt := range tests {
+		var got []string
+		for _, res := range r.Search(tt.query, tt.opts) {
+			got = append(got, fmt.Sprintf("%v:%v:%v", res.Name, res.Match, res.Distance))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
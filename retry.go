@@ -0,0 +1,112 @@
+package higgs
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryAttempts  = 10
+	defaultRetryBaseDelay = 250 * time.Millisecond
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// RetryPolicy is how hard to try a request. Only errors that might go away are retried, that is no response at
+// all because of the network, a 5xx, or being told to slow down with a 420 or 429. Anything else, like a 404 for
+// something deleted or a request that couldnt be made, fails straight away.
+type RetryPolicy struct {
+	// Attempts is how many times a request is tried in all, defaults to 10
+	Attempts int
+	// BaseDelay is the most to wait before the first retry, doubling each retry after up to MaxDelay. The wait is
+	// picked at random up to that so retries dont all land at once. MaxDelay also caps how long ESI can tell us to
+	// wait for. Defaults to 250ms and 30s
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts < 1 {
+		p.Attempts = defaultRetryAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	return p
+}
+
+// retryable is whether a request that got status, or err if there was no response, is worth trying again
+func retryable(status int, err error) bool {
+	if err != nil {
+		return isNetworkError(err)
+	}
+	return status == 420 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// isNetworkError is whether err is from the connection, like a timeout or a reset, rather than the request being
+// one that cant be made at all. The http client wraps everything in a *url.Error, which is a net.Error itself,
+// so it is what is inside that counts.
+func isNetworkError(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// delay is how long to wait before retrying after attempt, the first being 1. The server saying how long to wait
+// wins over the backoff, up to MaxDelay.
+func (p RetryPolicy) delay(attempt, status int, header http.Header) time.Duration {
+	if wait, ok := retryAfter(status, header); ok {
+		if wait > p.MaxDelay {
+			wait = p.MaxDelay
+		}
+		return wait
+	}
+
+	backoff := p.MaxDelay
+	if shift := uint(attempt - 1); shift < 32 && p.BaseDelay<<shift < p.MaxDelay {
+		backoff = p.BaseDelay << shift
+	}
+	return time.Duration(rand.Int63n(int64(backoff))) + 1
+}
+
+// retryAfter reads Retry-After, in seconds or as a date, or for a 420 when ESI's error limit resets
+func retryAfter(status int, header http.Header) (time.Duration, bool) {
+	if header == nil {
+		return 0, false
+	}
+
+	if v := header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			wait := time.Until(at)
+			if wait < 0 {
+				wait = 0
+			}
+			return wait, true
+		}
+	}
+
+	if status == 420 {
+		if secs, err := strconv.Atoi(header.Get("X-Esi-Error-Limit-Reset")); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,139 @@
+package higgs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/podded/higgs/esitest"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	defer esi.Close()
+	client := memoryClient(esi, NewMemoryStore())
+	client.Retry.Attempts = 4
+	ctx := context.Background()
+
+	get := func(path string) ([]byte, error) {
+		return client.MakeESIGetContext(ctx, client.esiURL("/latest"+path+"?datasource=tranquility"))
+	}
+
+	// Something deleted isnt going to come back
+	esi.Inject(esitest.Fault{Path: "/universe/moons/40009078/", Status: http.StatusNotFound})
+	_, err := get("/universe/moons/40009078/")
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.Status != http.StatusNotFound || reqErr.Attempts != 1 {
+		t.Errorf("want a 404 after 1 attempt, got %v", err)
+	}
+	if n := esi.Requests("/universe/moons/40009078/"); n != 1 {
+		t.Errorf("404 was asked for %v times", n)
+	}
+	if err != nil && !strings.Contains(err.Error(), "/universe/moons/40009078/") {
+		t.Errorf("error doesnt say what it was fetching: %v", err)
+	}
+
+	// A blip is retried through
+	esi.Inject(esitest.Fault{Path: "/universe/planets/", Status: http.StatusBadGateway, Times: 2})
+	if _, err := get("/universe/planets/40009077/"); err != nil {
+		t.Errorf("planet after 2 502s: %v", err)
+	}
+	if n := esi.Requests("/universe/planets/40009077/"); n != 3 {
+		t.Errorf("planet was asked for %v times, want 3", n)
+	}
+
+	// An outage runs out of attempts
+	esi.Inject(esitest.Fault{Path: "/universe/stars/", Status: http.StatusServiceUnavailable})
+	_, err = get("/universe/stars/40009076/")
+	if !errors.As(err, &reqErr) || reqErr.Status != http.StatusServiceUnavailable || reqErr.Attempts != 4 {
+		t.Errorf("want a 503 after 4 attempts, got %v", err)
+	}
+
+	// Being told to wait is listened to, up to MaxDelay
+	client.Retry.MaxDelay = 2 * time.Second
+	esi.Inject(esitest.Fault{Path: "/universe/stargates/", Status: http.StatusTooManyRequests, RetryAfter: time.Second, Times: 1})
+	start := time.Now()
+	if _, err := get("/universe/stargates/50001248/"); err != nil {
+		t.Errorf("stargate after a 429: %v", err)
+	}
+	if took := time.Since(start); took < time.Second {
+		t.Errorf("retried a 429 after %v, it said to wait a second", took)
+	}
+
+	// Giving up stops the retries
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	client.Retry = RetryPolicy{Attempts: 100, BaseDelay: time.Second, MaxDelay: time.Second}
+	_, err = client.MakeESIGetContext(cancelled, client.esiURL("/latest/universe/stars/40009076/"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want the deadline once ctx is done, got %v", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}.withDefaults()
+
+	for attempt, most := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second, 80: time.Second} {
+		for i := 0; i < 50; i++ {
+			if d := policy.delay(attempt, http.StatusBadGateway, nil); d <= 0 || d > most {
+				t.Fatalf("delay after attempt %v was %v, want up to %v", attempt, d, most)
+			}
+		}
+	}
+
+	policy.MaxDelay = 10 * time.Second
+	header := http.Header{}
+	header.Set("X-Esi-Error-Limit-Reset", "7")
+	if d := policy.delay(1, 420, header); d != 7*time.Second {
+		t.Errorf("420 waited %v, want until the error limit resets", d)
+	}
+	header.Set("Retry-After", "3")
+	if d := policy.delay(1, http.StatusTooManyRequests, header); d != 3*time.Second {
+		t.Errorf("429 waited %v, want the 3s from Retry-After", d)
+	}
+
+	// However long ESI says, it is only waited for up to MaxDelay
+	header.Set("Retry-After", "3600")
+	if d := policy.delay(1, http.StatusTooManyRequests, header); d != policy.MaxDelay {
+		t.Errorf("429 waited %v, want it capped at %v", d, policy.MaxDelay)
+	}
+	header = http.Header{}
+	header.Set("X-Esi-Error-Limit-Reset", "86400")
+	if d := policy.delay(1, 420, header); d != policy.MaxDelay {
+		t.Errorf("420 waited %v, want it capped at %v", d, policy.MaxDelay)
+	}
+
+	for status, want := range map[int]bool{200: false, 400: false, 403: false, 404: false, 420: true, 429: true, 500: true, 502: true, 504: true} {
+		if got := retryable(status, nil); got != want {
+			t.Errorf("retryable(%v) = %v", status, got)
+		}
+	}
+}
+
+func TestRetryOnlyNetworkErrors(t *testing.T) {
+	esi := esitest.NewServer(nil)
+	client := memoryClient(esi, NewMemoryStore())
+	client.Retry.Attempts = 3
+	ctx := context.Background()
+
+	// A request that cant be made isnt tried again
+	_, err := client.MakeESIGetContext(ctx, client.esiURL("/latest/universe/types/%zz/"))
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.Attempts != 1 {
+		t.Errorf("want a bad url to fail after 1 attempt, got %v", err)
+	}
+	_, err = client.MakeESIGetContext(ctx, "gopher://esi.invalid/latest/universe/types/")
+	if !errors.As(err, &reqErr) || reqErr.Attempts != 1 {
+		t.Errorf("want an unsupported scheme to fail after 1 attempt, got %v", err)
+	}
+
+	// Nobody answering might be fixed by the time it is tried again
+	esi.Close()
+	_, err = client.MakeESIGetContext(ctx, client.esiURL("/latest/universe/types/587/"))
+	if !errors.As(err, &reqErr) || reqErr.Attempts != 3 {
+		t.Errorf("want a refused connection to be tried 3 times, got %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package higgs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The kinds of run that end up in import_runs
+const (
+	RunPopulate       = "populate"
+	RunDelete         = "delete"
+	RunImportSDE      = "import-sde"
+	RunImportIndustry = "import-industry"
+)
+
+// The states a run can be in
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// how often the progress in a running run's document is brought up to date
+const runProgressEvery = 10 * time.Second
+
+// Version is the higgs version recorded against each run, set it with
+// -ldflags "-X github.com/podded/higgs.Version=v1.2.3". If it isnt set the module version is used.
+var Version = ""
+
+type (
+	// ImportRun is the record of one run that changed the static data, kept in import_runs
+	ImportRun struct {
+		ID       primitive.ObjectID `json:"id" bson:"_id"`
+		Kind     string             `json:"kind" bson:"kind"`
+		Status   string             `json:"status" bson:"status"`
+		Started  time.Time          `json:"started" bson:"started"`
+		Finished time.Time          `json:"finished,omitempty" bson:"finished,omitempty"`
+		Version  string             `json:"version" bson:"version"`
+		// Config is what the run was started with, with any passwords taken out
+		Config Configuration `json:"config" bson:"config"`
+		Stages []string      `json:"stages,omitempty" bson:"stages,omitempty"`
+		// Progress is the per stage done/failed/total, kept up to date while the run is going
+		Progress []StageProgress `json:"progress,omitempty" bson:"progress,omitempty"`
+		// Counts is how much is in each collection once the run finished
+		Counts map[string]int64 `json:"counts,omitempty" bson:"counts,omitempty"`
+		// Errors is keyed by stage, or "run" for anything that wasnt down to one stage
+		Errors map[string]string `json:"errors,omitempty" bson:"errors,omitempty"`
+		// SnapshotID identifies the set of entities the run left behind, two runs that end up with the
+		// same ids in every collection have the same snapshot id
+		SnapshotID string `json:"snapshot_id,omitempty" bson:"snapshot_id,omitempty"`
+		// Changes summarises what the run changed, by collection. The changes themselves are in changelogs.
+		// It is empty if nothing changed and missing if there was nothing to compare against.
+		Changes map[string]ChangeCounts `json:"changes,omitempty" bson:"changes"`
+	}
+
+	// runRecorder keeps a run's document up to date while it goes
+	runRecorder struct {
+		client *Client
+		// db is where the run is recorded, nil if the store isnt mongo in which case it isnt
+		db  *DB
+		run ImportRun
+		// previous are the collections copied aside before the run, to diff against once it is done
+		previous []string
+		// events is where to send what changed, kept apart from run.Config as that has the secrets taken out
+		events EventsConfig
+		stop   chan struct{}
+		wg     sync.WaitGroup
+	}
+)
+
+// Took is how long the run took, or has taken so far
+func (r ImportRun) Took() time.Duration {
+	if r.Finished.IsZero() {
+		return time.Since(r.Started)
+	}
+	return r.Finished.Sub(r.Started)
+}
+
+// History returns the most recent runs, newest first
+func History(config Configuration, limit int) ([]ImportRun, error) {
+	store, err := GetDatabaseHandle(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to database")
+	}
+	defer store.Close()
+
+	return store.GetImportRuns(limit)
+}
+
+// GetRun finds a single run by the hex of its id
+func GetRun(config Configuration, id string) (*ImportRun, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%q is not a run id", id)
+	}
+
+	store, err := GetDatabaseHandle(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to database")
+	}
+	defer store.Close()
+
+	return store.GetImportRun(oid)
+}
+
+// startRun records that a run has begun and starts tracking the progress of its stages. Failing to record
+// it is logged rather than stopping the run, the history is there to help not to get in the way.
+func (c *Client) startRun(config Configuration, kind string, stages []string) *runRecorder {
+	progressReset(stages...)
+
+	r := &runRecorder{
+		client: c,
+		run: ImportRun{
+			ID:      primitive.NewObjectID(),
+			Kind:    kind,
+			Status:  RunRunning,
+			Started: time.Now().UTC(),
+			Version: higgsVersion(),
+			Config:  redactConfig(config),
+			Stages:  stages,
+		},
+		events: config.Events,
+		stop:   make(chan struct{}),
+	}
+
+	db, ok := c.db()
+	if !ok {
+		return r
+	}
+	r.db = db
+
+	if err := db.InsertImportRun(context.Background(), r.run); err != nil {
+		c.Log.Warn("Failed to record run", "run", r.run.ID.Hex(), "error", err)
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(runProgressEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				if err := db.UpdateImportRunProgress(context.Background(), r.run.ID, Progress()); err != nil {
+					c.Log.Warn("Failed to update run progress", "run", r.run.ID.Hex(), "error", err)
+				}
+			}
+		}
+	}()
+
+	return r
+}
+
+// finish records how the run went, err being whatever the run returned
+func (r *runRecorder) finish(err error) {
+	close(r.stop)
+	r.wg.Wait()
+
+	if r.db == nil {
+		return
+	}
+
+	run := r.run
+	run.Finished = time.Now().UTC()
+	run.Progress = Progress()
+	run.Status = RunSucceeded
+	if err != nil {
+		run.Status = RunFailed
+		run.Errors = runErrors(err)
+	}
+
+	run.Counts = make(map[string]int64, len(StaticCollections))
+	for _, collection := range StaticCollections {
+		n, cerr := r.client.Store.Count(collection)
+		if cerr != nil {
+			r.client.Log.Warn("Failed to count for run", "run", run.ID.Hex(), "collection", collection, "error", cerr)
+			continue
+		}
+		run.Counts[collection] = n
+	}
+
+	snapshot, serr := snapshotID(r.client.Store)
+	if serr != nil {
+		r.client.Log.Warn("Failed to work out snapshot id", "run", run.ID.Hex(), "error", serr)
+	}
+	run.SnapshotID = snapshot
+
+	if err == nil && len(r.previous) > 0 {
+		changelog, derr := r.client.diffPrevious(r.previous)
+		if derr != nil {
+			r.client.Log.Warn("Failed to work out what the run changed", "run", run.ID.Hex(), "error", derr)
+		} else {
+			run.Changes = changelog.Counts()
+			if cerr := r.db.InsertChangelog(context.Background(), run.ID, changelog); cerr != nil {
+				r.client.Log.Warn("Failed to store the changelog", "run", run.ID.Hex(), "error", cerr)
+			}
+			r.client.publishChanges(context.Background(), r.client.changeSinks(r.events), changelog.Events(run.ID))
+		}
+	}
+	if err != nil && len(r.previous) > 0 && !r.client.staged {
+		// The data may be half replaced, say so rather than diffing it
+		r.client.publishChanges(context.Background(), r.client.changeSinks(r.events), []ChangeEvent{runFailedEvent(run.ID, err)})
+	}
+	// The copies are only there to diff against, whether or not the run got that far
+	if len(r.previous) > 0 {
+		if derr := r.client.dropPrevious(context.Background(), r.previous); derr != nil {
+			r.client.Log.Warn("Failed to drop the copies taken before the run", "run", run.ID.Hex(), "error", derr)
+		}
+	}
+
+	if uerr := r.db.UpdateImportRun(context.Background(), run); uerr != nil {
+		r.client.Log.Warn("Failed to record run", "run", run.ID.Hex(), "error", uerr)
+		return
+	}
+	r.client.Log.Info("Recorded run", "run", run.ID.Hex(), "status", run.Status, "snapshot", run.SnapshotID)
+}
+
+// snapshot copies collections aside before the run replaces them, so finish can say what changed
+func (r *runRecorder) snapshot(collections []string) {
+	if r.db == nil {
+		return
+	}
+	err := r.client.snapshotPrevious(context.Background(), collections)
+	if err != nil {
+		r.client.Log.Warn("Failed to copy collections before the run, there will be no changelog", "run", r.run.ID.Hex(), "error", err)
+		return
+	}
+	r.previous = collections
+}
+
+func runErrors(err error) map[string]string {
+	if stageErrs, ok := errors.Cause(err).(StageErrors); ok {
+		out := make(map[string]string, len(stageErrs))
+		for name, e := range stageErrs {
+			out[name] = e.Error()
+		}
+		return out
+	}
+	return map[string]string{"run": err.Error()}
+}
+
+// snapshotID hashes the ids in every static collection, so it changes when anything is added or removed
+func snapshotID(store Store) (string, error) {
+	h := sha256.New()
+	buf := make([]byte, 4)
+	for _, collection := range StaticCollections {
+		ids, err := store.GetIDs(collection)
+		if err != nil {
+			return "", err
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		h.Write([]byte(collection))
+		for _, id := range ids {
+			binary.BigEndian.PutUint32(buf, uint32(id))
+			h.Write(buf)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+func higgsVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+var userinfoPassword = regexp.MustCompile(`://([^:@/]*):[^@/]*@`)
+
+// redactConfig takes any passwords out of the urls in the config before it is stored
+func redactConfig(config Configuration) Configuration {
+	config.Database.URI = redactURL(config.Database.URI)
+	config.Metrics.PushGateway = redactURL(config.Metrics.PushGateway)
+	config.Tracing.Endpoint = redactURL(config.Tracing.Endpoint)
+	config.Web.Transport.Proxy = redactURL(config.Web.Transport.Proxy)
+
+	webhooks := make([]string, len(config.Events.Webhooks))
+	for i, hook := range config.Events.Webhooks {
+		webhooks[i] = redactURL(hook)
+	}
+	config.Events.Webhooks = webhooks
+	if config.Events.WebhookSecret != "" {
+		config.Events.WebhookSecret = "xxxxx"
+	}
+	return config
+}
+
+func redactURL(s string) string {
+	// Not url.Parse, mongo uris can have a list of hosts which it wont take
+	return userinfoPassword.ReplaceAllString(s, "://$1:xxxxx@")
+}
@@ -0,0 +1,87 @@
+package higgs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// A Monday
+	monday := time.Date(2024, 1, 15, 10, 7, 30, 0, time.UTC)
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2024, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", monday, at(1, 15, 10, 8)},
+		{"*/15 * * * *", monday, at(1, 15, 10, 15)},
+		// Always strictly after, even on the minute
+		{"*/15 * * * *", at(1, 15, 10, 15), at(1, 15, 10, 30)},
+		{"5/20 * * * *", monday, at(1, 15, 10, 25)},
+		{"0,30 * * * *", monday, at(1, 15, 10, 30)},
+		{"0 9-17 * * *", monday, at(1, 15, 11, 0)},
+		{"0 18-22/2 * * *", monday, at(1, 15, 18, 0)},
+		{"30 2 * * *", monday, at(1, 16, 2, 30)},
+		{"0 0 1 * *", monday, at(2, 1, 0, 0)},
+		{"0 0 * 3 *", monday, at(3, 1, 0, 0)},
+		{"0 0 29 2 *", monday, at(2, 29, 0, 0)},
+		{"0 0 29 2 *", time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Sunday is 0 or 7
+		{"0 0 * * 0", monday, at(1, 21, 0, 0)},
+		{"0 0 * * 7", monday, at(1, 21, 0, 0)},
+		{"0 0 * * 5-7", monday, at(1, 19, 0, 0)},
+		{"@weekly", monday, at(1, 21, 0, 0)},
+		{"@daily", monday, at(1, 16, 0, 0)},
+		{"@hourly", monday, at(1, 15, 11, 0)},
+		// With both day fields restricted either matching is enough, the Friday comes before the 13th
+		{"0 0 13 * 5", monday, at(1, 19, 0, 0)},
+		// and the 16th before the Friday
+		{"0 0 16 * 5", monday, at(1, 16, 0, 0)},
+		// With only one restricted the other doesnt widen it
+		{"0 0 13 * *", monday, at(2, 13, 0, 0)},
+		{"0 0 * * 5", monday, at(1, 19, 0, 0)},
+		// Times are UTC whatever zone they come in
+		{"0 12 * * *", time.Date(2024, 1, 15, 11, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60)), at(1, 15, 12, 0)},
+		{"@every 90m", monday, monday.Add(90 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if got := s.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q after %v: got %v, want %v", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"0 0 31 2 *",
+		"@every 10s",
+		"@every soon",
+		"@yearly",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q should be an error", spec)
+		}
+	}
+}
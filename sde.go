@@ -0,0 +1,698 @@
+package higgs
+
+import (
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// The SDE is CCP's static data export, a zip of yaml files - https://developers.eveonline.com/resource/resources
+// Everything in here maps it onto the same structs we get from ESI so the rest of higgs doesnt care where
+// the data came from.
+
+type (
+	sdeArchive struct {
+		reader *zip.ReadCloser
+		files  map[string]*zip.File
+	}
+
+	sdeName struct {
+		ItemID   int64  `yaml:"itemID"`
+		ItemName string `yaml:"itemName"`
+	}
+
+	sdeRegion struct {
+		RegionID int       `yaml:"regionID"`
+		Center   []float64 `yaml:"center"`
+	}
+
+	sdeConstellation struct {
+		ConstellationID int       `yaml:"constellationID"`
+		Center          []float64 `yaml:"center"`
+	}
+
+	sdeSystem struct {
+		SolarSystemID int                 `yaml:"solarSystemID"`
+		Center        []float64           `yaml:"center"`
+		Security      float64             `yaml:"security"`
+		SecurityClass string              `yaml:"securityClass"`
+		Star          *sdeStar            `yaml:"star"`
+		Planets       map[int]sdePlanet   `yaml:"planets"`
+		Stargates     map[int]sdeStargate `yaml:"stargates"`
+	}
+
+	sdeStar struct {
+		ID         int   `yaml:"id"`
+		Radius     int64 `yaml:"radius"`
+		TypeID     int   `yaml:"typeID"`
+		Statistics struct {
+			Age           float64 `yaml:"age"`
+			Luminosity    float64 `yaml:"luminosity"`
+			SpectralClass string  `yaml:"spectralClass"`
+			Temperature   float64 `yaml:"temperature"`
+		} `yaml:"statistics"`
+	}
+
+	sdePlanet struct {
+		Position      []float64            `yaml:"position"`
+		TypeID        int32                `yaml:"typeID"`
+		Moons         map[int]sdeCelestial `yaml:"moons"`
+		AsteroidBelts map[int]sdeCelestial `yaml:"asteroidBelts"`
+	}
+
+	sdeCelestial struct {
+		Position []float64 `yaml:"position"`
+		TypeID   int32     `yaml:"typeID"`
+	}
+
+	sdeStargate struct {
+		Destination int32     `yaml:"destination"`
+		Position    []float64 `yaml:"position"`
+		TypeID      int32     `yaml:"typeID"`
+	}
+
+	sdeStation struct {
+		StationID              int32   `yaml:"stationID"`
+		StationName            string  `yaml:"stationName"`
+		SolarSystemID          int32   `yaml:"solarSystemID"`
+		StationTypeID          int32   `yaml:"stationTypeID"`
+		CorporationID          int32   `yaml:"corporationID"`
+		X                      float64 `yaml:"x"`
+		Y                      float64 `yaml:"y"`
+		Z                      float64 `yaml:"z"`
+		ReprocessingEfficiency float32 `yaml:"reprocessingEfficiency"`
+		MaxShipVolumeDockable  float64 `yaml:"maxShipVolumeDockable"`
+		OfficeRentalCost       float64 `yaml:"officeRentalCost"`
+	}
+
+	sdeType struct {
+		GroupID       int32             `yaml:"groupID"`
+		Name          map[string]string `yaml:"name"`
+		Description   map[string]string `yaml:"description"`
+		Capacity      float64           `yaml:"capacity"`
+		GraphicID     int32             `yaml:"graphicID"`
+		IconID        int32             `yaml:"iconID"`
+		MarketGroupID int32             `yaml:"marketGroupID"`
+		Mass          float64           `yaml:"mass"`
+		PortionSize   int32             `yaml:"portionSize"`
+		Published     bool              `yaml:"published"`
+		Radius        float64           `yaml:"radius"`
+		Volume        float64           `yaml:"volume"`
+	}
+
+	sdeTypeDogma struct {
+		DogmaAttributes []struct {
+			AttributeID int32   `yaml:"attributeID"`
+			Value       float64 `yaml:"value"`
+		} `yaml:"dogmaAttributes"`
+		DogmaEffects []struct {
+			EffectID  int32 `yaml:"effectID"`
+			IsDefault bool  `yaml:"isDefault"`
+		} `yaml:"dogmaEffects"`
+	}
+
+	sdeGroup struct {
+		CategoryID int32             `yaml:"categoryID"`
+		Name       map[string]string `yaml:"name"`
+		Published  bool              `yaml:"published"`
+	}
+
+	sdeCategory struct {
+		Name      map[string]string `yaml:"name"`
+		Published bool              `yaml:"published"`
+	}
+
+	// sdeWriter fans inserts out over a handful of goroutines, mongo is the slow part of an SDE import
+	sdeWriter struct {
+		ctx    context.Context
+		client *Client
+		stage  string
+		jobs   chan sdeJob
+		wg     sync.WaitGroup
+
+		mu     sync.Mutex
+		total  int
+		failed int
+	}
+
+	sdeJob struct {
+		what string
+		id   interface{}
+		fn   func() error
+	}
+)
+
+// sdeStages are the stages of an SDE import, in the order they run
+var sdeStages = []string{"sde universe", "sde types", "sde industry", "enrich"}
+
+// ImportSDE replaces the static data with the contents of a local copy of the SDE zip. No ESI calls are made.
+func ImportSDE(config Configuration, sdePath string) error {
+	client, err := newClient(config)
+	if err != nil {
+		return errors.Wrap(err, "failed to create client")
+	}
+	defer client.Close()
+
+	return client.importSDEWithRun(context.Background(), config, sdePath)
+}
+
+// importSDEWithRun is ImportSDE on a client that is already set up, giving up part way through if ctx is done
+func (c *Client) importSDEWithRun(ctx context.Context, config Configuration, sdePath string) error {
+	return c.withLock(ctx, config, RunImportSDE, func(ctx context.Context) error {
+		run := c.startRun(config, RunImportSDE, sdeStages)
+		run.snapshot(StaticCollections)
+		err := c.replace(ctx, StaticCollections, func(ctx context.Context, client *Client) error {
+			return importSDEFile(ctx, client, sdePath)
+		})
+		run.finish(err)
+		return err
+	})
+}
+
+func importSDEFile(ctx context.Context, client *Client, sdePath string) error {
+	err := client.Store.DeleteStaticData()
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete existing static data")
+	}
+
+	ctx, span := tracer.Start(ctx, "import sde")
+
+	err = importSDE(ctx, client, sdePath)
+	if err == nil {
+		err = traceStage(ctx, "enrich", func(ctx context.Context) error { return enrichUniverse(ctx, client) })
+		err = errors.Wrap(err, "Failed to enrich the universe")
+	}
+
+	endSpan(span, err)
+
+	return err
+}
+
+func importSDE(ctx context.Context, client *Client, sdePath string) error {
+	archive, err := openSDE(sdePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	err = traceStage(ctx, "sde universe", func(ctx context.Context) error { return importSDEUniverse(ctx, client, archive) })
+	if err != nil {
+		return errors.Wrap(err, "Failed to import the universe from the SDE")
+	}
+
+	err = traceStage(ctx, "sde types", func(ctx context.Context) error { return importSDETypes(ctx, client, archive) })
+	if err != nil {
+		return errors.Wrap(err, "Failed to import types from the SDE")
+	}
+
+	err = traceStage(ctx, "sde industry", func(ctx context.Context) error { return importSDEIndustry(ctx, client, archive) })
+	if err != nil {
+		return errors.Wrap(err, "Failed to import industry data from the SDE")
+	}
+
+	return nil
+}
+
+func openSDE(sdePath string) (*sdeArchive, error) {
+	reader, err := zip.OpenReader(sdePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open SDE archive")
+	}
+
+	archive := &sdeArchive{reader: reader, files: make(map[string]*zip.File)}
+
+	// The zip normally has everything under sde/ but dont rely on it, key on the path from fsd/ or bsd/ down
+	for _, f := range reader.File {
+		name := f.Name
+		for _, root := range []string{"fsd/", "bsd/"} {
+			if i := strings.Index(name, root); i >= 0 {
+				archive.files[name[i:]] = f
+				break
+			}
+		}
+	}
+
+	return archive, nil
+}
+
+func (a *sdeArchive) Close() error {
+	return a.reader.Close()
+}
+
+// decode unmarshals one file from the archive
+func (a *sdeArchive) decode(name string, out interface{}) error {
+	f, ok := a.files[name]
+	if !ok {
+		return errors.Errorf("SDE archive has no %v", name)
+	}
+
+	return decodeZipYAML(f, out)
+}
+
+// glob returns every file in the archive under dir with the given base name, sorted so parents come first
+func (a *sdeArchive) glob(dir, base string) []string {
+	var out []string
+	for name := range a.files {
+		if strings.HasPrefix(name, dir) && path.Base(name) == base {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func decodeZipYAML(f *zip.File, out interface{}) error {
+	rc, err := f.Open()
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %v", f.Name)
+	}
+	defer rc.Close()
+
+	body, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %v", f.Name)
+	}
+
+	return errors.Wrapf(yaml.Unmarshal(body, out), "failed to decode %v", f.Name)
+}
+
+func newSDEWriter(ctx context.Context, client *Client, stageName string) *sdeWriter {
+	routines := client.MaxRoutines
+	if routines < 1 {
+		routines = 1
+	}
+
+	w := &sdeWriter{ctx: ctx, client: client, stage: stageName, jobs: make(chan sdeJob, routines)}
+	for i := 0; i < routines; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for job := range w.jobs {
+				if ctx.Err() != nil {
+					// Drain whats left so insert never blocks, Wait reports the stop
+					continue
+				}
+				if err := job.fn(); err != nil {
+					w.mu.Lock()
+					w.failed++
+					w.mu.Unlock()
+					progressFailed(w.stage)
+					w.client.Log.Error("Failed to insert", "stage", w.stage, "what", job.what, "entity_id", job.id, "error", err)
+					continue
+				}
+				progressDone(w.stage)
+			}
+		}()
+	}
+	return w
+}
+
+func (w *sdeWriter) insert(what string, id interface{}, fn func() error) {
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	progressAddTotal(w.stage, 1)
+	w.mu.Lock()
+	w.total++
+	w.mu.Unlock()
+	w.jobs <- sdeJob{what: what, id: id, fn: fn}
+}
+
+// Wait waits for every insert to finish, failing if any of them did so a partial import isnt taken for a good one
+func (w *sdeWriter) Wait() error {
+	close(w.jobs)
+	w.wg.Wait()
+
+	if err := w.ctx.Err(); err != nil {
+		return errors.Wrapf(err, "%v stopped part way through", w.stage)
+	}
+	if w.failed > 0 {
+		return errors.Errorf("%v of %v %v inserts failed", w.failed, w.total, w.stage)
+	}
+	return nil
+}
+
+func importSDEUniverse(ctx context.Context, client *Client, archive *sdeArchive) error {
+
+	var names []sdeName
+	err := archive.decode("bsd/invNames.yaml", &names)
+	if err != nil {
+		return err
+	}
+
+	nameOf := make(map[int64]string, len(names))
+	for _, n := range names {
+		nameOf[n.ItemID] = n.ItemName
+	}
+	names = nil
+
+	var stations []sdeStation
+	err = archive.decode("bsd/staStations.yaml", &stations)
+	if err != nil {
+		return err
+	}
+
+	systemStations := make(map[int32][]int)
+	for _, st := range stations {
+		systemStations[st.SolarSystemID] = append(systemStations[st.SolarSystemID], int(st.StationID))
+	}
+
+	// Directories are universe/<space>/<region>/<constellation>/<system>, so parents are found by path
+	regionFiles := archive.glob("fsd/universe/", "region.staticdata")
+	constellationFiles := archive.glob("fsd/universe/", "constellation.staticdata")
+	systemFiles := archive.glob("fsd/universe/", "solarsystem.staticdata")
+
+	client.Log.Info("Importing the universe from the SDE", "regions", len(regionFiles), "constellations", len(constellationFiles), "systems", len(systemFiles))
+
+	regions := make(map[string]*ESIRegion)
+	for _, name := range regionFiles {
+		var r sdeRegion
+		err = archive.decode(name, &r)
+		if err != nil {
+			return err
+		}
+		regions[path.Dir(name)] = &ESIRegion{RegionID: r.RegionID, Name: nameOf[int64(r.RegionID)]}
+	}
+
+	constellations := make(map[string]*ESIConstellation)
+	for _, name := range constellationFiles {
+		var c sdeConstellation
+		err = archive.decode(name, &c)
+		if err != nil {
+			return err
+		}
+
+		dir := path.Dir(name)
+		region, ok := regions[path.Dir(dir)]
+		if !ok {
+			return errors.Errorf("constellation %v has no region", name)
+		}
+
+		constellations[dir] = &ESIConstellation{
+			ConstellationID: c.ConstellationID,
+			Name:            nameOf[int64(c.ConstellationID)],
+			Postion:         sdePosition(c.Center),
+			RegionID:        region.RegionID,
+		}
+		region.Constellations = append(region.Constellations, c.ConstellationID)
+	}
+
+	var systems []sdeSystem
+	systemConstellations := make(map[int]int)
+	gateSystems := make(map[int32]int32)
+	for _, name := range systemFiles {
+		var s sdeSystem
+		err = archive.decode(name, &s)
+		if err != nil {
+			return err
+		}
+
+		constellation, ok := constellations[path.Dir(path.Dir(name))]
+		if !ok {
+			return errors.Errorf("system %v has no constellation", name)
+		}
+		constellation.Systems = append(constellation.Systems, s.SolarSystemID)
+		systemConstellations[s.SolarSystemID] = constellation.ConstellationID
+
+		for gateID := range s.Stargates {
+			gateSystems[int32(gateID)] = int32(s.SolarSystemID)
+		}
+
+		systems = append(systems, s)
+	}
+
+	writer := newSDEWriter(ctx, client, "sde universe")
+
+	for _, r := range regions {
+		region := *r
+		writer.insert("region", region.RegionID, func() error { return client.Store.InsertRegion(ctx, region) })
+	}
+
+	for _, c := range constellations {
+		constellation := *c
+		writer.insert("constellation", constellation.ConstellationID, func() error { return client.Store.InsertConstellation(ctx, constellation) })
+	}
+
+	for i := range systems {
+		if ctx.Err() != nil {
+			return writer.Wait()
+		}
+		s := systems[i]
+		systemID := int32(s.SolarSystemID)
+
+		system := ESISystem{
+			ConstellationID: systemConstellations[s.SolarSystemID],
+			Name:            nameOf[int64(s.SolarSystemID)],
+			Position:        sdePosition(s.Center),
+			SecurityClass:   s.SecurityClass,
+			SecurityStatus:  s.Security,
+			Stations:        systemStations[systemID],
+			SystemID:        s.SolarSystemID,
+		}
+
+		if s.Star != nil {
+			system.StarID = s.Star.ID
+			star := ESIStar{
+				Age:           int64(s.Star.Statistics.Age),
+				Luminosity:    s.Star.Statistics.Luminosity,
+				Name:          nameOf[int64(s.Star.ID)],
+				Radius:        s.Star.Radius,
+				SolarSystemID: s.SolarSystemID,
+				SpectralClass: s.Star.Statistics.SpectralClass,
+				Temperature:   int(s.Star.Statistics.Temperature),
+				TypeID:        s.Star.TypeID,
+				StarID:        s.Star.ID,
+			}
+			writer.insert("star", star.StarID, func() error { return client.Store.InsertStar(ctx, star) })
+		}
+
+		for _, planetID := range sortedKeys(s.Planets) {
+			p := s.Planets[planetID]
+			sysPlanet := ESISystemPlanets{PlanetID: planetID}
+
+			planet := ESIPlanet{
+				Name:     nameOf[int64(planetID)],
+				PlanetID: int32(planetID),
+				Position: sdePosition(p.Position),
+				SystemID: systemID,
+				TypeID:   p.TypeID,
+			}
+			writer.insert("planet", planet.PlanetID, func() error { return client.Store.InsertPlanet(ctx, planet) })
+
+			for _, moonID := range sortedKeys(p.Moons) {
+				sysPlanet.Moons = append(sysPlanet.Moons, moonID)
+				moon := ESIMoon{
+					MoonID:   int32(moonID),
+					Name:     nameOf[int64(moonID)],
+					Position: sdePosition(p.Moons[moonID].Position),
+					SystemID: systemID,
+				}
+				writer.insert("moon", moon.MoonID, func() error { return client.Store.InsertMoon(ctx, moon) })
+			}
+
+			for _, beltID := range sortedKeys(p.AsteroidBelts) {
+				sysPlanet.AsteroidBelts = append(sysPlanet.AsteroidBelts, beltID)
+				belt := ESIAsteroidBelt{
+					BeltID:   int32(beltID),
+					Name:     nameOf[int64(beltID)],
+					Position: sdePosition(p.AsteroidBelts[beltID].Position),
+					SystemID: systemID,
+				}
+				writer.insert("asteroid belt", belt.BeltID, func() error { return client.Store.InsertAsteroidBelt(ctx, belt) })
+			}
+
+			system.Planets = append(system.Planets, sysPlanet)
+		}
+
+		for gateID, g := range s.Stargates {
+			system.Stargates = append(system.Stargates, gateID)
+			gate := ESIStargate{
+				Destination: ESIStargateDestination{StargateID: g.Destination, SystemID: gateSystems[g.Destination]},
+				Name:        nameOf[int64(gateID)],
+				Position:    sdePosition(g.Position),
+				StargateID:  int32(gateID),
+				SystemID:    systemID,
+				TypeID:      g.TypeID,
+			}
+			writer.insert("stargate", gate.StargateID, func() error { return client.Store.InsertStargate(ctx, gate) })
+		}
+		sort.Ints(system.Stargates)
+
+		writer.insert("system", system.SystemID, func() error { return client.Store.InsertSystem(ctx, system) })
+	}
+
+	for i := range stations {
+		if ctx.Err() != nil {
+			return writer.Wait()
+		}
+		st := stations[i]
+		station := ESIStation{
+			MaxDockableShipVolume:  st.MaxShipVolumeDockable,
+			Name:                   st.StationName,
+			OfficeRentalCost:       st.OfficeRentalCost,
+			Owner:                  st.CorporationID,
+			Position:               ESIPosition{X: st.X, Y: st.Y, Z: st.Z},
+			ReprocessingEfficiency: st.ReprocessingEfficiency,
+			StationID:              st.StationID,
+			SystemID:               st.SolarSystemID,
+			TypeID:                 st.StationTypeID,
+		}
+		writer.insert("station", station.StationID, func() error { return client.Store.InsertStation(ctx, station) })
+	}
+
+	return writer.Wait()
+}
+
+func importSDETypes(ctx context.Context, client *Client, archive *sdeArchive) error {
+
+	var categories map[int32]sdeCategory
+	err := archive.decode("fsd/categoryIDs.yaml", &categories)
+	if err != nil {
+		return err
+	}
+
+	var groups map[int32]sdeGroup
+	err = archive.decode("fsd/groupIDs.yaml", &groups)
+	if err != nil {
+		return err
+	}
+
+	var dogma map[int32]sdeTypeDogma
+	err = archive.decode("fsd/typeDogma.yaml", &dogma)
+	if err != nil {
+		return err
+	}
+
+	var types map[int32]sdeType
+	err = archive.decode("fsd/typeIDs.yaml", &types)
+	if err != nil {
+		return err
+	}
+
+	client.Log.Info("Importing types from the SDE", "types", len(types), "groups", len(groups), "categories", len(categories))
+
+	// ESI lists children on the parent, the SDE only has the parent on the child
+	groupTypes := make(map[int32][]int32)
+	for typeID, t := range types {
+		groupTypes[t.GroupID] = append(groupTypes[t.GroupID], typeID)
+	}
+	categoryGroups := make(map[int32][]int32)
+	for groupID, g := range groups {
+		categoryGroups[g.CategoryID] = append(categoryGroups[g.CategoryID], groupID)
+	}
+
+	writer := newSDEWriter(ctx, client, "sde types")
+
+	for categoryID, c := range categories {
+		category := ESICategory{
+			CategoryID: categoryID,
+			Groups:     sortedInt32s(categoryGroups[categoryID]),
+			Name:       c.Name[DefaultLanguage],
+			Published:  c.Published,
+			Names:      client.sdeTranslations(c.Name),
+		}
+		writer.insert("category", categoryID, func() error { return client.Store.InsertCategory(ctx, category) })
+	}
+
+	for groupID, g := range groups {
+		group := ESIGroup{
+			CategoryID: g.CategoryID,
+			GroupID:    groupID,
+			Name:       g.Name[DefaultLanguage],
+			Published:  g.Published,
+			Types:      sortedInt32s(groupTypes[groupID]),
+			Names:      client.sdeTranslations(g.Name),
+		}
+		writer.insert("group", groupID, func() error { return client.Store.InsertGroup(ctx, group) })
+	}
+
+	for typeID, t := range types {
+		if ctx.Err() != nil {
+			return writer.Wait()
+		}
+		typeESI := ESIType{
+			Capacity:      t.Capacity,
+			Description:   t.Description[DefaultLanguage],
+			GraphicID:     t.GraphicID,
+			GroupID:       t.GroupID,
+			IconID:        t.IconID,
+			MarketGroupID: t.MarketGroupID,
+			Mass:          t.Mass,
+			Name:          t.Name[DefaultLanguage],
+			PortionSize:   t.PortionSize,
+			Published:     t.Published,
+			Radius:        t.Radius,
+			TypeID:        typeID,
+			Volume:        t.Volume,
+			Names:         client.sdeTranslations(t.Name),
+			Descriptions:  client.sdeTranslations(t.Description),
+		}
+
+		if d, ok := dogma[typeID]; ok {
+			for _, a := range d.DogmaAttributes {
+				typeESI.DogmaAttributes = append(typeESI.DogmaAttributes, TypeDogmaAttribute{AttributeID: a.AttributeID, Value: a.Value})
+			}
+			for _, e := range d.DogmaEffects {
+				typeESI.DogmaEffects = append(typeESI.DogmaEffects, TypeDogmaEffect{EffectID: e.EffectID, IsDefault: e.IsDefault})
+			}
+		}
+
+		writer.insert("type", typeID, func() error { return client.Store.InsertType(ctx, typeESI) })
+	}
+
+	return writer.Wait()
+}
+
+// sdeTranslations trims the SDE's translations down to the languages we have been asked for, the same
+// as we would have got from fetchLocalized
+func (c *Client) sdeTranslations(all map[string]string) map[string]string {
+	var out map[string]string
+	for _, lang := range c.Languages {
+		if lang == DefaultLanguage {
+			continue
+		}
+		if out == nil {
+			out = map[string]string{DefaultLanguage: all[DefaultLanguage]}
+		}
+		if t, ok := all[lang]; ok {
+			out[lang] = t
+		}
+	}
+	return out
+}
+
+func sdePosition(p []float64) ESIPosition {
+	if len(p) != 3 {
+		return ESIPosition{}
+	}
+	return ESIPosition{X: p[0], Y: p[1], Z: p[2]}
+}
+
+func sortedKeys(m interface{}) []int {
+	var keys []int
+	switch v := m.(type) {
+	case map[int]sdePlanet:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[int]sdeCelestial:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func sortedInt32s(s []int32) []int32 {
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s
+}
@@ -0,0 +1,57 @@
+package higgs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSDEWriterFailsOnAnyInsert(t *testing.T) {
+	client := &Client{Log: slog.New(slog.NewTextHandler(ioutil.Discard, nil)), MaxRoutines: 2}
+
+	w := newSDEWriter(context.Background(), client, "sde test")
+	for i := 0; i < 3; i++ {
+		w.insert("type", i, func() error { return nil })
+	}
+	if err := w.Wait(); err != nil {
+		t.Errorf("every insert worked, got %v", err)
+	}
+
+	w = newSDEWriter(context.Background(), client, "sde test")
+	w.insert("type", 1, func() error { return nil })
+	w.insert("type", 2, func() error { return errors.New("duplicate") })
+	if err := w.Wait(); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("want 1 of 2 inserts failing, got %v", err)
+	}
+}
+
+func TestSDEWriterWithoutRoutines(t *testing.T) {
+	// MaxRoutines unset still gets a worker rather than blocking on the first insert
+	client := &Client{Log: slog.New(slog.NewTextHandler(ioutil.Discard, nil))}
+
+	w := newSDEWriter(context.Background(), client, "sde test")
+	inserted := 0
+	for i := 0; i < 3; i++ {
+		w.insert("type", i, func() error { inserted++; return nil })
+	}
+	if err := w.Wait(); err != nil || inserted != 3 {
+		t.Errorf("got %v inserts, %v", inserted, err)
+	}
+}
+
+func TestSDEWriterStopsWhenCancelled(t *testing.T) {
+	client := &Client{Log: slog.New(slog.NewTextHandler(ioutil.Discard, nil)), MaxRoutines: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newSDEWriter(ctx, client, "sde test")
+	w.insert("type", 1, func() error { cancel(); return nil })
+	for i := 2; i < 100; i++ {
+		w.insert("type", i, func() error { return errors.New("inserted after being cancelled") })
+	}
+	if err := w.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("want cancelled, got %v", err)
+	}
+}
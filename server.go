@@ -0,0 +1,56 @@
+package higgs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Server is the http front end to higgs, mostly for the things people would otherwise have to ask ESI
+type Server struct {
+	mux      *http.ServeMux
+	resolver *Resolver
+}
+
+// NewServer loads everything the endpoints need up front so requests never touch mongo
+func NewServer(config Configuration) (*Server, error) {
+	resolver, err := LoadResolver(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load resolver")
+	}
+
+	s := &Server{mux: http.NewServeMux(), resolver: resolver}
+
+	s.mux.Handle("/autocomplete", resolver.AutocompleteHandler())
+	s.mux.HandleFunc("/ids", s.handleIDs)
+	s.mux.Handle("/metrics", MetricsHandler())
+	s.mux.Handle("/progress", ProgressHandler())
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleIDs is our take on ESI's POST /universe/ids, takes a json list of names
+func (s *Server) handleIDs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var names []string
+	err := json.NewDecoder(r.Body).Decode(&names)
+	if err != nil {
+		http.Error(w, "body must be a json list of names", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.resolver.ResolveIDs(names))
+}
@@ -0,0 +1,223 @@
+package higgs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	// PopulateOptions narrows down what PopulateStaticData does
+	PopulateOptions struct {
+		// Only run the named stages and whatever they depend on, empty means run all of them. See StageNames
+		Only []string
+	}
+
+	stage struct {
+		name        string
+		collections []string
+		universe    bool
+		// needs are stages that have to have run first, selecting this stage selects them too
+		needs []string
+		// after are only for ordering, if they are being run at the same time this waits for them
+		after []string
+		// derived stages are recalculated from the database so get run whenever anything they come after does
+		derived bool
+		run     func(context.Context, *Client) error
+	}
+
+	// StageErrors collects the failure of every stage that failed, or was skipped because something it needs failed
+	StageErrors map[string]error
+)
+
+var universeChildren = []string{"stars", "planets", "moons", "belts", "stargates", "stations"}
+
+// stages in an order that satisfies every dependency, anything without one between them runs concurrently
+var stages = []stage{
+	{name: "regions", collections: []string{"regions"}, universe: true, run: populateRegions},
+	{name: "constellations", collections: []string{"constellations"}, universe: true, run: populateConstellations},
+	{name: "systems", collections: []string{"solarsystems"}, universe: true, run: populateSystems},
+	// All of these work from the systems that are in the database
+	{name: "stars", collections: []string{"stars"}, universe: true, needs: []string{"systems"}, run: populateStars},
+	{name: "planets", collections: []string{"planets"}, universe: true, needs: []string{"systems"}, run: populatePlanets},
+	{name: "moons", collections: []string{"moons"}, universe: true, needs: []string{"systems"}, run: populateMoons},
+	{name: "belts", collections: []string{"asteroid_belts"}, universe: true, needs: []string{"systems"}, run: populateAsteroidBelts},
+	{name: "stargates", collections: []string{"stargates"}, universe: true, needs: []string{"systems"}, run: populateStargates},
+	{name: "stations", collections: []string{"stations"}, universe: true, needs: []string{"systems"}, run: populateStations},
+	{name: "enrich", derived: true, after: append([]string{"regions", "constellations", "systems"}, universeChildren...), run: enrichUniverse},
+	{name: "types", collections: []string{"types"}, run: populateTypes},
+	{name: "groups", collections: []string{"groups"}, run: populateGroups},
+	{name: "categories", collections: []string{"categories"}, run: populateCategories},
+}
+
+func (e StageErrors) Error() string {
+	var msgs []string
+	for _, st := range stages {
+		if err, ok := e[st.name]; ok {
+			msgs = append(msgs, fmt.Sprintf("%v: %v", st.name, err))
+		}
+	}
+	return "stages failed; " + strings.Join(msgs, "; ")
+}
+
+// StageNames lists every stage PopulateStaticData can run
+func StageNames() []string {
+	var names []string
+	for _, st := range stages {
+		names = append(names, st.name)
+	}
+	return names
+}
+
+// PlanPopulate returns the stages that would be run for the given options, including anything pulled in as a
+// dependency, without running anything. They are in an order they could be run one at a time.
+func PlanPopulate(opts PopulateOptions) ([]string, error) {
+	selected, err := selectStages(opts.Only)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, st := range selected {
+		names = append(names, st.name)
+	}
+	return names, nil
+}
+
+func findStage(name string) (stage, bool) {
+	for _, st := range stages {
+		if st.name == name {
+			return st, true
+		}
+	}
+	return stage{}, false
+}
+
+func selectStages(only []string) ([]stage, error) {
+	if len(only) == 0 {
+		return stages, nil
+	}
+
+	wanted := make(map[string]bool)
+	var add func(name string) error
+	add = func(name string) error {
+		if wanted[name] {
+			return nil
+		}
+		st, ok := findStage(name)
+		if !ok {
+			return fmt.Errorf("unknown stage %q, must be one of %v", name, StageNames())
+		}
+		wanted[name] = true
+		for _, need := range st.needs {
+			if err := add(need); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range only {
+		if err := add(name); err != nil {
+			return nil, err
+		}
+	}
+
+	var selected []stage
+	for _, st := range stages {
+		if !wanted[st.name] && st.derived {
+			for _, a := range st.after {
+				if wanted[a] {
+					wanted[st.name] = true
+					break
+				}
+			}
+		}
+		if wanted[st.name] {
+			selected = append(selected, st)
+		}
+	}
+
+	return selected, nil
+}
+
+// runStages runs each stage as soon as everything it has to wait for is finished. A failed stage fails
+// everything that needs it, but the stages that dont carry on.
+func runStages(ctx context.Context, client *Client, selected []stage) error {
+	done := make(map[string]chan struct{})
+	for _, st := range selected {
+		done[st.name] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	failed := StageErrors{}
+
+	names := make([]string, 0, len(selected))
+	for _, st := range selected {
+		names = append(names, st.name)
+	}
+	progressReset(names...)
+
+	var wg sync.WaitGroup
+	for _, s := range selected {
+		st := s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[st.name])
+
+			for _, wait := range append(append([]string{}, st.needs...), st.after...) {
+				ch, ok := done[wait]
+				if !ok {
+					continue
+				}
+				<-ch
+			}
+
+			mu.Lock()
+			for _, need := range st.needs {
+				if _, ok := failed[need]; ok {
+					failed[st.name] = fmt.Errorf("skipped as %v failed", need)
+				}
+			}
+			skipErr, skip := failed[st.name]
+			mu.Unlock()
+
+			if skip {
+				client.Log.Warn("Skipping stage", "stage", st.name, "error", skipErr)
+				progressSkip(st.name, skipErr)
+				_, span := tracer.Start(ctx, "stage "+st.name, trace.WithAttributes(attribute.String("stage", st.name), attribute.Bool("skipped", true)))
+				span.End()
+				return
+			}
+
+			client.Log.Info("Running stage", "stage", st.name)
+			ctx, span := tracer.Start(ctx, "stage "+st.name, trace.WithAttributes(attribute.String("stage", st.name)))
+			start := time.Now()
+			progressStart(st.name)
+			err := st.run(ctx, client)
+			progressFinish(st.name, err)
+			observeStage(st.name, time.Since(start))
+			endSpan(span, err)
+			if err != nil {
+				mu.Lock()
+				failed[st.name] = err
+				mu.Unlock()
+			}
+			client.Log.Info("Finished stage", "stage", st.name, "took", time.Since(start).String())
+		}()
+	}
+
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return failed
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package higgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+)
+
+func TestRunStagesSkipsWhatNeedsAFailedStage(t *testing.T) {
+	client := &Client{Log: slog.New(slog.NewTextHandler(ioutil.Discard, nil))}
+	broken := errors.New("broken")
+
+	// One stage fails with a few things needing it, while others fail and succeed alongside them
+	var selected []stage
+	ran := make(chan string, 20)
+	run := func(name string, err error) func(context.Context, *Client) error {
+		return func(context.Context, *Client) error {
+			ran <- name
+			return err
+		}
+	}
+	selected = append(selected, stage{name: "root", run: run("root", broken)})
+	for i := 0; i < 4; i++ {
+		selected = append(selected, stage{name: fmt.Sprintf("child%v", i), needs: []string{"root"}, run: run("child", nil)})
+		selected = append(selected, stage{name: fmt.Sprintf("other%v", i), run: run("other", broken)})
+	}
+	selected = append(selected,
+		stage{name: "grandchild", needs: []string{"child0"}, run: run("grandchild", nil)},
+		stage{name: "fine", run: run("fine", nil)},
+		stage{name: "after", after: []string{"root"}, run: run("after", nil)},
+	)
+
+	err := runStages(context.Background(), client, selected)
+	close(ran)
+
+	var stageErrs StageErrors
+	if !errors.As(err, &stageErrs) {
+		t.Fatalf("want StageErrors, got %v", err)
+	}
+	// root and the others fail, each child and the grandchild are skipped, fine and after run
+	if len(stageErrs) != 10 {
+		t.Errorf("got %v failed stages, want 10: %v", len(stageErrs), stageErrs)
+	}
+	if stageErrs["root"] != broken || stageErrs["child2"] == nil || stageErrs["grandchild"] == nil {
+		t.Errorf("got %v", stageErrs)
+	}
+	for name := range ran {
+		if name == "child" || name == "grandchild" {
+			t.Errorf("%v ran when something it needs failed", name)
+		}
+	}
+
+	skipped := 0
+	for _, sp := range Progress() {
+		if sp.State == StageSkipped {
+			skipped++
+			if sp.Error == "" {
+				t.Errorf("%v was skipped without saying why", sp.Stage)
+			}
+		}
+	}
+	if skipped != 5 {
+		t.Errorf("%v stages marked skipped, want 5", skipped)
+	}
+}
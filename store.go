@@ -0,0 +1,64 @@
+package higgs
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// errNotMongo is for the things only DB does, asked of some other store
+var errNotMongo = errors.New("only kept when the static data is in mongo")
+
+// Store is somewhere the static data is kept. DB keeps it in mongo and MemoryStore in memory, for tests and for
+// small tools that want the data without running a mongo. Locking, run history and changelogs are only kept by DB.
+type Store interface {
+	DeleteStaticData() error
+	DeleteCollections(names ...string) error
+
+	// Each insert fails if there is already something with the same id, as mongo would
+	InsertRegion(ctx context.Context, region ESIRegion) error
+	InsertConstellation(ctx context.Context, cons ESIConstellation) error
+	InsertSystem(ctx context.Context, system ESISystem) error
+	InsertStar(ctx context.Context, star ESIStar) error
+	InsertPlanet(ctx context.Context, planet ESIPlanet) error
+	InsertMoon(ctx context.Context, moon ESIMoon) error
+	InsertAsteroidBelt(ctx context.Context, belt ESIAsteroidBelt) error
+	InsertStargate(ctx context.Context, gate ESIStargate) error
+	InsertStation(ctx context.Context, station ESIStation) error
+	InsertType(ctx context.Context, typeESI ESIType) error
+	InsertGroup(ctx context.Context, group ESIGroup) error
+	InsertCategory(ctx context.Context, category ESICategory) error
+	InsertBlueprint(ctx context.Context, blueprint Blueprint) error
+	InsertTypeMaterials(ctx context.Context, materials TypeMaterials) error
+
+	UpdateSystemMetadata(ctx context.Context, system ESISystem) error
+	SetRegion(ctx context.Context, collection string, systemIDs []int32, regionID int32, regionName string) error
+
+	GetSystems() ([]ESISystem, error)
+	GetRegions() ([]ESIRegion, error)
+	GetConstellations() ([]ESIConstellation, error)
+	GetStations() ([]ESIStation, error)
+	GetTypes() ([]ESIType, error)
+	GetGroups() ([]ESIGroup, error)
+	GetCategories() ([]ESICategory, error)
+	GetBlueprint(blueprintTypeID int32) (Blueprint, error)
+	GetBlueprintsProducing(typeID int32) ([]Blueprint, error)
+	GetTypeMaterials(typeID int32) (TypeMaterials, error)
+	GetNames(collection string) ([]EntityName, error)
+	GetLocalizedNames(collection, lang string) ([]EntityName, error)
+	GetIDs(collection string) ([]int32, error)
+	Count(collection string) (int64, error)
+	ExportCollection(collection string, w io.Writer) error
+}
+
+// db is the client's store if it is mongo, for the things only DB does
+func (c *Client) db() (*DB, bool) {
+	db, ok := c.Store.(*DB)
+	return db, ok
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,120 @@
+package higgs
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans go to whatever tracer provider is installed globally, which does nothing until SetupTracing is called
+var tracer = otel.Tracer("github.com/podded/higgs")
+
+// SetupTracing installs a global tracer provider exporting spans as the config says. The returned func
+// flushes anything buffered and has to be called before exiting or the tail of the run is lost.
+func SetupTracing(config TracingConfig) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	var exporter sdktrace.SpanExporter
+	var traceFile *os.File
+	var err error
+
+	switch config.Exporter {
+	case "":
+		return noop, nil
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case "file":
+		traceFile, err = os.Create(config.File)
+		if err != nil {
+			return noop, errors.Wrap(err, "failed to create trace file")
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(traceFile))
+	default:
+		return noop, errors.Errorf("unknown trace exporter %q, must be otlp or file", config.Exporter)
+	}
+	if err != nil {
+		return noop, errors.Wrap(err, "failed to create trace exporter")
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "higgs"
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if config.SampleRatio > 0 && config.SampleRatio < 1 {
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if traceFile != nil {
+			if cerr := traceFile.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// endSpan records err on the span, if there is one, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceStage wraps fn in a span for one of the stages that isnt run by runStages
+func traceStage(ctx context.Context, name string, fn func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, "stage "+name, trace.WithAttributes(attribute.String("stage", name)))
+	progressStart(name)
+	err := fn(ctx)
+	progressFinish(name, err)
+	endSpan(span, err)
+	return err
+}
+
+// dbWrite starts a span and a timer for a write to collection. The returned func has to be called when it is done,
+// with the error the write returned so the span records it, usually as defer done(&err).
+func dbWrite(ctx context.Context, op, collection string) (context.Context, func(*error)) {
+	ctx, span := tracer.Start(ctx, "db "+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "mongodb"),
+		attribute.String("db.operation", op),
+		attribute.String("db.collection", collection),
+	))
+	start := time.Now()
+	return ctx, func(err *error) {
+		observeDBWrite(collection, start)
+		endSpan(span, *err)
+	}
+}
@@ -0,0 +1,114 @@
+package higgs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDialTimeout     = 30 * time.Second
+	defaultKeepAlive       = 30 * time.Second
+	defaultIdleConnTimeout = 90 * time.Second
+)
+
+// TransportConfig is how higgs connects. The zero value verifies certificates against the system's CAs, uses
+// HTTP_PROXY and friends from the environment, and speaks HTTP/2 where it can.
+type TransportConfig struct {
+	// CAFile is a PEM bundle of extra CAs to trust, on top of the system's
+	CAFile string
+	// InsecureSkipVerify turns off certificate verification. Only for testing against something with a
+	// self signed certificate
+	InsecureSkipVerify bool
+	// Proxy is the url of a proxy to send everything through, empty uses the environment
+	Proxy string
+	// DisableHTTP2 sticks to HTTP/1.1
+	DisableHTTP2 bool
+	// MaxConnsPerHost defaults to as many requests as can be in flight, web.MaxConcurrency. MaxIdleConnsPerHost
+	// defaults to the same so connections get reused rather than closed between requests
+	MaxConnsPerHost     int
+	MaxIdleConnsPerHost int
+	// KeepAlive is how often to probe idle connections, defaults to 30s. IdleConnTimeout is how long an idle
+	// connection is kept around, defaults to 90s
+	KeepAlive       time.Duration
+	IdleConnTimeout time.Duration
+}
+
+// newTransport builds the transport from the config. Connections are sized off the most requests the pacer lets
+// be in flight at once, which is tied to maxRoutines.
+func newTransport(web HttpConfig, maxRoutines int) (*http.Transport, error) {
+	tc := web.Transport
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: tc.InsecureSkipVerify}
+	if tc.CAFile != "" {
+		pem, err := ioutil.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read web.Transport.CAFile")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %v", tc.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if tc.Proxy != "" {
+		proxyURL, err := url.Parse(tc.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, errors.Errorf("web.Transport.Proxy %q isnt a url", redactURL(tc.Proxy))
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	conns := tc.MaxConnsPerHost
+	if conns < 1 {
+		conns = web.MaxConcurrency
+	}
+	if conns < 1 {
+		conns = maxRoutines * 2
+	}
+	if conns < 1 {
+		conns = 2
+	}
+	idle := tc.MaxIdleConnsPerHost
+	if idle < 1 {
+		idle = conns
+	}
+
+	keepAlive := tc.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = defaultKeepAlive
+	}
+	idleTimeout := tc.IdleConnTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleConnTimeout
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: defaultDialTimeout, KeepAlive: keepAlive}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxConnsPerHost:       conns,
+		MaxIdleConnsPerHost:   idle,
+		IdleConnTimeout:       idleTimeout,
+		// Setting TLSClientConfig turns HTTP/2 off unless it is asked for
+		ForceAttemptHTTP2: !tc.DisableHTTP2,
+	}
+	if tc.DisableHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,156 @@
+package higgs
+
+import (
+	"github.com/pkg/errors"
+)
+
+type (
+	// VerifyReport is the result of checking the static data hangs together
+	VerifyReport struct {
+		Counts map[string]int64 `json:"counts"`
+		// Missing is keyed by collection, holding ids that are referenced from elsewhere but not there
+		Missing map[string][]int32 `json:"missing,omitempty"`
+	}
+
+	// StatusReport is a quick summary of what is in the database
+	StatusReport struct {
+		Database string           `json:"database"`
+		Counts   map[string]int64 `json:"counts"`
+	}
+)
+
+// industryCollections are only filled by the SDE and industry imports, populating from ESI leaves them empty
+var industryCollections = []string{"blueprints", "type_materials"}
+
+// OK is true if nothing is missing and none of the collections the data should have are empty
+func (r VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Empty()) == 0
+}
+
+// Empty lists the collections that should have something in them but dont. Blueprints and type materials only
+// have to be there if either of them is, as only the SDE and industry imports fill them.
+func (r VerifyReport) Empty() []string {
+	industry := false
+	for _, collection := range industryCollections {
+		if r.Counts[collection] > 0 {
+			industry = true
+		}
+	}
+
+	var empty []string
+	for _, collection := range StaticCollections {
+		if r.Counts[collection] > 0 || (!industry && isIndustryCollection(collection)) {
+			continue
+		}
+		empty = append(empty, collection)
+	}
+	return empty
+}
+
+func isIndustryCollection(collection string) bool {
+	for _, c := range industryCollections {
+		if c == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// Status counts what is in each static data collection
+func Status(config Configuration) (*StatusReport, error) {
+	store, err := GetDatabaseHandle(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to database")
+	}
+	defer store.Close()
+
+	report := &StatusReport{Database: store.DBName, Counts: make(map[string]int64)}
+	for _, collection := range StaticCollections {
+		report.Counts[collection], err = store.Count(collection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
+
+// VerifyStaticData walks the universe from regions down checking everything that is referenced was imported
+func VerifyStaticData(config Configuration) (*VerifyReport, error) {
+	store, err := GetDatabaseHandle(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to database")
+	}
+	defer store.Close()
+
+	return VerifyStore(store)
+}
+
+// VerifyStore is VerifyStaticData for any store
+func VerifyStore(store Store) (*VerifyReport, error) {
+	report := &VerifyReport{Counts: make(map[string]int64), Missing: make(map[string][]int32)}
+	for _, collection := range StaticCollections {
+		var err error
+		report.Counts[collection], err = store.Count(collection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	existing := make(map[string]map[int32]bool)
+	for _, collection := range []string{"constellations", "solarsystems", "stars", "planets", "moons", "asteroid_belts", "stargates", "stations"} {
+		ids, err := store.GetIDs(collection)
+		if err != nil {
+			return nil, err
+		}
+		existing[collection] = make(map[int32]bool, len(ids))
+		for _, id := range ids {
+			existing[collection][id] = true
+		}
+	}
+
+	check := func(collection string, ids ...int) {
+		for _, id := range ids {
+			if id != 0 && !existing[collection][int32(id)] {
+				report.Missing[collection] = append(report.Missing[collection], int32(id))
+			}
+		}
+	}
+
+	regions, err := store.GetRegions()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range regions {
+		check("constellations", r.Constellations...)
+	}
+
+	constellations, err := store.GetConstellations()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range constellations {
+		check("solarsystems", c.Systems...)
+	}
+
+	systems, err := store.GetSystems()
+	if err != nil {
+		return nil, err
+	}
+	for _, sys := range systems {
+		check("stars", sys.StarID)
+		check("stargates", sys.Stargates...)
+		check("stations", sys.Stations...)
+		for _, p := range sys.Planets {
+			check("planets", p.PlanetID)
+			check("moons", p.Moons...)
+			check("asteroid_belts", p.AsteroidBelts...)
+		}
+	}
+
+	if len(report.Missing) == 0 {
+		report.Missing = nil
+	}
+
+	return report, nil
+}